@@ -0,0 +1,84 @@
+// Package asm parses assembly source and emits it through an x64.Emit.
+//
+// Assemble is the simplest way to turn source text into machine code:
+//
+//	code, err := asm.Assemble("xor eax, eax\nret", nil)
+//
+// A Parser can be used directly for more control over how the source is
+// read and which directives are accepted.
+package asm
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/kalamay/x86/instruction"
+	"github.com/kalamay/x86/operand"
+	"github.com/kalamay/x86/x64"
+)
+
+// Options configures Assemble and AssembleTo. The zero value is ready to use.
+type Options struct {
+	// Name is the file name reported in error positions.
+	Name string
+	// Syntax is the dialect of the source.
+	Syntax Syntax
+	// Instructions is the instruction set mnemonics are looked up in. The
+	// default is x64.Instructions.
+	Instructions *instruction.Set
+	// Directives are the directives accepted by the source.
+	Directives []Directive
+	// Reserved are the registers the source may not use.
+	Reserved []operand.Reg
+	// Include are the directories searched for included files.
+	Include []string
+	// MaxErrors is the number of errors after which assembly stops, or zero
+	// to report every error.
+	MaxErrors int
+	// Policy chooses among the encodings of a form in Assemble. The default
+	// uses the preferred encoding of each form.
+	Policy x64.Policy
+}
+
+// Assemble encodes src into machine code. Every error found is returned
+// in an ErrorList.
+func Assemble(src string, opts *Options) ([]byte, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	buf := bytes.Buffer{}
+
+	m := x64.NewMachine()
+	m.SetPolicy(opts.Policy)
+	e := x64.Emit{}
+	e.Open(m, &buf)
+	err := AssembleTo(&e, src, opts)
+	if err = Errors(err, e.Close(), opts.MaxErrors); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// AssembleTo parses src and emits each instruction and label into e. The
+// caller remains responsible for closing e.
+func AssembleTo(e *x64.Emit, src string, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	name := opts.Name
+	if name == "" {
+		name = "<input>"
+	}
+	data := opts.Instructions
+	if data == nil {
+		data = &x64.Instructions
+	}
+
+	p := Parser{Syntax: opts.Syntax, Include: opts.Include, MaxErrors: opts.MaxErrors}
+	p.SetDirectives(opts.Directives...)
+	p.Init(name, strings.NewReader(src))
+	for _, r := range opts.Reserved {
+		p.Reserved.Add(r)
+	}
+	return p.Eval(data, e)
+}
@@ -0,0 +1,511 @@
+package asm
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kalamay/x86/operand"
+	"github.com/kalamay/x86/x64"
+)
+
+func TestAssemble(t *testing.T) {
+	tests := []struct {
+		Source string
+		Opts   *Options
+		Expect []byte
+		Err    error
+	}{
+		{
+			Source: "xor eax, eax\nret",
+			Expect: []byte{0x31, 0xc0, 0xc3},
+		},
+		{
+			Source: "mov rax, QWORD PTR [rdi + 8]\nret",
+			Expect: []byte{0x48, 0x8b, 0x47, 0x08, 0xc3},
+		},
+		{
+			Source: "top:\ndec ecx\njne top",
+			Expect: []byte{0xff, 0xc9, 0x75, 0xfc},
+		},
+		{
+			Source: "f:\n.loop:\ndec ecx\njne .loop\n1:\ndec ecx\njne 1b\njmp 1f\nnop\n1:\ng:\n.loop:\njmp .loop",
+			Expect: []byte{0xff, 0xc9, 0x75, 0xfc, 0xff, 0xc9, 0x75, 0xfc, 0xeb, 0x01, 0x90, 0xeb, 0xfe},
+		},
+		{
+			Source: ".break\nret",
+			Opts:   &Options{Directives: []Directive{BreakNop}},
+			Expect: []byte{0xc3},
+		},
+		{
+			Source: "mov rbx, 1",
+			Opts:   &Options{Reserved: []operand.Reg{operand.RBX}},
+			Err:    ErrRegisterUnavailable,
+		},
+		{
+			Source: "xorl %eax, %eax\nret # done",
+			Opts:   &Options{Syntax: SyntaxATT},
+			Expect: []byte{0x31, 0xc0, 0xc3},
+		},
+		{
+			Source: "movq 8(%rdi), %rax\nmov -8(%rsp,%rcx,4), %edx",
+			Opts:   &Options{Syntax: SyntaxATT},
+			Expect: []byte{0x48, 0x8b, 0x47, 0x08, 0x8b, 0x54, 0x8c, 0xf8},
+		},
+		{
+			Source: "mov rax, [rbx*8 + 0x1000]\nmov eax, DWORD PTR [0x7fff0000]\nmov eax, [ebx*4 + 16]",
+			Expect: []byte{0x48, 0x8b, 0x04, 0xdd, 0x00, 0x10, 0x00, 0x00, 0x8b, 0x04, 0x25, 0x00, 0x00, 0xff, 0x7f, 0x67, 0x8b, 0x04, 0x9d, 0x10, 0x00, 0x00, 0x00},
+		},
+		{
+			Source: "mov eax, DWORD PTR fs:[rax]\nmov eax, fs:[rax]\nmov rax, QWORD PTR [fs:0x28]",
+			Expect: []byte{0x64, 0x8b, 0x00, 0x64, 0x8b, 0x00, 0x64, 0x48, 0x8b, 0x04, 0x25, 0x28, 0x00, 0x00, 0x00},
+		},
+		{
+			Source: "mov eax, fs:[gs:rax]",
+			Err:    ErrSIBInvalid,
+		},
+		{
+			Source: "mov rax, [4*rbx + rax]\nmov rax, [rbx*1]",
+			Expect: []byte{0x48, 0x8b, 0x04, 0x98, 0x48, 0x8b, 0x04, 0x1d, 0x00, 0x00, 0x00, 0x00},
+		},
+		{
+			Source: "mov rax, [rax - rbx]",
+			Err:    ErrSIBInvalid,
+		},
+		{
+			Source: "mov rax, [rax + rbx*3]",
+			Err:    ErrScaleInvalid,
+		},
+		{
+			Source: "mov rax, [rbp]\nmov rax, [r13]\nmov rax, [rbp + rcx*2]",
+			Expect: []byte{0x48, 0x8b, 0x45, 0x00, 0x49, 0x8b, 0x45, 0x00, 0x48, 0x8b, 0x44, 0x4d, 0x00},
+		},
+		{
+			Source: "movabs rax, [0x1122334455667788]\nmov rax, [0x1122334455667788]\nmovabs [0x1000], eax",
+			Expect: []byte{
+				0x48, 0xa1, 0x88, 0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11,
+				0x48, 0xa1, 0x88, 0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11,
+				0xa3, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			},
+		},
+		{
+			Source: "movabsq 0x1122334455667788, %rax\nmovl 0x1000, %eax\nmov (,%rbx,8), %rax",
+			Opts:   &Options{Syntax: SyntaxATT},
+			Expect: []byte{
+				0x48, 0xa1, 0x88, 0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11,
+				0x8b, 0x04, 0x25, 0x00, 0x10, 0x00, 0x00,
+				0x48, 0x8b, 0x04, 0xdd, 0x00, 0x00, 0x00, 0x00,
+			},
+		},
+		{
+			Source: "vpgatherdd xmm0, [rax + xmm1*4], xmm2",
+			Expect: []byte{0xc4, 0xe2, 0x69, 0x90, 0x04, 0x88},
+		},
+		{
+			Source: "vpgatherdd %ymm2, 8(%rax,%ymm9,4), %ymm0",
+			Opts:   &Options{Syntax: SyntaxATT},
+			Expect: []byte{0xc4, 0xa2, 0x6d, 0x90, 0x44, 0x88, 0x08},
+		},
+		{
+			Source: "addq $1, (%rdi)\nsubl $-2, %ecx",
+			Opts:   &Options{Syntax: SyntaxATT},
+			Expect: []byte{0x48, 0x83, 0x07, 0x01, 0x83, 0xe9, 0xfe},
+		},
+		{
+			Source: "top:\ndecl %ecx\njne top\nretq",
+			Opts:   &Options{Syntax: SyntaxATT},
+			Expect: []byte{0xff, 0xc9, 0x75, 0xfc, 0xc3},
+		},
+		{
+			Source: "jmp *%rax\ncall *%rcx\njmp *8(%rax)\njmpq *(%rax,%rcx,8)\njmp *%fs:16",
+			Opts:   &Options{Syntax: SyntaxATT},
+			Expect: []byte{0xff, 0xe0, 0xff, 0xd1, 0xff, 0x60, 0x08, 0xff, 0x24, 0xc8, 0x64, 0xff, 0x24, 0x25, 0x10, 0x00, 0x00, 0x00},
+		},
+		{
+			Source: "jmp *$8",
+			Opts:   &Options{Syntax: SyntaxATT},
+			Err:    ErrOperandExpected,
+		},
+		{
+			Source: "1:\ndecl %ecx\njne 1b\njmp 2f\n2:",
+			Opts:   &Options{Syntax: SyntaxATT},
+			Expect: []byte{0xff, 0xc9, 0x75, 0xfc, 0xeb, 0x00},
+		},
+		{
+			Source: "vaddps %ymm2, %ymm1, %ymm0",
+			Opts:   &Options{Syntax: SyntaxATT},
+			Expect: []byte{0xc5, 0xf4, 0x58, 0xc2},
+		},
+		{
+			Source: "movq %rax, %foo",
+			Opts:   &Options{Syntax: SyntaxATT},
+			Err:    ErrRegisterExpected,
+		},
+		{
+			Source: "#include \"textflag.h\"\n\nTEXT ·zero(SB), NOSPLIT, $0-8\n\tNO_LOCAL_POINTERS\n\tXORL AX, AX\n\tMOVQ AX, ret+0(FP)\n",
+			Opts:   &Options{Syntax: SyntaxGo},
+			Err:    ErrPseudoRegister,
+		},
+		{
+			Source: "MOVQ ·table<>(SB), AX",
+			Opts:   &Options{Syntax: SyntaxGo},
+			Err:    ErrPseudoRegister,
+		},
+		{
+			Source: "MOVQ x-8(SP), AX",
+			Opts:   &Options{Syntax: SyntaxGo},
+			Err:    ErrPseudoRegister,
+		},
+		{
+			Source: "LEAQ 0(PC), AX",
+			Opts:   &Options{Syntax: SyntaxGo},
+			Err:    ErrPseudoRegister,
+		},
+		{
+			Source: "MOVQ 8(SP), AX\nMOVQ foo+8(AX), AX",
+			Opts:   &Options{Syntax: SyntaxGo},
+			Err:    ErrSymbolUnsupported,
+		},
+		{
+			Source: "TEXT ·f(SB), NOSPLIT, $0\nXORL AX, AX\nMOVQ 8(DI)(CX*4), R9\nADDQ $-1, BX\nRET",
+			Opts:   &Options{Syntax: SyntaxGo},
+			Expect: []byte{0x31, 0xc0, 0x4c, 0x8b, 0x4c, 0x8f, 0x08, 0x48, 0x83, 0xc3, 0xff, 0xc3},
+		},
+		{
+			Source: "loop:\nDECL CX\nJNE loop\nVADDPS Y2, Y1, Y0\nMOVL $1, (SI)",
+			Opts:   &Options{Syntax: SyntaxGo},
+			Expect: []byte{0xff, 0xc9, 0x75, 0xfc, 0xc5, 0xf4, 0x58, 0xc2, 0xc7, 0x06, 0x01, 0x00, 0x00, 0x00},
+		},
+		{
+			Source: "%define N 4\nsection .text\nmov eax, N ; four\nret",
+			Opts:   &Options{Syntax: SyntaxNASM},
+			Expect: []byte{0xb8, 0x04, 0x00, 0x00, 0x00, 0xc3},
+		},
+		{
+			Source: "msg: db 'hi', 0\nlen equ $ - msg\nmov ecx, len * 2",
+			Opts:   &Options{Syntax: SyntaxNASM},
+			Expect: []byte{0x68, 0x69, 0x00, 0xb9, 0x06, 0x00, 0x00, 0x00},
+		},
+		{
+			Source: "off equ 8\nmov rax, [rbp - off]\nmov rax, [rbp + off]",
+			Opts:   &Options{Syntax: SyntaxNASM},
+			Expect: []byte{0x48, 0x8b, 0x45, 0xf8, 0x48, 0x8b, 0x45, 0x08},
+		},
+		{
+			Source: "dd 'ab'\ntimes 3 nop\nalign 8\ndw $-$$",
+			Opts:   &Options{Syntax: SyntaxNASM},
+			Expect: []byte{0x61, 0x62, 0x00, 0x00, 0x90, 0x90, 0x90, 0x90, 0x08, 0x00},
+		},
+		{
+			Source: "f:\n.loop:\nadd dword [rdi], 1\ndec ecx\njne .loop\njmp $",
+			Opts:   &Options{Syntax: SyntaxNASM},
+			Expect: []byte{0x83, 0x07, 0x01, 0xff, 0xc9, 0x75, 0xf9, 0xeb, 0xfe},
+		},
+		{
+			Source: "db 256",
+			Opts:   &Options{Syntax: SyntaxNASM},
+			Err:    ErrIntegerOverflow,
+		},
+		{
+			Source: "bits 8",
+			Opts:   &Options{Syntax: SyntaxNASM},
+			Err:    ErrModeUnsupported,
+		},
+		{
+			Source: "bits 16\nmov eax, 1\nmov ax, [bp + di]\nbits 64\ninc eax",
+			Opts:   &Options{Syntax: SyntaxNASM},
+			Expect: []byte{0x66, 0xb8, 0x01, 0x00, 0x00, 0x00, 0x8b, 0x03, 0xff, 0xc0},
+		},
+		{
+			Source: ".code16\nmov ax, [bx + si + 2]\ninc ax\n.code32\npush eax\nmov eax, [ebx]\n.code64\npush rax",
+			Expect: []byte{0x8b, 0x40, 0x02, 0x40, 0x50, 0x8b, 0x03, 0x50},
+		},
+		{
+			Source: ".code32\nmov eax, [0x1000]\nmov ecx, [ebx*4 + 0x1000]",
+			Expect: []byte{0x8b, 0x05, 0x00, 0x10, 0x00, 0x00, 0x8b, 0x0c, 0x9d, 0x00, 0x10, 0x00, 0x00},
+		},
+		{
+			Source: ".code32\npushl %ebp\nmovl %esp, %ebp\nincl %eax\nmov (%bx,%si), %al",
+			Opts:   &Options{Syntax: SyntaxATT},
+			Expect: []byte{0x55, 0x89, 0xe5, 0x40, 0x67, 0x8a, 0x00},
+		},
+		{
+			Source: ".code32\nmov rax, rbx",
+			Err:    x64.ErrModeOperand,
+		},
+		{
+			Source: "mov eax, float32(1.5)\nmov al, 'a'\nmov rax, float64(-2)",
+			Expect: []byte{0xb8, 0x00, 0x00, 0xc0, 0x3f, 0xb0, 0x61, 0x48, 0xb8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0},
+		},
+		{
+			Source: ".byte 'a', -1\n.float 1.5\n.asciz \"hi\"",
+			Expect: []byte{0x61, 0xff, 0x00, 0x00, 0xc0, 0x3f, 0x68, 0x69, 0x00},
+		},
+		{
+			Source: ".byte 1.5",
+			Err:    ErrIntegerExpected,
+		},
+		{
+			Source: "movl $float32(1.5), %eax\nmovb $'a', %al",
+			Opts:   &Options{Syntax: SyntaxATT},
+			Expect: []byte{0xb8, 0x00, 0x00, 0xc0, 0x3f, 0xb0, 0x61},
+		},
+		{
+			Source: "MOVL $float32(1.5), AX",
+			Opts:   &Options{Syntax: SyntaxGo},
+			Expect: []byte{0xb8, 0x00, 0x00, 0xc0, 0x3f},
+		},
+		{
+			Source: "dd 1.5, -2.0\ndq 1.0\nmov eax, __float32__(1.5)",
+			Opts:   &Options{Syntax: SyntaxNASM},
+			Expect: []byte{0x00, 0x00, 0xc0, 0x3f, 0x00, 0x00, 0x00, 0xc0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf0, 0x3f, 0xb8, 0x00, 0x00, 0xc0, 0x3f},
+		},
+		{
+			Source: "dw 1.5",
+			Opts:   &Options{Syntax: SyntaxNASM},
+			Err:    ErrFloatSize,
+		},
+		{
+			Source: "lock add dword ptr [rax], 1\nrep movsb\nrepne\ncmpsb",
+			Expect: []byte{0xf0, 0x83, 0x00, 0x01, 0xf3, 0xa4, 0xf2, 0xa6},
+		},
+		{
+			Source: "lock mov dword ptr [rax], 1",
+			Err:    x64.ErrLockInvalid,
+		},
+		{
+			Source: "lock; xaddq %rax, (%rdi)\nrep stosb",
+			Opts:   &Options{Syntax: SyntaxATT},
+			Expect: []byte{0xf0, 0x48, 0x0f, 0xc1, 0x07, 0xf3, 0xaa},
+		},
+		{
+			Source: "vaddps zmm1 {k1}{z}, zmm2, zmm3",
+			Err:    x64.ErrEVEXUnsupported,
+		},
+		{
+			Source: "vaddps %zmm3, %zmm2, %zmm1{%k1}{z}",
+			Opts:   &Options{Syntax: SyntaxATT},
+			Err:    x64.ErrEVEXUnsupported,
+		},
+		{
+			Source: "frob rax",
+			Err:    ErrMnemonicUnknown,
+		},
+		{
+			Source: ".break",
+			Err:    ErrDirectiveUnknown,
+		},
+	}
+
+	for _, test := range tests {
+		code, err := Assemble(test.Source, test.Opts)
+		if !errors.Is(err, test.Err) {
+			t.Errorf("unexpected error for %q: expect = %v, actual = %v", test.Source, test.Err, err)
+			continue
+		}
+		if !bytes.Equal(code, test.Expect) {
+			t.Errorf("failed to assemble %q:\n\texpect = % x\n\tactual = % x", test.Source, test.Expect, code)
+		}
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib")
+	files := map[string]string{
+		filepath.Join(dir, "main.s"):     ".include \"zero.s\"\nret",
+		filepath.Join(dir, "zero.s"):     ".include \"inc.s\"\nxor eax, eax",
+		filepath.Join(lib, "inc.s"):      "inc eax",
+		filepath.Join(dir, "loop.s"):     ".include \"loop.s\"",
+		filepath.Join(dir, "bad.s"):      "nop\n.include \"bad.inc\"",
+		filepath.Join(dir, "bad.inc"):    "nop\nfrob",
+		filepath.Join(dir, "consts.asm"): "%define N 3\n%define EMPTY\nSIZE equ 8",
+		filepath.Join(dir, "main.asm"):   "%include \"consts.asm\"\nmov eax, N + SIZE EMPTY",
+	}
+	if err := os.Mkdir(lib, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range files {
+		if err := os.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		Name   string
+		Opts   Options
+		Expect []byte
+		Err    error
+		Pos    string
+	}{
+		{
+			Name:   "main.s",
+			Opts:   Options{Include: []string{lib}},
+			Expect: []byte{0xff, 0xc0, 0x31, 0xc0, 0xc3},
+		},
+		{
+			Name: "main.s",
+			Err:  ErrIncludeNotFound,
+			Pos:  filepath.Join(dir, "zero.s") + ":1:10",
+		},
+		{
+			Name: "loop.s",
+			Err:  ErrIncludeCycle,
+		},
+		{
+			Name: "bad.s",
+			Err:  ErrMnemonicUnknown,
+			Pos:  filepath.Join(dir, "bad.inc") + ":2:1",
+		},
+		{
+			Name:   "main.asm",
+			Opts:   Options{Syntax: SyntaxNASM},
+			Expect: []byte{0xb8, 0x0b, 0x00, 0x00, 0x00},
+		},
+	}
+
+	for _, test := range tests {
+		name := filepath.Join(dir, test.Name)
+		src, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.Opts.Name = name
+		code, err := Assemble(string(src), &test.Opts)
+		if !errors.Is(err, test.Err) {
+			t.Errorf("unexpected error for %s: expect = %v, actual = %v", test.Name, test.Err, err)
+			continue
+		}
+		var perr *Error
+		if test.Pos != "" && (!errors.As(err, &perr) || perr.Position.String() != test.Pos) {
+			t.Errorf("unexpected position for %s: expect = %s, actual = %v", test.Name, test.Pos, err)
+		}
+		if !bytes.Equal(code, test.Expect) {
+			t.Errorf("failed to assemble %s:\n\texpect = % x\n\tactual = % x", test.Name, test.Expect, code)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	src := "mov eax, ]\nfrob\nxor eax, eax\nvaddps ymm0, ymm1, xmm2\nmov rax, [rdi + rcx * 3]\nret"
+	tests := []struct {
+		Max   int
+		Lines []int
+	}{
+		{Max: 0, Lines: []int{1, 2, 4, 5}},
+		{Max: 2, Lines: []int{1, 2}},
+	}
+
+	for _, test := range tests {
+		code, err := Assemble(src, &Options{MaxErrors: test.Max})
+		if code != nil {
+			t.Errorf("unexpected code with max %d: % x", test.Max, code)
+		}
+		list, ok := err.(ErrorList)
+		if !ok {
+			t.Errorf("expected an ErrorList with max %d, got %v", test.Max, err)
+			continue
+		}
+		lines := make([]int, len(list))
+		for i, err := range list {
+			lines[i] = positionOf(err).Line
+		}
+		if !reflect.DeepEqual(lines, test.Lines) {
+			t.Errorf("unexpected error lines with max %d: expect = %v, actual = %v\n%v", test.Max, test.Lines, lines, err)
+		}
+	}
+}
+
+func TestDecorations(t *testing.T) {
+	tests := []struct {
+		Source string
+		Syntax Syntax
+		Args   []string
+		Err    error
+	}{
+		{
+			Source: "vaddps zmm1 {k1}{z}, zmm2, DWORD PTR [rax]{1to16}",
+			Args:   []string{"zmm1 {k1}{z}", "zmm2", "DWORD PTR [rax]{1to16}"},
+		},
+		{
+			Source: "vaddps zmm1{k2}, zmm2, zmm3, {rz-sae}",
+			Args:   []string{"zmm1 {k2}", "zmm2", "zmm3", "{rz-sae}"},
+		},
+		{
+			Source: "vaddps zmm1, zmm2, [rax]{1to16}",
+			Syntax: SyntaxNASM,
+			Args:   []string{"zmm1", "zmm2", "[rax]{1to16}"},
+		},
+		{
+			Source: "vaddps {rn-sae}, %zmm3, %zmm2, %zmm1{%k1}{z}",
+			Syntax: SyntaxATT,
+			Args:   []string{"zmm1 {k1}{z}", "zmm2", "zmm3", "{rn-sae}"},
+		},
+		{
+			Source: "vaddps (%rax){1to16}, %zmm2, %zmm1",
+			Syntax: SyntaxATT,
+			Args:   []string{"zmm1", "zmm2", "DWORD PTR [rax]{1to16}"},
+		},
+		{Source: "vaddps zmm1{z}, zmm2, zmm3", Err: ErrMaskExpected},
+		{Source: "vaddps zmm1{k0}, zmm2, zmm3", Err: ErrMaskExpected},
+		{Source: "vaddps zmm1, zmm2, [rax]{1to3}", Err: ErrDecoratorInvalid},
+		{Source: "vaddps zmm1{1to16}, zmm2, zmm3", Err: ErrDecoratorInvalid},
+		{Source: "vaddps zmm1, zmm2, zmm3, {rx-sae}", Err: ErrDecoratorInvalid},
+	}
+
+	for _, test := range tests {
+		prog := x64.NewProgram()
+		e := x64.Emit{}
+		e.Open(prog, nil)
+		err := AssembleTo(&e, test.Source, &Options{Syntax: test.Syntax})
+		if !errors.Is(err, test.Err) {
+			t.Errorf("unexpected error for %q: expect = %v, actual = %v", test.Source, test.Err, err)
+			continue
+		}
+		if test.Err != nil {
+			continue
+		}
+		call, ok := prog.At(0).(*x64.EmitCall)
+		if prog.Len() != 1 || !ok {
+			t.Errorf("expected one instruction for %q", test.Source)
+			continue
+		}
+		args := make([]string, len(call.Args))
+		for i, arg := range call.Args {
+			args[i] = arg.String()
+		}
+		if !reflect.DeepEqual(args, test.Args) {
+			t.Errorf("unexpected operands for %q:\n\texpect = %q\n\tactual = %q", test.Source, test.Args, args)
+		}
+	}
+}
+
+func TestMemString(t *testing.T) {
+	tests := []operand.Mem{
+		{Size: operand.Size32, Base: operand.RAX},
+		{Size: operand.Size32, Base: operand.RAX, Segment: operand.FS},
+		{Size: operand.Size32, Base: operand.RBX, Index: operand.RCX, Scale: operand.Size32, Disp: -8, Segment: operand.GS},
+		{Size: operand.Size32, Index: operand.RDX, Scale: operand.Size64, Disp: 0x1000},
+		{Size: operand.Size32, Index: operand.RBX, Scale: operand.Size8},
+		{Size: operand.Size32, Base: operand.RIP, Disp: 16},
+		{Size: operand.Size32, Disp: 0x28, Segment: operand.FS},
+	}
+
+	for _, mem := range tests {
+		src := "mov eax, " + mem.String()
+		prog := x64.NewProgram()
+		e := x64.Emit{}
+		e.Open(prog, nil)
+		if err := AssembleTo(&e, src, nil); err != nil {
+			t.Errorf("failed to parse %q: %v", src, err)
+			continue
+		}
+		call, ok := prog.At(0).(*x64.EmitCall)
+		if !ok || len(call.Args) != 2 || !reflect.DeepEqual(call.Args[1], mem) {
+			t.Errorf("unexpected operands for %q: %v", src, call.Args)
+		}
+	}
+}
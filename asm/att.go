@@ -0,0 +1,89 @@
+package asm
+
+import (
+	"github.com/kalamay/x86/operand"
+)
+
+func (p *Parser) argATT() (operand.Arg, error) {
+	val, err := p.Peek()
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := val.(type) {
+	case uint64:
+		return p.memATT()
+	case rune:
+		switch v {
+		case '%':
+			p.Next()
+			reg, err := p.Reg()
+			if err != nil {
+				return nil, err
+			}
+			if reg.Type() == operand.RegTypeSegment && p.Maybe(rune(':')) {
+				mem, err := p.memATT()
+				mem.Segment = reg
+				return mem, err
+			}
+			return reg, nil
+		case '$':
+			p.Next()
+			return p.imm()
+		case '(', '-':
+			return p.memATT()
+		case '{':
+			return p.rounding()
+		}
+	}
+	return nil, p.NewError(ErrOperandExpected)
+}
+
+func (p *Parser) memATT() (mem operand.Mem, err error) {
+	// A number without a parenthesized address is an absolute address.
+	if val, _ := p.Peek(); val != nil {
+		if n, ok := val.(uint64); ok {
+			p.Next()
+			if !p.Maybe(rune('(')) {
+				return operand.AbsAddr(n), nil
+			}
+			if mem.Disp, ok = addUint(0, n); !ok {
+				return mem, p.NewError(ErrDisplacementInvalid)
+			}
+			return p.addrATT(mem)
+		}
+	}
+
+	if mem.Disp, err = p.disp(); err != nil {
+		return
+	}
+	if err = p.Expect(rune('(')); err != nil {
+		return
+	}
+	return p.addrATT(mem)
+}
+
+// addrATT parses the registers of an address after its '('.
+func (p *Parser) addrATT(mem operand.Mem) (operand.Mem, error) {
+	var err error
+	if p.Maybe(rune('%')) {
+		if mem.Base, err = p.Reg(); err != nil {
+			return mem, err
+		}
+	}
+	if p.Maybe(rune(',')) {
+		if err = p.Expect(rune('%')); err != nil {
+			return mem, err
+		}
+		if mem.Index, err = p.Reg(); err != nil {
+			return mem, err
+		}
+		mem.Scale = operand.Size8
+		if p.Maybe(rune(',')) {
+			if mem.Scale, err = p.Scale(); err != nil {
+				return mem, err
+			}
+		}
+	}
+	return mem, p.Expect(rune(')'))
+}
@@ -1,4 +1,4 @@
-package parser
+package asm
 
 import (
 	"github.com/kalamay/x86/operand"
@@ -0,0 +1,185 @@
+package asm
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"text/scanner"
+
+	"github.com/kalamay/x86/instruction"
+	"github.com/kalamay/x86/operand"
+	"github.com/kalamay/x86/x64"
+)
+
+// dataKind is the element type of a data directive.
+type dataKind struct {
+	size  int
+	float bool
+	str   bool
+	zero  bool
+}
+
+// gasData are the data directives of the GNU assembler.
+var gasData = map[string]dataKind{
+	"byte":   {size: 1},
+	"word":   {size: 2},
+	"short":  {size: 2},
+	"long":   {size: 4},
+	"int":    {size: 4},
+	"quad":   {size: 8},
+	"float":  {size: 4, float: true},
+	"single": {size: 4, float: true},
+	"double": {size: 8, float: true},
+	"ascii":  {str: true},
+	"asciz":  {str: true, zero: true},
+	"string": {str: true, zero: true},
+}
+
+// dataGAS parses the values of a GNU assembler data directive and emits
+// them as data.
+func (p *Parser) dataGAS(d dataKind) error {
+	pos := p.pos
+	var b []byte
+	for {
+		var err error
+		if d.str {
+			b, err = p.appendString(b, d.zero)
+		} else {
+			b, err = p.appendValue(b, d)
+		}
+		if err != nil {
+			return err
+		}
+		if !p.Maybe(rune(',')) {
+			break
+		}
+	}
+	for _, call := range dataCalls(b, pos) {
+		p.emitCall(call)
+	}
+	return nil
+}
+
+func (p *Parser) appendString(b []byte, zero bool) ([]byte, error) {
+	val, err := p.Next()
+	if err != nil {
+		return nil, err
+	}
+	s, ok := val.(quoted)
+	if !ok {
+		return nil, p.NewError(ErrStringExpected)
+	}
+	b = append(b, s...)
+	if zero {
+		b = append(b, 0)
+	}
+	return b, nil
+}
+
+func (p *Parser) appendValue(b []byte, d dataKind) ([]byte, error) {
+	neg := p.Maybe(rune('-'))
+	val, err := p.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	var n uint64
+	switch v := val.(type) {
+	case float64:
+		if !d.float {
+			return nil, p.NewError(ErrIntegerExpected)
+		}
+		if neg {
+			v = -v
+		}
+		n = floatBitsOf(v, d.size)
+	case uint64:
+		if d.float {
+			f := float64(v)
+			if neg {
+				f = -f
+			}
+			n = floatBitsOf(f, d.size)
+			break
+		}
+		if neg {
+			if v > 1<<(d.size*8-1) {
+				return nil, p.NewError(ErrIntegerOverflow)
+			}
+			v = -v
+		} else if d.size < 8 && v >= 1<<(d.size*8) {
+			return nil, p.NewError(ErrIntegerOverflow)
+		}
+		n = v
+	default:
+		return nil, p.NewError(ErrIntegerExpected)
+	}
+	return appendUint(b, n, d.size), nil
+}
+
+func appendUint(b []byte, n uint64, size int) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], n)
+	return append(b, buf[:size]...)
+}
+
+// dataCalls splits b into calls of the data pseudo-instruction.
+func dataCalls(b []byte, pos scanner.Position) []*x64.EmitCall {
+	var calls []*x64.EmitCall
+	for len(b) > 0 {
+		n := len(b)
+		if n > len(instruction.Format{}.Val) {
+			n = len(instruction.Format{}.Val)
+		}
+		calls = append(calls, newCall(x64.DataInstruction, []operand.Arg{operand.Data(b[:n])}, pos))
+		b = b[n:]
+	}
+	return calls
+}
+
+// floatSize returns the size in bytes of the float function name, as in
+// float32(1.5). NASM also names these __float32__ and __float64__.
+func floatSize(name string) (int, bool) {
+	switch strings.Trim(strings.ToLower(name), "_") {
+	case "float32":
+		return 4, true
+	case "float64":
+		return 8, true
+	}
+	return 0, false
+}
+
+// floatBits parses the parenthesized number following the float function
+// name and returns its bit pattern.
+func (p *Parser) floatBits(name string) (uint64, error) {
+	size, _ := floatSize(name)
+	if err := p.Expect(rune('(')); err != nil {
+		return 0, err
+	}
+	neg := p.Maybe(rune('-'))
+	val, err := p.Next()
+	if err != nil {
+		return 0, err
+	}
+
+	var f float64
+	switch v := val.(type) {
+	case float64:
+		f = v
+	case uint64:
+		f = float64(v)
+	default:
+		return 0, p.NewError(ErrFloatInvalid)
+	}
+	if neg {
+		f = -f
+	}
+	return floatBitsOf(f, size), p.Expect(rune(')'))
+}
+
+func floatBitsOf(f float64, size int) uint64 {
+	if size == 4 {
+		return uint64(math.Float32bits(float32(f)))
+	}
+	return math.Float64bits(f)
+}
@@ -1,4 +1,4 @@
-package parser
+package asm
 
 type Directive interface {
 	Name() string
@@ -0,0 +1,105 @@
+package asm
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"text/scanner"
+
+	"github.com/kalamay/x86/x64"
+)
+
+// ErrorList is a list of parsing and encoding errors.
+type ErrorList []error
+
+// Add appends err to the list. The errors of another ErrorList are added
+// one by one.
+func (l *ErrorList) Add(err error) {
+	if list, ok := err.(ErrorList); ok {
+		*l = append(*l, list...)
+	} else if err != nil {
+		*l = append(*l, err)
+	}
+}
+
+// Sort orders the errors by file name and position. Errors without a
+// position come first.
+func (l ErrorList) Sort() {
+	sort.SliceStable(l, func(i, j int) bool {
+		a, b := positionOf(l[i]), positionOf(l[j])
+		switch {
+		case a.Filename != b.Filename:
+			return a.Filename < b.Filename
+		case a.Line != b.Line:
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// Err returns l, or nil if l is empty.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, err := range l {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Is reports whether any error in l matches target.
+func (l ErrorList) Is(target error) bool {
+	for _, err := range l {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error in l that matches target.
+func (l ErrorList) As(target interface{}) bool {
+	for _, err := range l {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Errors combines the error returned by Parser.Eval with the errors returned
+// by closing its emitter. The errors are sorted by position, and only the
+// first max are kept if max is positive.
+func Errors(err error, closeErrs []error, max int) error {
+	var l ErrorList
+	l.Add(err)
+	for _, err := range closeErrs {
+		l.Add(err)
+	}
+	l.Sort()
+	if max > 0 && len(l) > max {
+		l = l[:max]
+	}
+	return l.Err()
+}
+
+func positionOf(err error) scanner.Position {
+	var (
+		perr *Error
+		eerr *x64.Error
+	)
+	switch {
+	case errors.As(err, &perr):
+		return perr.Position
+	case errors.As(err, &eerr) && eerr.Value != nil:
+		pos := eerr.Value.Position()
+		return scanner.Position{Filename: pos.Filename, Line: pos.Line, Column: pos.Column}
+	}
+	return scanner.Position{}
+}
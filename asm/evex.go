@@ -0,0 +1,92 @@
+package asm
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/kalamay/x86/operand"
+)
+
+// decorate parses the AVX-512 decorations that follow a register or memory
+// operand: an opmask as in {k1} with an optional {z} for zeroing, or a
+// broadcast as in {1to16}.
+func (p *Parser) decorate(arg operand.Arg) (operand.Arg, error) {
+	var d operand.Decorations
+	for p.Maybe(rune('{')) {
+		val, err := p.Peek()
+		if err != nil {
+			return nil, err
+		}
+		switch v := val.(type) {
+		case uint64:
+			// A broadcast such as {1to16} scans as 1 followed by "to16".
+			p.Next()
+			var name string
+			if name, err = p.Ident(); err == nil {
+				err = p.check(d.Add(strconv.FormatUint(v, 10) + name))
+			}
+		case string:
+			if strings.EqualFold(v, "z") {
+				p.Next()
+				err = p.check(d.Add(v))
+			} else {
+				err = p.mask(&d)
+			}
+		default:
+			err = p.mask(&d)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := p.Expect(rune('}')); err != nil {
+			return nil, err
+		}
+	}
+
+	arg, err := d.Apply(arg)
+	return arg, p.check(err)
+}
+
+// mask parses the opmask register of a decoration. AT&T syntax writes it
+// with a '%', as in {%k1}.
+func (p *Parser) mask(d *operand.Decorations) error {
+	if p.Syntax == SyntaxATT {
+		if err := p.Expect(rune('%')); err != nil {
+			return err
+		}
+	}
+	k, err := p.Reg()
+	if err != nil {
+		return err
+	}
+	return p.check(d.Add(k.String()))
+}
+
+// rounding parses a standalone {sae} operand or a rounding mode such as
+// {rn-sae}.
+func (p *Parser) rounding() (operand.Arg, error) {
+	if err := p.Expect(rune('{')); err != nil {
+		return nil, err
+	}
+	name, err := p.Ident()
+	if err != nil {
+		return nil, err
+	}
+	var arg operand.Arg
+	if p.Maybe(rune('-')) {
+		sae, err := p.Ident()
+		if err != nil {
+			return nil, err
+		}
+		r, ok := operand.RoundOf(name + "-" + sae)
+		if !ok {
+			return nil, p.NewError(ErrDecoratorInvalid)
+		}
+		arg = r
+	} else if strings.EqualFold(name, "sae") {
+		arg = operand.Misc(operand.SAE)
+	} else {
+		return nil, p.NewError(ErrDecoratorInvalid)
+	}
+	return arg, p.Expect(rune('}'))
+}
@@ -0,0 +1,77 @@
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// include parses the name of a file and continues parsing from the start of
+// that file. The file is looked for relative to the including file, then in
+// each of the Include directories.
+func (p *Parser) include() error {
+	val, err := p.Next()
+	if err != nil {
+		return err
+	}
+	pos := p.scan.Position
+	name, ok := val.(quoted)
+	if !ok {
+		return p.NewError(ErrStringExpected)
+	}
+
+	path, ok := p.findInclude(string(name))
+	if !ok {
+		return NewError(fmt.Errorf("%w: %s", ErrIncludeNotFound, name), pos)
+	}
+	if p.including(path) {
+		return NewError(fmt.Errorf("%w: %s", ErrIncludeCycle, name), pos)
+	}
+
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return NewError(err, pos)
+	}
+	p.frames = append(p.frames, p.scan)
+	p.open(path, bytes.NewReader(src))
+	return nil
+}
+
+func (p *Parser) findInclude(name string) (string, bool) {
+	if filepath.IsAbs(name) {
+		return name, exists(name)
+	}
+	dirs := append([]string{filepath.Dir(p.scan.Filename)}, p.Include...)
+	for _, dir := range dirs {
+		if path := filepath.Join(dir, name); exists(path) {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// including reports whether path is the current file or one of the files
+// including it.
+func (p *Parser) including(path string) bool {
+	if samePath(path, p.scan.Filename) {
+		return true
+	}
+	for _, s := range p.frames {
+		if samePath(path, s.Filename) {
+			return true
+		}
+	}
+	return false
+}
+
+func samePath(a, b string) bool {
+	a, aerr := filepath.Abs(a)
+	b, berr := filepath.Abs(b)
+	return aerr == nil && berr == nil && a == b
+}
+
+func exists(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && !fi.IsDir()
+}
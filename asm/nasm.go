@@ -0,0 +1,477 @@
+package asm
+
+import (
+	"strconv"
+	"strings"
+	"text/scanner"
+	"unicode"
+
+	"github.com/kalamay/x86/instruction"
+	"github.com/kalamay/x86/operand"
+	"github.com/kalamay/x86/x64"
+)
+
+// quoted is a string literal in NASM syntax.
+type quoted string
+
+// nasmSizes are the NASM size keywords not known to operand.MemSizeOf.
+var nasmSizes = map[string]operand.Size{
+	"oword": operand.Size128,
+	"yword": operand.Size256,
+	"zword": operand.Size512,
+}
+
+// nasmData are the data directives and the size of their elements.
+var nasmData = map[string]int{
+	"db": 1,
+	"dw": 2,
+	"dd": 4,
+	"dq": 8,
+}
+
+func nasmIdentRune(ch rune, i int) bool {
+	return ch == '_' || ch == '.' || ch == '$' || ch == '@' || ch == '?' ||
+		unicode.IsLetter(ch) || (unicode.IsDigit(ch) && i > 0)
+}
+
+// token is a scanned token saved for later, such as in a %define.
+type token struct {
+	tok rune
+	txt string
+}
+
+// define parses a %define with the rest of the line as its value. Names in
+// the value that are already defined are expanded.
+func (p *Parser) define() error {
+	if p.scan.Scan() != scanner.Ident {
+		return p.NewError(ErrIdentifierExpected)
+	}
+	name := p.scan.TokenText()
+
+	var b strings.Builder
+	for ch := p.scan.Peek(); ch >= 0 && ch != '\n'; ch = p.scan.Peek() {
+		b.WriteRune(p.scan.Next())
+	}
+
+	s := &scanner.Scanner{}
+	s.Init(strings.NewReader(b.String()))
+	s.Mode = scanner.ScanIdents | scanner.ScanInts
+	s.IsIdentRune = nasmIdentRune
+
+	var body []token
+	for tok := s.Scan(); tok != scanner.EOF && tok != ';'; tok = s.Scan() {
+		switch {
+		case isQuote(tok):
+			str, ok := readQuote(s, tok)
+			if !ok {
+				return p.NewError(ErrStringUnterminated)
+			}
+			body = append(body, token{scanner.String, strconv.Quote(str)})
+		case tok == scanner.Ident && p.defined(s.TokenText()):
+			body = append(body, p.defines[s.TokenText()]...)
+		default:
+			body = append(body, token{tok, s.TokenText()})
+		}
+	}
+	p.defines[name] = body
+	return nil
+}
+
+func (p *Parser) defined(name string) bool {
+	_, ok := p.defines[name]
+	return ok
+}
+
+func isQuote(tok rune) bool {
+	return tok == '\'' || tok == '"' || tok == '`'
+}
+
+// readQuote reads the rest of a string literal opened by q. NASM strings
+// have no escapes.
+func readQuote(s *scanner.Scanner, q rune) (string, bool) {
+	var b strings.Builder
+	for {
+		ch := s.Next()
+		switch ch {
+		case q:
+			return b.String(), true
+		case scanner.EOF, '\n':
+			return "", false
+		}
+		b.WriteRune(ch)
+	}
+}
+
+// localName expands a NASM local label, which starts with a single '.', to
+// include the name of the preceding non-local label.
+func (p *Parser) localName(name string) string {
+	if strings.HasPrefix(name, ".") && !strings.HasPrefix(name, "..") {
+		return p.global + name
+	}
+	return name
+}
+
+// target returns the label for the branch target name. A target of $ is
+// replaced by an anonymous label at the current position.
+func (p *Parser) target(name string) string {
+	if name == "$" {
+		name = "$" + strconv.Itoa(p.anon)
+		p.anon++
+		p.emit.Label(name)
+		return name
+	}
+	return p.localName(name)
+}
+
+// argNASM parses the NASM operands that are not in Intel syntax: constant
+// expressions and immediates with a size keyword. It returns false if val
+// does not start such an operand.
+func (p *Parser) argNASM(val interface{}) (operand.Arg, bool, error) {
+	if sz, ok := val.(operand.Size); ok {
+		p.Next()
+		if next, _ := p.Peek(); next == rune('[') {
+			arg, err := p.Mem(sz)
+			return arg, true, err
+		}
+		val, _ = p.Peek()
+		if !p.isConst(val) {
+			return nil, true, p.NewError(ErrOperandExpected)
+		}
+	} else if !p.isConst(val) {
+		return nil, false, nil
+	}
+	v, err := p.expr()
+	if err != nil {
+		return nil, true, err
+	}
+	return immArg(v), true, nil
+}
+
+// statementNASM parses a NASM statement starting with name.
+func (p *Parser) statementNASM(data *instruction.Set, e *x64.Emit, name string, pos scanner.Position) error {
+	switch strings.ToLower(name) {
+	case "section", "segment":
+		p.skipLine()
+		p.origin, p.originKnown = e.Offset()
+		return nil
+	case "bits":
+		n, err := p.expr()
+		if err != nil {
+			return err
+		}
+		switch n {
+		case 16:
+			e.SetMode(x64.Mode16)
+		case 32:
+			e.SetMode(x64.Mode32)
+		case 64:
+			e.SetMode(x64.Mode64)
+		default:
+			return NewError(ErrModeUnsupported, pos)
+		}
+		return nil
+	case "default", "global", "extern", "cpu":
+		p.skipLine()
+		return nil
+	case "align":
+		n, err := p.expr()
+		if err != nil {
+			return err
+		}
+		off, ok := e.Offset()
+		if !ok {
+			return NewError(ErrPositionUnknown, pos)
+		}
+		if n <= 0 || n&(n-1) != 0 {
+			return NewError(ErrAlignInvalid, pos)
+		}
+		if pad := (n - int64(off)%n) % n; pad > 0 {
+			e.Data([]byte(strings.Repeat("\x90", int(pad))))
+		}
+		return nil
+	case "times":
+		n, err := p.expr()
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return NewError(ErrCountInvalid, pos)
+		}
+		pos = p.scan.Position
+		name, err := p.Ident()
+		if err != nil {
+			return err
+		}
+		calls, err := p.callsNASM(data, name, pos)
+		if err != nil {
+			return err
+		}
+		for i := int64(0); i < n; i++ {
+			for _, call := range calls {
+				c := *call
+				c.Args = append([]operand.Arg(nil), call.Args...)
+				p.emitCall(&c)
+			}
+		}
+		return nil
+	}
+
+	if p.Maybe(rune(':')) {
+		if !strings.HasPrefix(name, ".") {
+			p.global = name
+		}
+		name = p.localName(name)
+		if off, ok := e.Offset(); ok {
+			p.labels[name] = off
+		}
+		e.Label(name)
+		return nil
+	}
+	if next, _ := p.Peek(); next != nil {
+		if s, ok := next.(string); ok && strings.EqualFold(s, "equ") {
+			p.Next()
+			v, err := p.expr()
+			if err != nil {
+				return err
+			}
+			p.consts[name] = v
+			return nil
+		}
+	}
+
+	calls, err := p.callsNASM(data, name, pos)
+	for _, call := range calls {
+		p.emitCall(call)
+	}
+	return err
+}
+
+// callsNASM parses an instruction or data directive.
+func (p *Parser) callsNASM(data *instruction.Set, name string, pos scanner.Position) ([]*x64.EmitCall, error) {
+	if size, ok := nasmData[strings.ToLower(name)]; ok {
+		b, err := p.dataNASM(size)
+		if err != nil {
+			return nil, err
+		}
+		return dataCalls(b, pos), nil
+	}
+
+	inst := data.Lookup(name)
+	if inst == nil {
+		return nil, NewError(ErrMnemonicUnknown, pos)
+	}
+	args, err := p.Args(inst)
+	if err != nil {
+		return nil, err
+	}
+	return []*x64.EmitCall{newCall(inst, args, pos)}, nil
+}
+
+// dataNASM parses the values of a data directive with elements of size
+// bytes. Strings are padded with zeros to a multiple of size.
+func (p *Parser) dataNASM(size int) ([]byte, error) {
+	var b []byte
+	for {
+		val, err := p.Peek()
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := val.(quoted); ok {
+			p.Next()
+			b = append(b, s...)
+			for len(b)%size != 0 {
+				b = append(b, 0)
+			}
+		} else {
+			v, f, float, err := p.exprNASM()
+			switch {
+			case err != nil:
+				return nil, err
+			case float && size != 4 && size != 8:
+				return nil, p.NewError(ErrFloatSize)
+			case float:
+				b = appendUint(b, floatBitsOf(f, size), size)
+			case size < 8 && (v < -(1<<(size*8-1)) || v >= 1<<(size*8)):
+				return nil, p.NewError(ErrIntegerOverflow)
+			default:
+				b = appendUint(b, uint64(v), size)
+			}
+		}
+		if !p.Maybe(rune(',')) {
+			return b, nil
+		}
+	}
+}
+
+// exprNASM parses a value of a data directive, which is either a constant
+// expression or a floating-point number.
+func (p *Parser) exprNASM() (v int64, f float64, float bool, err error) {
+	neg := p.Maybe(rune('-'))
+	if val, _ := p.Peek(); val != nil {
+		if f, float = val.(float64); float {
+			p.Next()
+			if neg {
+				f = -f
+			}
+			return 0, f, true, nil
+		}
+	}
+	if v, err = p.unary(); err == nil && neg {
+		v = -v
+	}
+	v, err = p.exprFrom(p.productFrom(v, err))
+	return v, 0, false, err
+}
+
+// expr parses a constant expression.
+func (p *Parser) expr() (int64, error) {
+	return p.exprFrom(p.product())
+}
+
+// exprFrom parses the rest of a sum starting with v.
+func (p *Parser) exprFrom(v int64, err error) (int64, error) {
+	for err == nil {
+		var w int64
+		switch {
+		case p.Maybe(rune('+')):
+			if w, err = p.product(); err == nil {
+				v += w
+			}
+		case p.Maybe(rune('-')):
+			if w, err = p.product(); err == nil {
+				v -= w
+			}
+		default:
+			return v, nil
+		}
+	}
+	return 0, err
+}
+
+func (p *Parser) product() (int64, error) {
+	return p.productFrom(p.unary())
+}
+
+// productFrom parses the rest of a product starting with v.
+func (p *Parser) productFrom(v int64, err error) (int64, error) {
+	for err == nil {
+		var w int64
+		switch {
+		case p.Maybe(rune('*')):
+			if w, err = p.unary(); err == nil {
+				v *= w
+			}
+		case p.Maybe(rune('/')):
+			if w, err = p.divisor(); err == nil {
+				v /= w
+			}
+		case p.Maybe(rune('%')):
+			if w, err = p.divisor(); err == nil {
+				v %= w
+			}
+		default:
+			return v, nil
+		}
+	}
+	return 0, err
+}
+
+func (p *Parser) divisor() (int64, error) {
+	v, err := p.unary()
+	if err == nil && v == 0 {
+		err = p.NewError(ErrDivideByZero)
+	}
+	return v, err
+}
+
+func (p *Parser) unary() (int64, error) {
+	switch {
+	case p.Maybe(rune('-')):
+		v, err := p.unary()
+		return -v, err
+	case p.Maybe(rune('+')):
+		return p.unary()
+	case p.Maybe(rune('~')):
+		v, err := p.unary()
+		return ^v, err
+	}
+
+	val, err := p.Next()
+	if err != nil {
+		return 0, err
+	}
+	switch v := val.(type) {
+	case uint64:
+		return int64(v), nil
+	case rune:
+		if v == '(' {
+			n, err := p.expr()
+			if err == nil {
+				err = p.Expect(rune(')'))
+			}
+			return n, err
+		}
+	case quoted:
+		if len(v) > 0 && len(v) <= 8 {
+			n := int64(0)
+			for i := len(v) - 1; i >= 0; i-- {
+				n = n<<8 | int64(v[i])
+			}
+			return n, nil
+		}
+	case string:
+		if _, ok := floatSize(v); ok {
+			n, err := p.floatBits(v)
+			return int64(n), err
+		}
+		switch v {
+		case "$":
+			if off, ok := p.emit.Offset(); ok {
+				return int64(off), nil
+			}
+			return 0, p.NewError(ErrPositionUnknown)
+		case "$$":
+			if p.originKnown {
+				return int64(p.origin), nil
+			}
+			return 0, p.NewError(ErrPositionUnknown)
+		}
+		if n, ok := p.consts[v]; ok {
+			return n, nil
+		}
+		if off, ok := p.labels[p.localName(v)]; ok {
+			return int64(off), nil
+		}
+	}
+	return 0, p.NewError(ErrConstantExpected)
+}
+
+// isConst reports whether val starts a constant expression.
+func (p *Parser) isConst(val interface{}) bool {
+	switch v := val.(type) {
+	case uint64, quoted:
+		return true
+	case rune:
+		return v == '(' || v == '-' || v == '+' || v == '~'
+	case string:
+		_, ok := p.consts[v]
+		_, float := floatSize(v)
+		return ok || float || v == "$" || v == "$$"
+	}
+	return false
+}
+
+func immArg(v int64) operand.Arg {
+	if v < 0 {
+		return operand.Int(v)
+	}
+	return operand.Uint(v)
+}
+
+func nasmSizeOf(name string) (operand.Size, bool) {
+	if sz, ok := operand.MemSizeOf(name); ok {
+		return sz, true
+	}
+	sz, ok := nasmSizes[strings.ToLower(name)]
+	return sz, ok
+}
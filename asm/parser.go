@@ -0,0 +1,988 @@
+package asm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/scanner"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kalamay/x86/instruction"
+	"github.com/kalamay/x86/operand"
+	"github.com/kalamay/x86/x64"
+)
+
+var (
+	ErrDirectiveUnknown       = errors.New("unknown directive")
+	ErrDisplacementInvalid    = operand.ErrDispInvalid
+	ErrIdentifierExpected     = errors.New("identifier expected")
+	ErrInputUnexpected        = errors.New("unexpected input")
+	ErrIntegerExpected        = errors.New("integer expected")
+	ErrIntegerOverflow        = errors.New("integer overflow")
+	ErrMnemonicUnknown        = errors.New("unknown mnemonic")
+	ErrOperandExpected        = errors.New("operand expected")
+	ErrPTRExpected            = errors.New(`"PTR" expected`)
+	ErrRegisterExpected       = errors.New("register expected")
+	ErrRegisterTypeUnexpected = errors.New("unexpected register type")
+	ErrRegisterUnavailable    = errors.New("register is unavailable")
+	ErrSIBInvalid             = operand.ErrAddressInvalid
+	ErrScaleInvalid           = operand.ErrInvalidScale
+	ErrStringUnterminated     = errors.New("unterminated string")
+	ErrConstantExpected       = errors.New("constant expected")
+	ErrDivideByZero           = errors.New("division by zero")
+	ErrPositionUnknown        = errors.New("position is not known before a forward branch is resolved")
+	ErrAlignInvalid           = errors.New("alignment must be a power of two")
+	ErrCountInvalid           = errors.New("invalid repeat count")
+	ErrModeUnsupported        = errors.New("mode must be 16, 32 or 64 bits")
+	ErrStringExpected         = errors.New("string expected")
+	ErrIncludeNotFound        = errors.New("include file not found")
+	ErrIncludeCycle           = errors.New("include cycle")
+	ErrFloatInvalid           = errors.New("invalid floating-point number")
+	ErrFloatSize              = errors.New("floating-point number must be 32 or 64 bits")
+	ErrCharInvalid            = errors.New("invalid character literal")
+	ErrDecoratorInvalid       = operand.ErrDecoratorInvalid
+	ErrMaskExpected           = operand.ErrMaskExpected
+	ErrPseudoRegister         = errors.New("pseudo-register not supported")
+	ErrSymbolUnsupported      = errors.New("symbol reference not supported")
+)
+
+type Error struct {
+	scanner.Position
+	Err error
+}
+
+func NewError(err error, at scanner.Position) *Error {
+	return &Error{Position: at, Err: err}
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v", e.Position, e.Err)
+}
+
+// prefixes are the instruction prefixes, which apply to the instruction
+// that follows on the same line or the next.
+var prefixes = map[string]x64.Prefix{
+	"lock":  x64.PrefixLock,
+	"rep":   x64.PrefixRep,
+	"repe":  x64.PrefixRep,
+	"repz":  x64.PrefixRep,
+	"repne": x64.PrefixRepne,
+	"repnz": x64.PrefixRepne,
+}
+
+type RegisterSet map[operand.Reg]struct{}
+
+func (rs RegisterSet) Add(r operand.Reg) {
+	rs[r] = struct{}{}
+}
+
+func (rs RegisterSet) Contains(r operand.Reg) bool {
+	_, ok := rs[r]
+	return ok
+}
+
+func (rs RegisterSet) Copy() RegisterSet {
+	c := make(RegisterSet, len(rs))
+	for reg := range rs {
+		c[reg] = struct{}{}
+	}
+	return c
+}
+
+func (rs RegisterSet) Values() []operand.Reg {
+	regs := make([]operand.Reg, 0, len(rs))
+	for reg := range rs {
+		regs = append(regs, reg)
+	}
+	sort.Slice(regs, func(i, j int) bool {
+		return regs[i] < regs[j]
+	})
+	return regs
+}
+
+type Parser struct {
+	Registers RegisterSet
+	Reserved  RegisterSet
+	Syntax    Syntax
+	// Include are the directories searched for included files that are not
+	// found relative to the including file.
+	Include []string
+	// MaxErrors is the number of errors after which Eval stops, or zero to
+	// report every error.
+	MaxErrors int
+
+	dirs     []Directive
+	prefix   x64.Prefix
+	dirnames map[string]int
+	names    map[string][]*instruction.Instruction
+
+	// The scanners of the files that include the current one, and the
+	// files to read after it.
+	frames []*scanner.Scanner
+	queue  []source
+
+	// NASM state: the %define values and the tokens left of the one being
+	// expanded, constants from equ, the offsets of labels, the last
+	// non-local label, the offset of the current section and the number of
+	// anonymous labels for $.
+	emit        *x64.Emit
+	defines     map[string][]token
+	expand      []token
+	consts      map[string]int64
+	labels      map[string]int
+	global      string
+	origin      int
+	originKnown bool
+	anon        int
+
+	scan   *scanner.Scanner
+	val    interface{}
+	err    error
+	peeked bool
+
+	// The positions of the last token returned by Next and of the token
+	// after it.
+	pos, nextPos scanner.Position
+}
+
+func (p *Parser) NewError(err error) *Error {
+	return NewError(err, p.scan.Position)
+}
+
+// check returns err, if any, at the current position.
+func (p *Parser) check(err error) error {
+	if err != nil {
+		return p.NewError(err)
+	}
+	return nil
+}
+
+func (p *Parser) SetDirectives(directives ...Directive) {
+	p.dirs = make([]Directive, 0, len(directives))
+	p.dirnames = make(map[string]int, len(directives))
+	for _, dir := range directives {
+		if _, ok := p.dirnames[dir.Name()]; !ok {
+			p.dirnames[dir.Name()] = len(p.dirs)
+			p.dirs = append(p.dirs, dir)
+		}
+	}
+}
+
+type source struct {
+	name string
+	src  io.Reader
+}
+
+// Init prepares p to parse src, using name as the file name in positions.
+func (p *Parser) Init(name string, src io.Reader) {
+	p.Registers = RegisterSet{}
+	p.Reserved = RegisterSet{}
+	p.frames, p.queue = nil, nil
+	p.val, p.err, p.peeked = nil, nil, false
+
+	if p.Syntax == SyntaxNASM {
+		p.defines = map[string][]token{}
+		p.expand = nil
+		p.consts = map[string]int64{}
+		p.labels = map[string]int{}
+		p.global, p.origin, p.originKnown, p.anon = "", 0, true, 0
+	}
+	p.open(name, src)
+}
+
+// Append adds src to be parsed after the sources already given to p, as if
+// they were concatenated.
+func (p *Parser) Append(name string, src io.Reader) {
+	p.queue = append(p.queue, source{name, src})
+}
+
+func (p *Parser) open(name string, src io.Reader) {
+	p.scan = &scanner.Scanner{}
+	p.scan.Init(src)
+	p.scan.Filename = name
+	if p.Syntax == SyntaxNASM {
+		// Quotes are read by the parser, as NASM strings have no escapes.
+		p.scan.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanFloats
+		p.scan.IsIdentRune = nasmIdentRune
+	} else {
+		p.scan.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanFloats |
+			scanner.ScanChars | scanner.ScanStrings | scanner.ScanRawStrings |
+			scanner.ScanComments | scanner.SkipComments
+	}
+
+	if p.scan.Peek() == '#' {
+		for {
+			ch := p.scan.Next()
+			if ch < 0 || ch == '\n' {
+				break
+			}
+		}
+	}
+}
+
+// next moves on to the file that follows the current one, and reports
+// whether there is one.
+func (p *Parser) next() bool {
+	switch {
+	case len(p.frames) > 0:
+		p.scan = p.frames[len(p.frames)-1]
+		p.frames = p.frames[:len(p.frames)-1]
+	case len(p.queue) > 0:
+		src := p.queue[0]
+		p.queue = p.queue[1:]
+		p.open(src.name, src.src)
+	default:
+		return false
+	}
+	return true
+}
+
+// Eval parses the input and emits it into e. A statement with an error is
+// skipped up to the end of its line, and parsing goes on until the end of
+// the input or until MaxErrors errors are found. The errors are returned as
+// an ErrorList.
+func (p *Parser) Eval(data *instruction.Set, e *x64.Emit) error {
+	if p.Syntax != SyntaxIntel && p.Syntax != SyntaxNASM {
+		p.names = nameIndex(data, p.formName)
+	}
+	p.emit = e
+
+	var errs ErrorList
+	for _, d := range p.dirs {
+		errs.Add(d.Before(p))
+	}
+
+	for p.MaxErrors <= 0 || len(errs) < p.MaxErrors {
+		done, err := p.statement(data, e)
+		if err != nil {
+			errs.Add(err)
+			p.resync()
+		} else if done {
+			break
+		}
+	}
+
+	for i := len(p.dirs) - 1; i >= 0; i-- {
+		errs.Add(p.dirs[i].After(p))
+	}
+
+	if p.MaxErrors > 0 && len(errs) > p.MaxErrors {
+		errs = errs[:p.MaxErrors]
+	}
+	return errs.Err()
+}
+
+// statement parses and emits the next statement, and reports whether the
+// end of the input is reached.
+func (p *Parser) statement(data *instruction.Set, e *x64.Emit) (bool, error) {
+	val, err := p.Next()
+	if err != nil || val == nil {
+		return err == nil, err
+	}
+	pos := p.pos
+
+	switch val := val.(type) {
+	case string:
+		switch {
+		case val == ".":
+			return false, p.directive()
+		case val == ";" && (p.Syntax == SyntaxATT || p.Syntax == SyntaxGo):
+			// Statements may be separated by a semicolon.
+		case prefixes[strings.ToLower(val)] != 0:
+			p.prefix |= prefixes[strings.ToLower(val)]
+		case p.Syntax == SyntaxNASM:
+			return false, p.statementNASM(data, e, val, pos)
+		case p.Syntax == SyntaxGo && goPseudo[val]:
+			p.skipLine()
+		case p.Maybe(rune(':')):
+			e.Label(val)
+		case p.Syntax == SyntaxATT || p.Syntax == SyntaxGo:
+			name := p.modeName(val, e.Mode())
+			args, err := p.args(p.lookup(data, name))
+			if err != nil {
+				return false, err
+			}
+			if isMovabs(val) {
+				args = moffsArgs(args)
+				if p.names[strings.ToLower(val)] == nil {
+					name = "mov"
+				}
+			}
+			inst, args := p.resolve(data, name, args)
+			if inst == nil {
+				return false, NewError(ErrMnemonicUnknown, pos)
+			}
+			p.emitCall(newCall(inst, args, pos))
+		default:
+			name := val
+			if isMovabs(val) {
+				name = "mov"
+			}
+			inst := data.Lookup(name)
+			if inst == nil {
+				return false, NewError(ErrMnemonicUnknown, pos)
+			}
+			args, err := p.Args(inst)
+			if err != nil {
+				return false, err
+			}
+			if name != val {
+				args = moffsArgs(args)
+			}
+			p.emitCall(newCall(inst, args, pos))
+		}
+	case uint64:
+		if !p.Maybe(rune(':')) {
+			return false, p.NewError(ErrIdentifierExpected)
+		}
+		e.Label(strconv.FormatUint(val, 10))
+	case rune:
+		if val != '%' || p.Syntax != SyntaxNASM {
+			return false, p.NewError(ErrIdentifierExpected)
+		}
+		return false, p.directive()
+	default:
+		return false, p.NewError(ErrIdentifierExpected)
+	}
+	return false, nil
+}
+
+// resync discards the rest of the line after an error, so that parsing can
+// go on with the next statement.
+func (p *Parser) resync() {
+	p.err = nil
+	p.prefix = 0
+	p.expand = nil
+	if p.peeked && p.nextPos.Line != p.pos.Line {
+		return
+	}
+	p.peeked = false
+	p.skipLine()
+}
+
+// emitCall emits call with the pending prefixes.
+func (p *Parser) emitCall(call *x64.EmitCall) {
+	call.Prefix |= p.prefix
+	p.prefix = 0
+	p.emit.EmitCall(call)
+}
+
+func newCall(inst *instruction.Instruction, args []operand.Arg, pos scanner.Position) *x64.EmitCall {
+	return &x64.EmitCall{
+		Instruction: inst,
+		Args:        args,
+		EmitPosition: x64.EmitPosition{
+			Filename: pos.Filename,
+			Line:     pos.Line,
+			Column:   pos.Column,
+		},
+	}
+}
+
+func (p *Parser) Next() (interface{}, error) {
+	if p.peeked {
+		p.peeked = false
+	} else {
+		p.advance()
+	}
+	p.pos = p.nextPos
+	return p.val, p.err
+}
+
+func (p *Parser) Peek() (interface{}, error) {
+	if !p.peeked {
+		p.advance()
+		p.peeked = true
+	}
+	return p.val, p.err
+}
+
+func (p *Parser) Expect(exp interface{}) error {
+	val, err := p.Next()
+	if err != nil {
+		return err
+	}
+	if val != exp {
+		if r, ok := exp.(rune); ok {
+			return p.NewError(fmt.Errorf("'%c' expected", r))
+		}
+		return p.NewError(fmt.Errorf("%v expected", exp))
+	}
+	return nil
+}
+
+func (p *Parser) Maybe(exp interface{}) bool {
+	val, _ := p.Peek()
+	if val != exp {
+		return false
+	}
+	p.Next()
+	return true
+}
+
+func (p *Parser) advance() {
+	if p.err != nil {
+		return
+	}
+
+	tok, txt := p.token()
+	p.peeked = false
+	p.nextPos = p.scan.Position
+
+	switch tok {
+
+	case scanner.EOF:
+		p.val = nil
+
+	case scanner.Int:
+		var n uint64
+		if n, p.err = strconv.ParseUint(txt, 0, 64); p.err != nil {
+			p.val = nil
+		} else if ref, ok := p.numericRef(txt); ok {
+			p.val = ref
+		} else {
+			p.val = n
+		}
+
+	case scanner.Ident:
+		// A size keyword after a '.' is the name of a directive, as in .byte.
+		switch sz, ok := nasmSizeOf(txt); {
+		case ok && p.val == ".":
+			p.val = txt
+		case ok && p.Syntax == SyntaxIntel:
+			if _, nasm := nasmSizes[strings.ToLower(txt)]; nasm {
+				p.val = txt
+				break
+			}
+			if p.scan.Scan() != scanner.Ident || !strings.EqualFold(p.scan.TokenText(), "PTR") {
+				p.err = p.NewError(ErrPTRExpected)
+			}
+			p.val = sz
+		case ok && p.Syntax == SyntaxNASM:
+			// NASM size keywords are not followed by PTR.
+			p.val = sz
+		default:
+			p.val = txt
+		}
+
+	case scanner.Float:
+		if f, err := strconv.ParseFloat(txt, 64); err != nil {
+			p.err = p.NewError(ErrFloatInvalid)
+			p.val = nil
+		} else {
+			p.val = f
+		}
+
+	case scanner.Char:
+		if s, err := strconv.Unquote(txt); err != nil || utf8.RuneCountInString(s) != 1 {
+			p.err = p.NewError(ErrCharInvalid)
+			p.val = nil
+		} else {
+			r, _ := utf8.DecodeRuneInString(s)
+			p.val = uint64(r)
+		}
+
+	case scanner.String, scanner.RawString:
+		if s, err := strconv.Unquote(txt); err != nil {
+			p.err = p.NewError(ErrStringUnterminated)
+			p.val = nil
+		} else {
+			p.val = quoted(s)
+		}
+
+	case ',', '[', ']', '*', '+', '-', ':', '%', '$', '(', ')', '/', '~', '{', '}':
+		p.val = tok
+
+	default:
+		p.val = txt
+	}
+}
+
+// token scans the next token, skipping comments, continuing with the next
+// file at the end of an included one and expanding NASM defines.
+func (p *Parser) token() (rune, string) {
+	for {
+		if len(p.expand) > 0 {
+			t := p.expand[0]
+			p.expand = p.expand[1:]
+			return t.tok, t.txt
+		}
+
+		tok := p.scan.Scan()
+		switch {
+		case p.lineComment(tok):
+			p.skipLine()
+		case tok == scanner.EOF:
+			if !p.next() {
+				return tok, ""
+			}
+		case p.Syntax != SyntaxNASM:
+			return tok, p.scan.TokenText()
+		case isQuote(tok):
+			s, ok := readQuote(p.scan, tok)
+			if !ok {
+				p.err = p.NewError(ErrStringUnterminated)
+				return scanner.EOF, ""
+			}
+			return scanner.String, strconv.Quote(s)
+		case tok == scanner.Ident && p.defined(p.scan.TokenText()):
+			p.expand = p.defines[p.scan.TokenText()]
+		default:
+			return tok, p.scan.TokenText()
+		}
+	}
+}
+
+// sameLine reports whether the next token is on the line of the last one.
+// Operands are on the same line as their mnemonic.
+func (p *Parser) sameLine() bool {
+	val, _ := p.Peek()
+	return val != nil && p.nextPos.Line == p.pos.Line
+}
+
+// lineComment reports whether tok starts a comment that runs to the end of
+// the line.
+func (p *Parser) lineComment(tok rune) bool {
+	switch p.Syntax {
+	case SyntaxATT, SyntaxGo:
+		return tok == '#'
+	case SyntaxNASM:
+		return tok == ';'
+	}
+	return false
+}
+
+// skipLine discards the rest of the current line.
+func (p *Parser) skipLine() {
+	for ch := p.scan.Peek(); ch >= 0 && ch != '\n'; ch = p.scan.Peek() {
+		p.scan.Next()
+	}
+}
+
+func (p *Parser) directive() error {
+	name, err := p.Ident()
+	if err != nil {
+		return err
+	}
+	if p.Syntax != SyntaxNASM && p.Maybe(rune(':')) {
+		p.emit.Label("." + name)
+		return nil
+	}
+	if d, ok := p.dirnames[name]; ok {
+		return p.dirs[d].Parse(p)
+	}
+	switch {
+	case name == "include":
+		return p.include()
+	case name == "define" && p.Syntax == SyntaxNASM:
+		return p.define()
+	case p.Syntax != SyntaxNASM:
+		if d, ok := gasData[name]; ok {
+			return p.dataGAS(d)
+		}
+		if m, ok := codeModes[name]; ok {
+			p.emit.SetMode(m)
+			return nil
+		}
+	}
+	return p.NewError(ErrDirectiveUnknown)
+}
+
+// modeName maps the "l" suffix of a form that defaults to a 64-bit operand,
+// such as "pushl", to the "q" form outside of 64-bit mode. Those forms take
+// a 32-bit operand there.
+func (p *Parser) modeName(name string, m x64.Mode) string {
+	if m == x64.Mode64 || !strings.HasSuffix(name, "l") || p.names[strings.ToLower(name)] != nil {
+		return name
+	}
+	if q := name[:len(name)-1] + "q"; p.names[strings.ToLower(q)] != nil {
+		return q
+	}
+	return name
+}
+
+// codeModes are the directives that set the mode of the following code.
+var codeModes = map[string]x64.Mode{
+	"code16": x64.Mode16,
+	"code32": x64.Mode32,
+	"code64": x64.Mode64,
+}
+
+func (p *Parser) Args(inst *instruction.Instruction) ([]operand.Arg, error) {
+	args := []operand.Arg{}
+
+	if expectRel(inst) {
+		id, err := p.LabelName()
+		if err != nil {
+			return nil, err
+		}
+		if p.Syntax == SyntaxNASM {
+			id = p.target(id)
+		}
+		args = append(args, operand.Label(id))
+	} else if p.sameLine() {
+		arg, err := p.Arg(false)
+
+		if err != nil || arg == nil {
+			return nil, err
+		}
+
+		for {
+			if arg, err = p.decorate(arg); err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if !p.Maybe(rune(',')) {
+				break
+			}
+			if arg, err = p.Arg(true); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return args, nil
+}
+
+func (p *Parser) getReg(name string) (r operand.Reg, ok bool, err error) {
+	if r, ok = operand.RegOf(name); ok {
+		if p.Reserved.Contains(r) {
+			r, ok, err = 0, false, p.NewError(ErrRegisterUnavailable)
+		} else {
+			p.Registers.Add(r)
+		}
+	}
+	return
+}
+
+func (p *Parser) Arg(expect bool) (arg operand.Arg, err error) {
+	var val interface{}
+	if val, err = p.Peek(); err != nil {
+		return
+	}
+
+	if p.Syntax == SyntaxNASM {
+		if arg, ok, nerr := p.argNASM(val); ok || nerr != nil {
+			return arg, nerr
+		}
+	}
+
+	switch v := val.(type) {
+	case uint64:
+		p.Next()
+		return operand.Uint(v), nil
+	case string:
+		if _, ok := floatSize(v); ok {
+			p.Next()
+			var n uint64
+			n, err = p.floatBits(v)
+			return operand.Uint(n), err
+		}
+		if reg, ok, rerr := p.getReg(v); rerr != nil {
+			err = rerr
+			return
+		} else if ok {
+			p.Next()
+			if reg.Type() == operand.RegTypeSegment && p.Maybe(rune(':')) {
+				return p.mem(operand.Size0, reg)
+			}
+			return reg, nil
+		}
+	case rune:
+		switch v {
+		case '-':
+			p.Next()
+			var n int64
+			if n, err = p.neg(); err != nil {
+				return
+			}
+			return operand.Int(n), nil
+		case '[':
+			return p.Mem(operand.Size0)
+		case '{':
+			return p.rounding()
+		}
+	case operand.Size:
+		p.Next()
+		return p.Mem(v)
+	}
+
+	if expect {
+		err = p.NewError(ErrOperandExpected)
+	}
+	return
+}
+
+func (p *Parser) neg() (int64, error) {
+	val, err := p.Next()
+	if err != nil {
+		return 0, err
+	}
+	if n, ok := val.(uint64); ok {
+		if n > math.MaxInt64+1 {
+			return 0, p.NewError(ErrIntegerOverflow)
+		}
+		return -int64(n), nil
+	} else {
+		return 0, p.NewError(ErrIntegerExpected)
+	}
+}
+
+func (p *Parser) Ident() (string, error) {
+	val, err := p.Next()
+	if err != nil {
+		return "", err
+	}
+
+	if str, ok := val.(string); ok {
+		return str, nil
+	}
+
+	return "", p.NewError(ErrIdentifierExpected)
+}
+
+// LabelName parses the name of a label. Local labels are written with a
+// leading '.', and numeric labels are referred to as "1f" or "1b".
+func (p *Parser) LabelName() (string, error) {
+	id, err := p.Ident()
+	if err == nil && id == "." {
+		id, err = p.Ident()
+		id = "." + id
+	}
+	return id, err
+}
+
+// numericRef returns the label referred to by the integer txt if it is
+// directly followed by 'f' or 'b', as in "1f".
+func (p *Parser) numericRef(txt string) (string, bool) {
+	if p.Syntax == SyntaxNASM || strings.IndexFunc(txt, notDigit) >= 0 {
+		return "", false
+	}
+	switch ch := p.scan.Peek(); ch {
+	case 'f', 'b':
+		p.scan.Next()
+		if next := p.scan.Peek(); unicode.IsLetter(next) || unicode.IsDigit(next) || next == '_' {
+			p.err = p.NewError(ErrInputUnexpected)
+		}
+		return txt + string(ch), true
+	}
+	return "", false
+}
+
+func notDigit(r rune) bool {
+	return r < '0' || r > '9'
+}
+
+func (p *Parser) Scale() (operand.Size, error) {
+	val, err := p.Next()
+	if err != nil {
+		return 0, err
+	}
+
+	if n, ok := val.(uint64); ok {
+		switch n {
+		case 1:
+			return operand.Size8, nil
+		case 2:
+			return operand.Size16, nil
+		case 4:
+			return operand.Size32, nil
+		case 8:
+			return operand.Size64, nil
+		}
+	}
+
+	return 0, p.NewError(ErrScaleInvalid)
+}
+
+func (p *Parser) Reg() (reg operand.Reg, err error) {
+	name := ""
+	if name, err = p.Ident(); err == nil {
+		ok := false
+		if reg, ok, err = p.getReg(name); err == nil && !ok {
+			err = p.NewError(ErrRegisterExpected)
+		}
+	}
+	return
+}
+
+// Mem parses a memory operand of size sz. A segment override may be given
+// either before the bracket, as in "fs:[rax]", or as the first term within.
+func (p *Parser) Mem(sz operand.Size) (operand.Mem, error) {
+	var a operand.Address
+	if err := p.segment(&a); err != nil {
+		return operand.Mem{}, err
+	}
+	return p.addr(sz, &a)
+}
+
+// mem parses the bracketed address of a memory operand with the segment
+// override seg, if any, already given.
+func (p *Parser) mem(sz operand.Size, seg operand.Reg) (operand.Mem, error) {
+	var a operand.Address
+	if err := a.Segment(seg); err != nil {
+		return operand.Mem{}, p.NewError(err)
+	}
+	return p.addr(sz, &a)
+}
+
+// segment parses an optional segment override such as "fs:".
+func (p *Parser) segment(a *operand.Address) error {
+	val, _ := p.Peek()
+	if s, ok := val.(string); ok {
+		if r, isReg := operand.RegOf(s); isReg && r.Type() == operand.RegTypeSegment {
+			p.Next()
+			if err := a.Segment(r); err != nil {
+				return p.NewError(err)
+			}
+			return p.Expect(rune(':'))
+		}
+	}
+	return nil
+}
+
+// addr parses the bracketed terms of an address into a, which combines them
+// in the same way as operand.Parse.
+func (p *Parser) addr(sz operand.Size, a *operand.Address) (mem operand.Mem, err error) {
+	if err = p.Expect(rune('[')); err != nil {
+		return
+	}
+	if err = p.segment(a); err != nil {
+		return
+	}
+
+	for first := true; !p.Maybe(rune(']')); first = false {
+		neg := false
+		switch {
+		case p.Maybe(rune('-')):
+			neg = true
+		case p.Maybe(rune('+')):
+		case !first:
+			err = p.Expect(rune(']'))
+			return
+		}
+		if err = p.term(a, neg, first); err != nil {
+			return
+		}
+	}
+
+	if mem, err = a.Mem(); err != nil {
+		return mem, p.NewError(err)
+	}
+	mem.Size = sz
+	return
+}
+
+// term parses one register, scaled index, constant or displacement of an
+// address. A number that is the only term is an absolute address.
+func (p *Parser) term(a *operand.Address, neg, first bool) error {
+	val, err := p.Peek()
+	if err != nil {
+		return err
+	}
+
+	var scale uint64
+	switch v := val.(type) {
+	case string:
+		if n, ok := p.consts[v]; ok {
+			p.Next()
+			if neg {
+				n = -n
+			}
+			return p.check(a.Disp(n))
+		}
+	case uint64:
+		p.Next()
+		if p.Maybe(rune('*')) {
+			if scale = v; scale == 0 {
+				return p.NewError(ErrScaleInvalid)
+			}
+			break
+		}
+		if next, _ := p.Peek(); first && !neg && next == rune(']') {
+			a.Abs(v)
+			return nil
+		}
+		if v > math.MaxUint32 {
+			return p.NewError(ErrDisplacementInvalid)
+		}
+		n := int64(v)
+		if neg {
+			n = -n
+		}
+		return p.check(a.Disp(n))
+	default:
+		return p.NewError(ErrInputUnexpected)
+	}
+	if neg {
+		return p.NewError(ErrSIBInvalid)
+	}
+
+	r, err := p.Reg()
+	if err != nil {
+		return err
+	}
+	if scale == 0 && p.Maybe(rune('*')) {
+		val, err := p.Next()
+		if err != nil {
+			return err
+		}
+		if scale, _ = val.(uint64); scale == 0 {
+			return p.NewError(ErrScaleInvalid)
+		}
+	}
+	return p.check(a.Reg(r, scale))
+}
+
+// isMovabs reports whether name is movabs, which is MOV with a full 64-bit
+// address or immediate. AT&T syntax may add a size suffix.
+func isMovabs(name string) bool {
+	name = strings.ToLower(name)
+	switch name {
+	case "movabs", "movabsb", "movabsw", "movabsl", "movabsq":
+		return true
+	}
+	return false
+}
+
+// moffsArgs returns args with absolute addresses in the moffs form.
+func moffsArgs(args []operand.Arg) []operand.Arg {
+	for i, arg := range args {
+		if m, ok := arg.(operand.Mem); ok && m.Base == 0 && m.Index == 0 && m.Type == operand.MemTypeGeneral {
+			m.Type, m.Addr, m.Disp = operand.MemTypeOffset, uint64(int64(m.Disp)), 0
+			args[i] = m
+		}
+	}
+	return args
+}
+
+func expectRel(inst *instruction.Instruction) bool {
+	op := inst.Forms[0].Operands
+	return op.Len == 1 && op.Val[0].Kind() == operand.KindRel
+}
+func addInt(d int32, val int64) (int32, bool) {
+	if val < math.MinInt32 || val > math.MaxInt32 {
+		return d, false
+	}
+	n := int64(d) + val
+	if n < math.MinInt32 || n > math.MaxInt32 {
+		return d, false
+	}
+	return int32(n), true
+}
+
+func addUint(d int32, val uint64) (int32, bool) {
+	if val > math.MaxInt32 {
+		return d, false
+	}
+	return addInt(d, int64(val))
+}
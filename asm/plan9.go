@@ -0,0 +1,175 @@
+package asm
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/kalamay/x86/operand"
+)
+
+// goPseudo are the Go assembler pseudo-ops that are skipped along with the
+// rest of their line.
+var goPseudo = map[string]bool{
+	"TEXT":              true,
+	"GLOBL":             true,
+	"DATA":              true,
+	"PCDATA":            true,
+	"FUNCDATA":          true,
+	"NO_LOCAL_POINTERS": true,
+}
+
+var goGeneral = [...]string{"AX", "CX", "DX", "BX", "SP", "BP", "SI", "DI"}
+
+// goRegOf returns the register with the given Go assembler name. General
+// purpose registers are returned with a 64-bit size.
+func goRegOf(name string) (operand.Reg, bool) {
+	for i, n := range goGeneral {
+		if name == n {
+			return operand.MakeReg(uint8(i), operand.RegTypeGeneral, operand.Size64), true
+		}
+	}
+	if len(name) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(name[1:], 10, 8)
+	if err != nil || (len(name) > 2 && name[1] == '0') {
+		return 0, false
+	}
+	switch name[0] {
+	case 'R':
+		if 8 <= n && n < 16 {
+			return operand.MakeReg(uint8(n), operand.RegTypeGeneral, operand.Size64), true
+		}
+	case 'X':
+		if n < 32 {
+			return operand.MakeReg(uint8(n), operand.RegTypeVector, operand.Size128), true
+		}
+	case 'Y':
+		if n < 32 {
+			return operand.MakeReg(uint8(n), operand.RegTypeVector, operand.Size256), true
+		}
+	case 'Z':
+		if n < 32 {
+			return operand.MakeReg(uint8(n), operand.RegTypeVector, operand.Size512), true
+		}
+	case 'K':
+		if n < 8 {
+			return operand.MakeReg(uint8(n), operand.RegTypeMask, operand.Size64), true
+		}
+	}
+	return 0, false
+}
+
+func (p *Parser) regGo() (operand.Reg, error) {
+	name, err := p.Ident()
+	if err != nil {
+		return 0, err
+	}
+	r, ok := goRegOf(name)
+	switch {
+	case !ok:
+		return 0, p.NewError(ErrRegisterExpected)
+	case p.Reserved.Contains(r):
+		return 0, p.NewError(ErrRegisterUnavailable)
+	}
+	p.Registers.Add(r)
+	return r, nil
+}
+
+func (p *Parser) argGo() (operand.Arg, error) {
+	val, err := p.Peek()
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := val.(type) {
+	case uint64:
+		return p.memGo()
+	case string:
+		if _, ok := goRegOf(v); !ok {
+			return p.memGo()
+		}
+		return p.regGo()
+	case rune:
+		switch v {
+		case '$':
+			p.Next()
+			return p.imm()
+		case '(', '-', '·':
+			return p.memGo()
+		}
+	}
+	return nil, p.NewError(ErrOperandExpected)
+}
+
+// goPseudoRegs are the pseudo-registers of the Go assembler. SP is only a
+// pseudo-register when it follows a symbol, as in "x-8(SP)".
+var goPseudoRegs = map[string]bool{"FP": true, "SB": true, "PC": true}
+
+func (p *Parser) memGo() (mem operand.Mem, err error) {
+	sym := p.symGo()
+	if sym != "" {
+		p.Maybe(rune('+'))
+	}
+	if mem.Disp, err = p.disp(); err != nil {
+		return
+	}
+
+	if err = p.Expect(rune('(')); err != nil {
+		return
+	}
+	if val, _ := p.Peek(); val != nil {
+		if name, ok := val.(string); ok && (goPseudoRegs[name] || (name == "SP" && sym != "")) {
+			err = p.NewError(fmt.Errorf("%w: %s", ErrPseudoRegister, name))
+			return
+		}
+	}
+	if sym != "" {
+		err = p.NewError(fmt.Errorf("%w: %s", ErrSymbolUnsupported, sym))
+		return
+	}
+	if mem.Base, err = p.regGo(); err != nil {
+		return
+	}
+	if err = p.Expect(rune(')')); err != nil {
+		return
+	}
+
+	if p.Maybe(rune('(')) {
+		if mem.Index, err = p.regGo(); err != nil {
+			return
+		}
+		mem.Scale = operand.Size8
+		if p.Maybe(rune('*')) {
+			if mem.Scale, err = p.Scale(); err != nil {
+				return
+			}
+		}
+		err = p.Expect(rune(')'))
+	}
+	return
+}
+
+// symGo skips the symbol name in front of a Go memory operand, as in
+// "ret+0(FP)" or "·table<>(SB)", and returns it.
+func (p *Parser) symGo() string {
+	sym := ""
+	for {
+		val, _ := p.Peek()
+		switch v := val.(type) {
+		case string:
+			if _, ok := goRegOf(v); ok && sym == "" {
+				return sym
+			}
+			sym += v
+		case rune:
+			if v != '·' && v != '.' && v != '<' && v != '>' {
+				return sym
+			}
+			sym += string(v)
+		default:
+			return sym
+		}
+		p.Next()
+	}
+}
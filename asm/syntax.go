@@ -0,0 +1,263 @@
+package asm
+
+import (
+	"strings"
+
+	"github.com/kalamay/x86/instruction"
+	"github.com/kalamay/x86/operand"
+)
+
+// Syntax selects the assembly dialect accepted by a Parser.
+type Syntax uint8
+
+const (
+	// SyntaxIntel is the Intel syntax used by the instruction set, with the
+	// destination operand first.
+	SyntaxIntel Syntax = iota
+	// SyntaxATT is the AT&T syntax of the GNU assembler. Operands are in
+	// reverse order, registers are written as %reg, immediates as $imm and
+	// memory as disp(base, index, scale). Mnemonics may carry a size suffix.
+	SyntaxATT
+	// SyntaxGo is the syntax of the Go assembler. Operands are in reverse
+	// order, registers are written without a size, as in AX or X0, and
+	// memory as disp(base)(index*scale). Mnemonics carry the operand size as
+	// in MOVQ, and the TEXT, GLOBL and DATA pseudo-ops are ignored.
+	SyntaxGo
+	// SyntaxNASM is the syntax of the Netwide Assembler. Operands are in
+	// Intel order, sizes are written without PTR, as in dword [rdi], and the
+	// section, db, times, equ and %define directives are understood.
+	SyntaxNASM
+)
+
+var syntaxNames = [...]string{"intel", "att", "go", "nasm"}
+
+// SyntaxOf returns the syntax with the given name.
+func SyntaxOf(name string) (Syntax, bool) {
+	for i, n := range syntaxNames {
+		if strings.EqualFold(name, n) {
+			return Syntax(i), true
+		}
+	}
+	return SyntaxIntel, false
+}
+
+func (s Syntax) String() string {
+	if int(s) < len(syntaxNames) {
+		return syntaxNames[s]
+	}
+	return "unknown"
+}
+
+// formName returns the name of f in the syntax of p.
+func (p *Parser) formName(f *instruction.Form) string {
+	switch p.Syntax {
+	case SyntaxATT:
+		return f.GasName
+	case SyntaxGo:
+		return f.GoName
+	}
+	return ""
+}
+
+// nameIndex maps the lower case form names returned by name to the
+// instructions having such a form.
+func nameIndex(data *instruction.Set, name func(f *instruction.Form) string) map[string][]*instruction.Instruction {
+	idx := map[string][]*instruction.Instruction{}
+	for i := range data.Instructions {
+		inst := &data.Instructions[i]
+		prev := ""
+		for f := range inst.Forms {
+			n := strings.ToLower(name(&inst.Forms[f]))
+			if n == "" || n == prev {
+				continue
+			}
+			if l := idx[n]; len(l) == 0 || l[len(l)-1] != inst {
+				idx[n] = append(l, inst)
+			}
+			prev = n
+		}
+	}
+	return idx
+}
+
+// lookup returns the first instruction that may be named by a form name,
+// before its operands are known.
+func (p *Parser) lookup(data *instruction.Set, name string) *instruction.Instruction {
+	if insts := p.names[strings.ToLower(name)]; len(insts) > 0 {
+		return insts[0]
+	}
+	return data.Lookup(name)
+}
+
+// resolve finds the instruction for the form name and operands. Memory
+// operands without a size take it from the matching form, so that a size
+// suffix such as in "addq $1, (%rdi)" is not lost. In Go syntax, general
+// purpose registers take their size from the form as well.
+func (p *Parser) resolve(data *instruction.Set, name string, args []operand.Arg) (*instruction.Instruction, []operand.Arg) {
+	name = strings.ToLower(name)
+	insts := p.names[name]
+	for _, inst := range insts {
+		for i := range inst.Forms {
+			f := &inst.Forms[i]
+			if strings.ToLower(p.formName(f)) != name || int(f.Operands.Len) != len(args) {
+				continue
+			}
+			if sized, ok := sizeArgs(f, args, p.Syntax == SyntaxGo); ok {
+				return inst, sized
+			}
+		}
+	}
+	if len(insts) > 0 {
+		return insts[0], args
+	}
+	return data.Lookup(name), args
+}
+
+func sizeArgs(f *instruction.Form, args []operand.Arg, regs bool) ([]operand.Arg, bool) {
+	sized := make([]operand.Arg, len(args))
+	for i, arg := range args {
+		p := f.Operands.Val[i]
+		switch a := arg.(type) {
+		case operand.Mem:
+			if a.Size == operand.Size0 && p.Kind() == operand.KindMem {
+				if a.Type == operand.MemTypeBroadcast {
+					a.Size = operand.MemParam(p).ElemSize()
+				} else {
+					a.Size = operand.MemParam(p).Size()
+				}
+				arg = a
+			}
+		case operand.Reg:
+			pr := operand.Reg(operand.RegParam(p))
+			if regs && p.Kind() == operand.KindReg &&
+				a.Type() == operand.RegTypeGeneral && pr.Type() == operand.RegTypeGeneral {
+				arg = operand.MakeReg(a.ID(), operand.RegTypeGeneral, pr.Size())
+			}
+		}
+		if !arg.Matches(p) {
+			return nil, false
+		}
+		sized[i] = arg
+	}
+	return sized, true
+}
+
+// args parses the operands of an instruction written with the source
+// operands first, and returns them in Intel order.
+func (p *Parser) args(inst *instruction.Instruction) ([]operand.Arg, error) {
+	if p.Syntax != SyntaxGo && p.Maybe(rune('*')) {
+		return p.indirectATT()
+	}
+	if inst != nil && expectRel(inst) {
+		id, err := p.LabelName()
+		if err != nil {
+			return nil, err
+		}
+		return []operand.Arg{operand.Label(id)}, nil
+	}
+
+	args := []operand.Arg{}
+	if !p.sameLine() {
+		return args, nil
+	}
+	if val, _ := p.Peek(); !p.startsArg(val) {
+		return args, nil
+	}
+	for {
+		var (
+			arg operand.Arg
+			err error
+		)
+		if p.Syntax == SyntaxGo {
+			arg, err = p.argGo()
+		} else if arg, err = p.argATT(); err == nil {
+			arg, err = p.decorate(arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if !p.Maybe(rune(',')) {
+			break
+		}
+	}
+	for i, j := 0, len(args)-1; i < j; i, j = i+1, j-1 {
+		args[i], args[j] = args[j], args[i]
+	}
+	return args, nil
+}
+
+// indirectATT parses the operand of an indirect branch after its '*', which
+// is either a register or a memory operand holding the target.
+func (p *Parser) indirectATT() ([]operand.Arg, error) {
+	arg, err := p.argATT()
+	if err != nil {
+		return nil, err
+	}
+	switch arg.(type) {
+	case operand.Reg, operand.Mem:
+		return []operand.Arg{arg}, nil
+	}
+	return nil, p.NewError(ErrOperandExpected)
+}
+
+// startsArg reports whether val begins an operand rather than the next
+// statement. Operands start with a sigil, a number or a parenthesis, or in
+// Go syntax, a name.
+func (p *Parser) startsArg(val interface{}) bool {
+	switch v := val.(type) {
+	case uint64, rune:
+		return true
+	case string:
+		// A Go operand may also start with the symbol of a pseudo-register.
+		return p.Syntax == SyntaxGo && v != ";"
+	}
+	return false
+}
+
+// disp parses the optional displacement in front of a parenthesized address.
+func (p *Parser) disp() (int32, error) {
+	var (
+		d  int32
+		ok = true
+	)
+	if p.Maybe(rune('-')) {
+		n, err := p.neg()
+		if err != nil {
+			return 0, err
+		}
+		d, ok = addInt(0, n)
+	} else if val, _ := p.Peek(); val != nil {
+		if n, isInt := val.(uint64); isInt {
+			p.Next()
+			d, ok = addUint(0, n)
+		}
+	}
+	if !ok {
+		return 0, p.NewError(ErrDisplacementInvalid)
+	}
+	return d, nil
+}
+
+// imm parses the integer or float32(x) and float64(x) bit pattern following
+// a '$'.
+func (p *Parser) imm() (operand.Arg, error) {
+	if p.Maybe(rune('-')) {
+		n, err := p.neg()
+		return operand.Int(n), err
+	}
+	val, err := p.Next()
+	if err != nil {
+		return nil, err
+	}
+	switch v := val.(type) {
+	case uint64:
+		return operand.Uint(v), nil
+	case string:
+		if _, ok := floatSize(v); ok {
+			n, err := p.floatBits(v)
+			return operand.Uint(n), err
+		}
+	}
+	return nil, p.NewError(ErrIntegerExpected)
+}
@@ -5,6 +5,6 @@ go 1.16
 replace github.com/kalamay/x86 => ../..
 
 require (
-	github.com/alecthomas/kong v0.2.17 // indirect
+	github.com/alecthomas/kong v0.2.17
 	github.com/kalamay/x86 v0.0.0
 )
@@ -13,12 +13,15 @@ import (
 type Cmd struct {
 	XML *os.File `short:"x" help:"XML source file."`
 
-	As   sub.AsCmd   `cmd:"" help:"Parse and assemble instructions."`
-	Exec sub.ExecCmd `cmd:"" help:"Assemble and execute instructions."`
-	List sub.ListCmd `cmd:"" help:"List command names."`
-	Get  sub.GetCmd  `cmd:"" help:"Show instruction information."`
-	Reg  sub.RegCmd  `cmd:"" help:"Show register information."`
-	Gen  sub.GenCmd  `cmd:"" help:"Generate instructions."`
+	As      sub.AsCmd      `cmd:"" help:"Parse and assemble instructions."`
+	Exec    sub.ExecCmd    `cmd:"" help:"Assemble and execute instructions."`
+	List    sub.ListCmd    `cmd:"" help:"List command names."`
+	Get     sub.GetCmd     `cmd:"" help:"Show instruction information."`
+	Search  sub.SearchCmd  `cmd:"" help:"Search instruction forms by ISA, operands, opcode or summary."`
+	Encode  sub.EncodeCmd  `cmd:"" help:"Encode an instruction and explain each of its bytes."`
+	Reg     sub.RegCmd     `cmd:"" help:"Show register information."`
+	Gen     sub.GenCmd     `cmd:"" help:"Generate instructions."`
+	Analyze sub.AnalyzeCmd `cmd:"" help:"Estimate loop throughput from a timing model."`
 }
 
 func main() {
@@ -0,0 +1,101 @@
+package sub
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kalamay/x86/asm"
+	"github.com/kalamay/x86/instruction"
+	"github.com/kalamay/x86/x64"
+	"github.com/kalamay/x86/x64/cost"
+)
+
+type AnalyzeCmd struct {
+	AsCmd
+
+	Model *os.File `short:"m" required:"" help:"Timing model XML file."`
+}
+
+func (cli *AnalyzeCmd) Run(data *instruction.Set) error {
+	model := cost.Model{}
+	err := model.Load(cli.Model)
+	cli.Model.Close()
+	if err != nil {
+		return err
+	}
+
+	p, err := cli.parser()
+	if err != nil {
+		return err
+	}
+
+	p.SetDirectives(asm.PrintNop, asm.BreakNop)
+
+	prog := x64.NewProgram()
+	e := x64.Emit{}
+	e.Open(prog, nil)
+	err = p.Eval(data, &e)
+	if err = asm.Errors(err, e.Close(), cli.MaxErrors); err != nil {
+		return err
+	}
+
+	r, err := model.Analyze(prog.Values())
+	if err != nil {
+		return err
+	}
+	if len(r.Lines) == 0 {
+		return errors.New("no instructions to analyze")
+	}
+
+	buf := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(buf, "Model:        %s\n", model.Name)
+	fmt.Fprintf(buf, "Instructions: %d\n", len(r.Lines))
+	fmt.Fprintf(buf, "Uops:         %d\n", r.Uops)
+	fmt.Fprintf(buf, "Cycles:       %.2f (%s bound)\n", r.Cycles(), r.Bottleneck())
+	fmt.Fprintf(buf, "IPC:          %.2f\n", float64(len(r.Lines))/r.Cycles())
+	fmt.Fprintf(buf, "  issue       %.2f\n", r.IssueBound)
+	fmt.Fprintf(buf, "  ports       %.2f\n", r.PortBound)
+	fmt.Fprintf(buf, "  dependency  %.2f\n", r.DepBound)
+
+	if r.Ports != 0 {
+		buf.WriteString("\nPort pressure:\n")
+		for i, p := range r.Pressure {
+			if r.Ports&(1<<i) != 0 {
+				fmt.Fprintf(buf, "  p%x  %5.2f\n", i, p)
+			}
+		}
+	}
+
+	buf.WriteString("\n  LAT   RTHR  UOPS  PORTS           INSTRUCTION\n")
+	unknown := false
+	for _, l := range r.Lines {
+		mark := ' '
+		if !l.Known {
+			mark, unknown = '?', true
+		}
+		fmt.Fprintf(buf, "%c %3d  %5.2f  %4d  %-15s %s\n",
+			mark, l.Timing.Latency, l.Timing.Throughput, l.Timing.Ports.Uops(),
+			l.Timing.Ports, callString(l.Call))
+	}
+	if unknown {
+		buf.WriteString("\n? form missing from the model, default timing used\n")
+	}
+	buf.Flush()
+	return nil
+}
+
+func callString(call *x64.EmitCall) string {
+	b := strings.Builder{}
+	b.WriteString(call.Instruction.Name)
+	for i, op := range call.Args {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteByte(' ')
+		b.WriteString(op.String())
+	}
+	return b.String()
+}
@@ -5,41 +5,65 @@ import (
 	"os"
 	"strings"
 
-	"github.com/kalamay/x86/cmd/x86/parser"
+	"github.com/kalamay/x86/asm"
 	"github.com/kalamay/x86/instruction"
 	"github.com/kalamay/x86/x64"
 )
 
 type AsCmd struct {
-	File *os.File `short:"f" help:"Load assembly from specified file."`
+	Files   []string `short:"f" type:"existingfile" help:"Load assembly from specified files, in order."`
+	Include []string `short:"I" type:"existingdir" help:"Search directory for included files."`
+	Syntax  string   `short:"s" help:"Input syntax." default:"intel" enum:"intel,att,go,nasm"`
+
+	MaxErrors int `short:"e" default:"10" help:"Maximum number of errors to report, or 0 for all."`
 
 	Input string `arg:"" optional:"" help:"Input to assemble instead of stdin."`
 }
 
 func (cli *AsCmd) Run(data *instruction.Set) error {
-	p := parser.Parser{}
-	switch {
-	case cli.File != nil:
-		p.Init(cli.File.Name(), cli.File)
-	case len(cli.Input) > 0:
-		p.Init("<input>", strings.NewReader(cli.Input))
-	default:
-		p.Init("<stdin>", os.Stdin)
+	p, err := cli.parser()
+	if err != nil {
+		return err
 	}
 
-	p.SetDirectives(parser.PrintNop, parser.BreakNop)
+	p.SetDirectives(asm.PrintNop, asm.BreakNop)
 
 	buf := bytes.Buffer{}
 
 	e := x64.Emit{}
 	e.Open(x64.NewMachine(), &buf)
-	if err := p.Eval(data, &e); err != nil {
-		return err
-	}
-	for _, err := range e.Close() {
+	err = p.Eval(data, &e)
+	if err = asm.Errors(err, e.Close(), cli.MaxErrors); err != nil {
 		return err
 	}
 
 	os.Stdout.Write(buf.Bytes())
 	return nil
 }
+
+// parser returns a parser initialized with the input files, or with the
+// input argument or stdin when there are none.
+func (cli *AsCmd) parser() (*asm.Parser, error) {
+	syntax, _ := asm.SyntaxOf(cli.Syntax)
+	p := &asm.Parser{Syntax: syntax, Include: cli.Include, MaxErrors: cli.MaxErrors}
+
+	switch {
+	case len(cli.Files) > 0:
+		for i, name := range cli.Files {
+			src, err := os.ReadFile(name)
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				p.Init(name, bytes.NewReader(src))
+			} else {
+				p.Append(name, bytes.NewReader(src))
+			}
+		}
+	case len(cli.Input) > 0:
+		p.Init("<input>", strings.NewReader(cli.Input))
+	default:
+		p.Init("<stdin>", os.Stdin)
+	}
+	return p, nil
+}
@@ -0,0 +1,122 @@
+package sub
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kalamay/x86/asm"
+	"github.com/kalamay/x86/instruction"
+	"github.com/kalamay/x86/x64"
+)
+
+type EncodeCmd struct {
+	Syntax string `short:"s" help:"Input syntax." default:"intel" enum:"intel,att,go,nasm"`
+	Mode   string `short:"m" help:"Processor mode in bits." default:"64" enum:"16,32,64"`
+	Policy string `short:"p" help:"Encoding selection policy." default:"preferred" enum:"preferred,shortest,canonical"`
+
+	Input string `arg:"" help:"Instruction to encode."`
+}
+
+func (cli *EncodeCmd) Run(data *instruction.Set) error {
+	syntax, _ := asm.SyntaxOf(cli.Syntax)
+	p := &asm.Parser{Syntax: syntax}
+	p.Init("<input>", strings.NewReader(cli.Input))
+
+	prog := x64.NewProgram()
+	e := x64.Emit{}
+	e.Open(prog, nil)
+	switch cli.Mode {
+	case "32":
+		e.SetMode(x64.Mode32)
+	case "16":
+		e.SetMode(x64.Mode16)
+	}
+	err := p.Eval(data, &e)
+	if err = asm.Errors(err, e.Close(), 0); err != nil {
+		return err
+	}
+
+	var policy x64.Policy
+	switch cli.Policy {
+	case "shortest":
+		policy = x64.Shortest
+	case "canonical":
+		policy = x64.Canonical
+	}
+
+	buf := bufio.NewWriter(os.Stdout)
+	defer buf.Flush()
+	n := 0
+	for _, v := range prog.Values() {
+		call, ok := v.(*x64.EmitCall)
+		if !ok {
+			continue
+		}
+		x, err := policy.Explain(call)
+		if err != nil {
+			return fmt.Errorf("%s: %w", call.Name(), err)
+		}
+		if n > 0 {
+			buf.WriteByte('\n')
+		}
+		encodeExplain(buf, call, x)
+		n++
+	}
+	return nil
+}
+
+func encodeExplain(buf *bufio.Writer, call *x64.EmitCall, x *x64.Explanation) {
+	fmt.Fprintf(buf, "Bytes: % x\n", x.Bytes)
+	if f := x.Form; f != nil {
+		fmt.Fprintf(buf, "Form:  %s", call.Instruction.Name)
+		for i := uint8(0); i < f.Operands.Len; i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(buf, " %s", f.Operands.Val[i])
+		}
+		fmt.Fprintf(buf, "  # %s", f.GasName)
+		if f.ISA != 0 {
+			fmt.Fprintf(buf, "  %s", strings.Join(isaNames(f.ISA), ","))
+		}
+		buf.WriteByte('\n')
+		if len(f.Encodings) > 1 {
+			for i := range f.Encodings {
+				if f.Encodings[i] == *x.Encoding {
+					fmt.Fprintf(buf, "Encoding: %d of %d\n", i+1, len(f.Encodings))
+					break
+				}
+			}
+		}
+	}
+	if len(x.Args) > 0 {
+		buf.WriteString("Operands:\n")
+		for i, arg := range x.Args {
+			fmt.Fprintf(buf, "  #%d  %s\n", i, arg)
+		}
+	}
+
+	buf.WriteString("Parts:\n")
+	for _, p := range x.Parts {
+		line := fmt.Sprintf("  %2d  %-12s %-8s %s", p.Offset, fmt.Sprintf("% x", p.Bytes), p.Kind, p.Note)
+		if p.Arg >= 0 {
+			line = fmt.Sprintf("%-36s #%d", line, p.Arg)
+		}
+		buf.WriteString(strings.TrimRight(line, " "))
+		buf.WriteByte('\n')
+		for _, f := range p.Fields {
+			bits := fmt.Sprintf("[%d:%d]", f.Offset, f.Shift+f.Bits-1)
+			if f.Bits > 1 {
+				bits = fmt.Sprintf("[%d:%d-%d]", f.Offset, f.Shift+f.Bits-1, f.Shift)
+			}
+			line := fmt.Sprintf("      %-11s %-8s %0*b", bits, f.Name, f.Bits, f.Value)
+			if f.Arg >= 0 {
+				line = fmt.Sprintf("%-36s #%d", line, f.Arg)
+			}
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+	}
+}
@@ -7,10 +7,10 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"strings"
+	"strconv"
 	"syscall"
 
-	"github.com/kalamay/x86/cmd/x86/parser"
+	"github.com/kalamay/x86/asm"
 	"github.com/kalamay/x86/instruction"
 	"github.com/kalamay/x86/operand"
 	"github.com/kalamay/x86/x64"
@@ -29,12 +29,17 @@ func (cli *ExecCmd) Run(data *instruction.Set) error {
 			return err
 		}
 
-		args := []string{lldb, me, "-O", "settings set target.x86-disassembly-flavor intel", "-o", "run", "--", "exec"}
+		args := []string{lldb, me, "-O", "settings set target.x86-disassembly-flavor intel", "-o", "run", "--", "exec", "-s", cli.Syntax, "-e", strconv.Itoa(cli.MaxErrors)}
+
+		for _, dir := range cli.Include {
+			args = append(args, "-I", dir)
+		}
 
 		switch {
-		case cli.File != nil:
-			args = append(args, "-f")
-			args = append(args, cli.File.Name())
+		case len(cli.Files) > 0:
+			for _, name := range cli.Files {
+				args = append(args, "-f", name)
+			}
 		case len(cli.Input) > 0:
 			args = append(args, cli.Input)
 		default:
@@ -49,28 +54,20 @@ func (cli *ExecCmd) Run(data *instruction.Set) error {
 	emit := x64.Emit{}
 	emit.Open(x64.NewMachine(), &buf)
 
-	pr := parser.NewPrint(&emit, operand.R15)
+	pr := asm.NewPrint(&emit, operand.R15)
 
-	p := parser.Parser{}
-	p.SetDirectives(pr, parser.NewBreak(&emit))
-
-	switch {
-	case cli.File != nil:
-		p.Init(cli.File.Name(), cli.File)
-	case len(cli.Input) > 0:
-		p.Init("<input>", strings.NewReader(cli.Input))
-	default:
-		p.Init("<stdin>", os.Stdin)
-	}
-
-	if err := p.Eval(data, &emit); err != nil {
+	p, err := cli.parser()
+	if err != nil {
 		return err
 	}
+	p.SetDirectives(pr, asm.NewBreak(&emit))
+
+	err = p.Eval(data, &emit)
 
 	emit.VZEROALL()
 	emit.RET()
 
-	for _, err := range emit.Close() {
+	if err = asm.Errors(err, emit.Close(), cli.MaxErrors); err != nil {
 		return err
 	}
 
@@ -0,0 +1,329 @@
+package sub
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/kalamay/x86/instruction"
+	"github.com/kalamay/x86/operand"
+)
+
+type SearchCmd struct {
+	ISA       instruction.ISA `short:"i" help:"Require all of the ISA extensions (e.g. AVX2,FMA3)."`
+	Operands  []string        `short:"o" help:"Match the operands in order, using * for any (e.g. xmm,m128)."`
+	With      []string        `short:"w" help:"Require each operand in any position (e.g. ymm,imm8)."`
+	Opcode    string          `short:"c" help:"Match the leading opcode bytes in hex (e.g. 0f58)."`
+	Summary   string          `short:"s" help:"Match text in the summary, ignoring case."`
+	MMX       string          `name:"mmx" help:"Match the MMX mode." default:"any" enum:"any,none,FPU,MMX"`
+	XMM       string          `name:"xmm" help:"Match the XMM mode." default:"any" enum:"any,none,SSE,AVX"`
+	Canceling bool            `help:"Only forms with canceling inputs."`
+	Format    string          `short:"F" help:"Output format." default:"table" enum:"table,json,yaml"`
+}
+
+// searchResult is a matching form of an instruction.
+type searchResult struct {
+	Name     string
+	Summary  string
+	GasName  string
+	GoName   string `json:",omitempty"`
+	Prefix   string `json:",omitempty"`
+	Opcode   string
+	Operands []string `json:",omitempty"`
+	ISA      []string `json:",omitempty"`
+	MmxMode  string   `json:",omitempty"`
+	XmmMode  string   `json:",omitempty"`
+
+	CancelingInputs bool `json:",omitempty"`
+}
+
+func (cli *SearchCmd) Run(data *instruction.Set) error {
+	m, err := cli.matcher()
+	if err != nil {
+		return err
+	}
+
+	var results []searchResult
+	for i := range data.Instructions {
+		in := &data.Instructions[i]
+		for i := range in.Forms {
+			if f := &in.Forms[i]; m.match(in, f) {
+				results = append(results, newSearchResult(in, f))
+			}
+		}
+	}
+
+	buf := bufio.NewWriter(os.Stdout)
+	switch cli.Format {
+	case "json":
+		enc := json.NewEncoder(buf)
+		enc.SetIndent("", "  ")
+		if results == nil {
+			results = []searchResult{}
+		}
+		err = enc.Encode(results)
+	case "yaml":
+		searchYAML(buf, results)
+	default:
+		searchTable(buf, results)
+	}
+	if ferr := buf.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// searchMatcher holds the parsed search flags.
+type searchMatcher struct {
+	isa       instruction.ISA
+	operands  []string
+	with      []string
+	opcode    []byte
+	summary   string
+	mmx       *instruction.MmxMode
+	xmm       *instruction.XmmMode
+	canceling bool
+}
+
+func (cli *SearchCmd) matcher() (*searchMatcher, error) {
+	m := &searchMatcher{
+		isa:       cli.ISA,
+		summary:   strings.ToLower(cli.Summary),
+		canceling: cli.Canceling,
+	}
+
+	var err error
+	if m.operands, err = operandNames(cli.Operands, true); err != nil {
+		return nil, err
+	}
+	if m.with, err = operandNames(cli.With, false); err != nil {
+		return nil, err
+	}
+	if m.opcode, err = hex.DecodeString(strings.TrimPrefix(cli.Opcode, "0x")); err != nil {
+		return nil, fmt.Errorf("invalid opcode %q", cli.Opcode)
+	}
+
+	if cli.MMX != "any" {
+		m.mmx = new(instruction.MmxMode)
+		if cli.MMX != "none" {
+			if err = m.mmx.UnmarshalText([]byte(cli.MMX)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if cli.XMM != "any" {
+		m.xmm = new(instruction.XmmMode)
+		if cli.XMM != "none" {
+			if err = m.xmm.UnmarshalText([]byte(cli.XMM)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// operandNames checks that each of names is an operand type, or * if
+// wild is set.
+func operandNames(names []string, wild bool) ([]string, error) {
+	for _, name := range names {
+		if wild && name == "*" {
+			continue
+		}
+		if _, ok := operand.ParamOf(name); !ok {
+			return nil, fmt.Errorf("unknown operand type %q", name)
+		}
+	}
+	return names, nil
+}
+
+func (m *searchMatcher) match(in *instruction.Instruction, f *instruction.Form) bool {
+	switch {
+	case f.ISA&m.isa != m.isa,
+		m.mmx != nil && f.MmxMode != *m.mmx,
+		m.xmm != nil && f.XmmMode != *m.xmm,
+		m.canceling && !f.CancelingInputs,
+		m.summary != "" && !strings.Contains(strings.ToLower(in.Summary), m.summary):
+		return false
+	}
+
+	if m.operands != nil {
+		if int(f.Operands.Len) != len(m.operands) {
+			return false
+		}
+		for i, name := range m.operands {
+			if name != "*" && f.Operands.Val[i].String() != name {
+				return false
+			}
+		}
+	}
+
+	for _, name := range m.with {
+		found := false
+		for i := uint8(0); i < f.Operands.Len && !found; i++ {
+			found = f.Operands.Val[i].String() == name
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(m.opcode) > 0 {
+		found := false
+		for i := range f.Encodings {
+			found = found || opcodeHas(&f.Encodings[i], m.opcode)
+		}
+		if !found && !opcodeHas(&f.Encoding, m.opcode) {
+			return false
+		}
+	}
+	return true
+}
+
+// opcodeHas reports whether the opcode of enc, with or without its mandatory
+// prefixes, starts with b.
+func opcodeHas(enc *instruction.Encoding, b []byte) bool {
+	op, n := opcodeBytes(enc)
+	return hasBytes(op[n:], b) || (n > 0 && hasBytes(op, b))
+}
+
+// opcodeBytes returns the mandatory prefixes of enc followed by its opcode,
+// and the number of prefix bytes. The leading opcode bytes implied by a VEX
+// or EVEX prefix are included, so VADDPS has the opcode 0f58 as ADDPS does.
+func opcodeBytes(enc *instruction.Encoding) ([]byte, int) {
+	op := make([]byte, 0, 8)
+	for i := 0; i < int(enc.Prefix.Len); i++ {
+		if enc.Prefix.Mandatory(i) {
+			op = append(op, enc.Prefix.Val[i])
+		}
+	}
+	n := len(op)
+	m, _ := enc.VEX.Fmmmmm.Value()
+	if enc.EVEX.Fmm.IsSet() {
+		m, _ = enc.EVEX.Fmm.Value()
+	}
+	switch m {
+	case 1:
+		op = append(op, 0x0f)
+	case 2:
+		op = append(op, 0x0f, 0x38)
+	case 3:
+		op = append(op, 0x0f, 0x3a)
+	}
+	for i := uint8(0); i < enc.Opcode.Len; i++ {
+		op = append(op, byte(enc.Opcode.Val[i].Byte))
+	}
+	return op, n
+}
+
+func hasBytes(op, b []byte) bool {
+	return len(op) >= len(b) && string(op[:len(b)]) == string(b)
+}
+
+func newSearchResult(in *instruction.Instruction, f *instruction.Form) searchResult {
+	r := searchResult{
+		Name:            in.Name,
+		Summary:         in.Summary,
+		GasName:         f.GasName,
+		GoName:          f.GoName,
+		ISA:             isaNames(f.ISA),
+		MmxMode:         f.MmxMode.String(),
+		XmmMode:         f.XmmMode.String(),
+		CancelingInputs: f.CancelingInputs,
+	}
+	var sb strings.Builder
+	for i := uint8(0); i < f.Encoding.Prefix.Len; i++ {
+		fmt.Fprintf(&sb, "%02x", f.Encoding.Prefix.Val[i])
+	}
+	r.Prefix = sb.String()
+	op, n := opcodeBytes(&f.Encoding)
+	r.Opcode = hex.EncodeToString(op[n:])
+	for i := uint8(0); i < f.Operands.Len; i++ {
+		r.Operands = append(r.Operands, f.Operands.Val[i].String())
+	}
+	return r
+}
+
+// isaNames returns the names of the extensions in isa in sorted order.
+func isaNames(isa instruction.ISA) []string {
+	names := isa.Names()
+	sort.Strings(names)
+	return names
+}
+
+func searchTable(buf *bufio.Writer, results []searchResult) {
+	maxname, maxop, maxgas, maxopc := len("NAME"), len("OPERANDS"), len("GAS"), len("OP")
+	for _, r := range results {
+		if n := len(r.Name); n > maxname {
+			maxname = n
+		}
+		if n := len(strings.Join(r.Operands, ",")); n > maxop {
+			maxop = n
+		}
+		if n := len(r.GasName); n > maxgas {
+			maxgas = n
+		}
+		if n := len(r.Prefix) + len(r.Opcode); n > maxopc {
+			maxopc = n
+		}
+	}
+
+	fmt.Fprintf(buf, "%-*s  %-*s  %-*s  %-*s  ISA\n",
+		maxname, "NAME",
+		maxop, "OPERANDS",
+		maxgas, "GAS",
+		maxopc, "OP",
+	)
+	for _, r := range results {
+		fmt.Fprintf(buf, "%-*s  %-*s  %-*s  %-*s  %s\n",
+			maxname, r.Name,
+			maxop, strings.Join(r.Operands, ","),
+			maxgas, r.GasName,
+			maxopc, r.Prefix+r.Opcode,
+			strings.Join(r.ISA, ","),
+		)
+	}
+}
+
+func searchYAML(buf *bufio.Writer, results []searchResult) {
+	buf.WriteString("---\n")
+	if len(results) == 0 {
+		buf.WriteString("[]\n")
+		return
+	}
+	for _, r := range results {
+		fmt.Fprintf(buf, "- Name: %s\n  Summary: %q\n  GasName: %s\n", r.Name, r.Summary, r.GasName)
+		if r.GoName != "" {
+			fmt.Fprintf(buf, "  GoName: %s\n", r.GoName)
+		}
+		if r.Prefix != "" {
+			fmt.Fprintf(buf, "  Prefix: \"%s\"\n", r.Prefix)
+		}
+		fmt.Fprintf(buf, "  Opcode: \"%s\"\n", r.Opcode)
+		if len(r.Operands) > 0 {
+			buf.WriteString("  Operands: [")
+			for i, op := range r.Operands {
+				if i > 0 {
+					buf.WriteString(", ")
+				}
+				fmt.Fprintf(buf, "%q", op)
+			}
+			buf.WriteString("]\n")
+		}
+		if len(r.ISA) > 0 {
+			fmt.Fprintf(buf, "  ISA: [%s]\n", strings.Join(r.ISA, ", "))
+		}
+		if r.MmxMode != "" {
+			fmt.Fprintf(buf, "  MmxMode: %s\n", r.MmxMode)
+		}
+		if r.XmmMode != "" {
+			fmt.Fprintf(buf, "  XmmMode: %s\n", r.XmmMode)
+		}
+		if r.CancelingInputs {
+			buf.WriteString("  CancelingInputs: true\n")
+		}
+	}
+}
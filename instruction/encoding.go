@@ -58,14 +58,32 @@ func (e *Encoding) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 				}
 			}
 		case xml.EndElement:
-			if e.Opcode.Len == 0 || tmp.score() < e.score() {
-				*e = tmp
-			}
+			*e = tmp
 			return nil
 		}
 	}
 }
 
+// EncodedLen returns the length of the instruction encoded for args in
+// 64-bit mode, not counting any prefix given with the call.
+func (e *Encoding) EncodedLen(args []operand.Arg) int {
+	n := e.Prefix.EncodedLen(args)
+	switch {
+	case e.EVEX.Fmm.IsSet():
+		n += e.EVEX.EncodedLen(args)
+	case e.VEX.Type != VexTypeNone:
+		n += e.VEX.EncodedLen(args)
+	default:
+		n += e.REX.EncodedLen(args)
+	}
+	return n + e.Opcode.EncodedLen(args) +
+		e.ModRM.EncodedLen(args) +
+		e.RegisterByte.EncodedLen(args) +
+		e.Immediate.EncodedLen(args) +
+		e.CodeOffset.EncodedLen(args) +
+		e.DataOffset.EncodedLen(args)
+}
+
 func (e *Encoding) score() int {
 	s := int(e.Prefix.Len) +
 		e.REX.score() +
@@ -110,6 +128,10 @@ func (ol *OpcodeList) Encode(f *Format, args []operand.Arg) {
 	}
 }
 
+func (ol *OpcodeList) EncodedLen(args []operand.Arg) int {
+	return int(ol.Len)
+}
+
 func (ol *OpcodeList) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	var oc Opcode
 	if err := d.DecodeElement(&oc, &start); err != nil {
@@ -194,47 +216,75 @@ const (
 //     The index field specifies the register number of the index register.
 // BASE:
 //     The base field specifies the register number of the base register.
+//
+// A VSIB operand of a gather or scatter always uses the SIB byte, and its
+// index field holds the number of a vector register. An index of 0b100 then
+// names xmm4 rather than the absence of an index.
 func (m *ModRM) Encode(f *Format, args []operand.Arg) {
 	v, mode := m.RM.Value()
 	if mode != OptModeRef {
 		return
 	}
 
-	var (
-		disp       int32
-		dispsize   operand.Size
-		modrm, sib byte
-	)
+	modrm, sib, n, dispsize := address(args[v])
+	f.Val[f.Len] = modrm | m.reg(args)
+	f.Val[f.Len+1] = sib
+	f.Len += uint8(n)
+	if dispsize > operand.Size0 {
+		f.Len += uint8(operand.Int(args[v].(operand.Mem).Disp).Encode(f.Val[f.Len:], dispsize))
+	}
+}
 
-	n := 1
+// EncodedLen counts the ModR/M byte, and the SIB byte and displacement that
+// a memory operand in args may need. It is 0 without a ModR/M byte.
+func (m *ModRM) EncodedLen(args []operand.Arg) int {
+	v, mode := m.RM.Value()
+	if mode != OptModeRef {
+		return 0
+	}
+	_, _, n, dispsize := address(args[v])
+	return n + dispsize.Bytes()
+}
+
+// address returns the ModR/M byte without its reg field, the SIB byte, the
+// number of those bytes used, and the size of the displacement for arg.
+func address(arg operand.Arg) (modrm, sib byte, n int, dispsize operand.Size) {
+	n = 1
 
-	switch arg := args[v].(type) {
+	switch arg := arg.(type) {
 	case operand.Reg:
 		modrm = ModRMDirect | (arg.ID() & ModRMMask)
 	case operand.Mem:
-		disp = arg.Disp
+		disp := arg.Disp
 		switch arg.Base.Type() {
 		case operand.RegTypeIP:
 			modrm = ModRMRelative
 			dispsize = operand.Size32
 		case operand.RegTypeGeneral:
+			id := arg.Base.ID() & ModRMMask
 			switch {
+			case arg.Base == 0:
+				// Without a base, a SIB base of 0b101 with mod=00 takes a
+				// disp32. This is also the absolute form, as r/m=0b101
+				// alone is RIP-relative.
+				dispsize = operand.Size32
+				modrm = ModRMIndirect | ModRMSIB
+				sib = SIBNoBase
+				n = 2
 			case disp < math.MinInt8 || math.MaxInt8 < disp:
 				dispsize = operand.Size32
 				modrm = ModRMIndirectDisp32
-			case disp != 0:
+			case disp != 0 || id == ModRMRelative:
+				// A base of rbp or r13 has no mod=00 form, so it takes a
+				// zero disp8.
 				dispsize = operand.Size8
 				modrm = ModRMIndirectDisp8
 			default:
 				modrm = ModRMIndirect
 			}
 
-			if arg.Base == 0 {
-				n = 2
-				sib = SIBNoBase
-			} else {
-				id := arg.Base.ID() & ModRMMask
-				if arg.Index != 0 || id == ModRMSIB || id == ModRMRelative {
+			if arg.Base != 0 {
+				if arg.Index != 0 || id == ModRMSIB {
 					n = 2
 					modrm |= ModRMSIB
 					sib = id
@@ -252,20 +302,129 @@ func (m *ModRM) Encode(f *Format, args []operand.Arg) {
 			}
 		}
 	}
+	return
+}
 
-	switch v, mode = m.Reg.Value(); mode {
-	case OptModeValue:
-		modrm |= (v & ModRMMask) << 3
-	case OptModeRef:
-		modrm |= (args[v].(operand.Reg).ID() & ModRMMask) << 3
+// Encode16 is Encode for a memory operand with 16-bit addressing. There is
+// no SIB byte, and the address is one of the fixed pairs of base and index:
+//
+//	R/M  MOD=00   MOD=01,10
+//	000  [bx+si]  [bx+si+disp]
+//	001  [bx+di]  [bx+di+disp]
+//	010  [bp+si]  [bp+si+disp]
+//	011  [bp+di]  [bp+di+disp]
+//	100  [si]     [si+disp]
+//	101  [di]     [di+disp]
+//	110  [disp16] [bp+disp]
+//	111  [bx]     [bx+disp]
+//
+// The registers of the address must be one of these pairs.
+func (m *ModRM) Encode16(f *Format, args []operand.Arg) {
+	v, mode := m.RM.Value()
+	if mode != OptModeRef {
+		return
+	}
+	mem, ok := args[v].(operand.Mem)
+	if !ok {
+		m.Encode(f, args)
+		return
 	}
 
-	f.Val[f.Len] = modrm
-	f.Val[f.Len+1] = sib
-	f.Len += uint8(n)
+	modrm, dispsize := address16(mem)
+	f.Val[f.Len] = modrm | m.reg(args)
+	f.Len++
 	if dispsize > operand.Size0 {
-		f.Len += uint8(operand.Int(disp).Encode(f.Val[f.Len:], dispsize))
+		f.Len += uint8(operand.Int(mem.Disp).Encode(f.Val[f.Len:], dispsize))
+	}
+}
+
+// EncodedLen16 is EncodedLen for a 16-bit address, which has no SIB byte and
+// at most a disp16.
+func (m *ModRM) EncodedLen16(args []operand.Arg) int {
+	v, mode := m.RM.Value()
+	if mode != OptModeRef {
+		return 0
+	}
+	mem, ok := args[v].(operand.Mem)
+	if !ok {
+		return m.EncodedLen(args)
 	}
+	_, dispsize := address16(mem)
+	return 1 + dispsize.Bytes()
+}
+
+// Encode32 encodes the ModR/M byte as Encode does, but for a 32-bit address
+// outside 64-bit mode. There, mod=00 with r/m=0b101 is an absolute disp32
+// rather than RIP-relative, so an address without registers needs no SIB.
+func (m *ModRM) Encode32(f *Format, args []operand.Arg) {
+	v, mode := m.RM.Value()
+	if mode != OptModeRef {
+		return
+	}
+	mem, ok := args[v].(operand.Mem)
+	if !ok || mem.Base != 0 || mem.Index != 0 {
+		m.Encode(f, args)
+		return
+	}
+
+	f.Val[f.Len] = ModRMIndirect | ModRMRelative | m.reg(args)
+	f.Len++
+	f.Len += uint8(operand.Int(mem.Disp).Encode(f.Val[f.Len:], operand.Size32))
+}
+
+// EncodedLen32 is EncodedLen outside 64-bit mode, where an address without
+// registers is the ModR/M byte and a disp32.
+func (m *ModRM) EncodedLen32(args []operand.Arg) int {
+	v, mode := m.RM.Value()
+	if mode != OptModeRef {
+		return 0
+	}
+	mem, ok := args[v].(operand.Mem)
+	if !ok || mem.Base != 0 || mem.Index != 0 {
+		return m.EncodedLen(args)
+	}
+	return 5
+}
+
+// address16 returns the ModR/M byte without its reg field and the size of
+// the displacement for a 16-bit address.
+func address16(mem operand.Mem) (modrm byte, dispsize operand.Size) {
+	var rm byte
+	switch base, index := mem.Base16(); {
+	case base == 0 && index == 0:
+		rm = 0b110
+	case base == 0:
+		rm = 0b100 | (index.ID() & 1)
+	case index == 0 && base.ID() == 3:
+		rm = 0b111
+	case index == 0:
+		rm = 0b110
+	default:
+		rm = (index.ID() & 1) | ((base.ID() >> 1) & 0b10)
+	}
+
+	switch disp := mem.Disp; {
+	case mem.Base == 0 && mem.Index == 0:
+		modrm, dispsize = ModRMIndirect, operand.Size16
+	case disp < math.MinInt8 || math.MaxInt8 < disp:
+		modrm, dispsize = ModRMIndirectDisp32, operand.Size16
+	case disp != 0 || rm == 0b110:
+		modrm, dispsize = ModRMIndirectDisp8, operand.Size8
+	default:
+		modrm = ModRMIndirect
+	}
+	return modrm | rm, dispsize
+}
+
+// reg returns the reg field of the ModR/M byte.
+func (m *ModRM) reg(args []operand.Arg) byte {
+	switch v, mode := m.Reg.Value(); mode {
+	case OptModeValue:
+		return (v & ModRMMask) << 3
+	case OptModeRef:
+		return (args[v].(operand.Reg).ID() & ModRMMask) << 3
+	}
+	return 0
 }
 
 func (m *ModRM) score() int {
@@ -302,6 +461,14 @@ func (rb *RegisterByte) Encode(f *Format, args []operand.Arg) {
 	}
 }
 
+// EncodedLen is 1 if a register operand is encoded in a byte of its own.
+func (rb *RegisterByte) EncodedLen(args []operand.Arg) int {
+	if _, m := rb.Register.Value(); m == OptModeRef {
+		return 1
+	}
+	return 0
+}
+
 type Immediate struct {
 	// Size of the constant in bytes. Possible values are 1, 2, 4, or 8.
 	Size operand.Size `xml:"size,attr"`
@@ -330,6 +497,14 @@ func (il *ImmediateList) Encode(f *Format, args []operand.Arg) {
 	}
 }
 
+func (il *ImmediateList) EncodedLen(args []operand.Arg) int {
+	n := 0
+	for i := uint8(0); i < il.Len; i++ {
+		n += il.Val[i].Size.Bytes()
+	}
+	return n
+}
+
 func (il *ImmediateList) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	var i Immediate
 	if err := d.DecodeElement(&i, &start); err != nil {
@@ -348,13 +523,47 @@ type CodeOffset struct {
 }
 
 func (co *CodeOffset) Encode(f *Format, args []operand.Arg) {
-	if v, m := co.Value.Value(); m == OptModeRef && co.Size >= operand.Size8 {
+	co.encode(f, args, co.Size)
+}
+
+// Encode16 is Encode for 16-bit code, where the operand size turns a rel32
+// into a rel16. The instruction pointer wraps at 64K, so the offset is
+// truncated rather than checked.
+func (co *CodeOffset) Encode16(f *Format, args []operand.Arg) {
+	co.encode(f, args, co.size16())
+}
+
+// EncodedLen is the size of the relative offset, if the encoding has one.
+func (co *CodeOffset) EncodedLen(args []operand.Arg) int {
+	if _, m := co.Value.Value(); m == OptModeRef {
+		return co.Size.Bytes()
+	}
+	return 0
+}
+
+// EncodedLen16 is EncodedLen with the offset limited to 16 bits.
+func (co *CodeOffset) EncodedLen16(args []operand.Arg) int {
+	if _, m := co.Value.Value(); m == OptModeRef {
+		return co.size16().Bytes()
+	}
+	return 0
+}
+
+func (co *CodeOffset) size16() operand.Size {
+	if co.Size > operand.Size16 {
+		return operand.Size16
+	}
+	return co.Size
+}
+
+func (co *CodeOffset) encode(f *Format, args []operand.Arg, size operand.Size) {
+	if v, m := co.Value.Value(); m == OptModeRef && size >= operand.Size8 {
 		switch rel := args[v].(type) {
 		case relFwd:
-			f.Len += uint8(operand.Int(rel).Encode(f.Val[f.Len:], co.Size))
+			f.Len += uint8(operand.Int(rel).Encode(f.Val[f.Len:], size))
 		case relRwd:
-			rel -= relRwd(f.Len) + relRwd(co.Size.Bytes())
-			f.Len += uint8(operand.Int(rel).Encode(f.Val[f.Len:], co.Size))
+			rel -= relRwd(f.Len) + relRwd(size.Bytes())
+			f.Len += uint8(operand.Int(rel).Encode(f.Val[f.Len:], size))
 		}
 	}
 }
@@ -368,7 +577,17 @@ type DataOffset struct {
 }
 
 func (do *DataOffset) Encode(f *Format, args []operand.Arg) {
-	if _, m := do.Value.Value(); m == OptModeRef && do.Size >= operand.Size8 {
-		panic("TODO: encode DataOffset")
+	if v, m := do.Value.Value(); m == OptModeRef && do.Size >= operand.Size8 {
+		if mem, ok := args[v].(operand.Mem); ok {
+			f.Len += uint8(operand.Uint(mem.Addr).Encode(f.Val[f.Len:], do.Size))
+		}
+	}
+}
+
+// EncodedLen is the size of the moffs address, if the encoding has one.
+func (do *DataOffset) EncodedLen(args []operand.Arg) int {
+	if _, m := do.Value.Value(); m == OptModeRef {
+		return do.Size.Bytes()
 	}
+	return 0
 }
@@ -35,6 +35,11 @@ func (is *Set) Load(r io.Reader) (err error) {
 			for o := uint8(0); o < form.Operands.Len; o++ {
 				form.Operands.Val[o].ApplyMnemonic(inst.Name)
 			}
+			for e := range form.Encodings {
+				if e == 0 || form.Encodings[e].score() < form.Encoding.score() {
+					form.Encoding = form.Encodings[e]
+				}
+			}
 		}
 		sort.SliceStable(inst.Forms, func(i, j int) bool {
 			return inst.Forms[i].score() < inst.Forms[j].score()
@@ -92,7 +97,16 @@ type Form struct {
 	// Operands are the list of constraints required for the arguments used to encode
 	// this form.
 	Operands operand.ParamList `xml:"Operand"`
-	Encoding Encoding          `xml:"Encoding"`
+	// Implicit are the registers the form reads or writes without them being
+	// passed as arguments, such as rdx:rax for DIV.
+	Implicit operand.ParamList `xml:"ImplicitOperand"`
+	// Encoding is the preferred encoding of the form, which is the first of
+	// the shortest in Encodings.
+	Encoding Encoding `xml:"-"`
+	// Encodings are all of the encodings of the form, in the order of the
+	// instruction set. A register-to-register MOV, for example, may place
+	// either register in the r/m field of its ModR/M byte.
+	Encodings []Encoding `xml:"Encoding"`
 }
 
 func (f *Form) score() int {
@@ -167,6 +181,25 @@ func (i ISA) Names() (names []string) {
 	return
 }
 
+// UnmarshalText sets i to the extensions named in a comma-separated list,
+// such as "AVX2,FMA3".
+func (i *ISA) UnmarshalText(text []byte) error {
+	var v ISA
+	for _, name := range strings.Split(string(text), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		isa, ok := isaNames[name]
+		if !ok {
+			return fmt.Errorf("ISA: unknown id %q", name)
+		}
+		v |= isa
+	}
+	*i = v
+	return nil
+}
+
 func (i *ISA) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	for _, attr := range start.Attr {
 		if attr.Name.Local == "id" {
@@ -245,6 +278,16 @@ const (
 	MmxModeMMX                 // Instruction causes transition to MMX technology state.
 )
 
+func (m MmxMode) String() string {
+	switch m {
+	case MmxModeFPU:
+		return "FPU"
+	case MmxModeMMX:
+		return "MMX"
+	}
+	return ""
+}
+
 func (m *MmxMode) UnmarshalText(text []byte) error {
 	if v, ok := mmxModes[string(text)]; ok {
 		*m = v
@@ -267,6 +310,16 @@ const (
 	XmmModeAVX                 // Instruction accesses XMM registers in AVX mode.
 )
 
+func (m XmmMode) String() string {
+	switch m {
+	case XmmModeSSE:
+		return "SSE"
+	case XmmModeAVX:
+		return "AVX"
+	}
+	return ""
+}
+
 func (m *XmmMode) UnmarshalText(text []byte) error {
 	if v, ok := xmmModes[string(text)]; ok {
 		*m = v
@@ -24,19 +24,26 @@ type Prefix struct {
 }
 
 type PrefixList struct {
-	Val       [2]byte
-	Len       uint8
-	mandatory uint8
+	Val [2]byte
+	Len uint8
+	// MandatoryMask has bit i set if Val[i] is a mandatory prefix.
+	MandatoryMask uint8
 }
 
 func (p PrefixList) MandatoryLen() int {
-	return bits.OnesCount8(p.mandatory)
+	return bits.OnesCount8(p.MandatoryMask)
+}
+
+// Mandatory reports whether the prefix at i is part of the opcode rather
+// than an override, such as 0x66 for a 16-bit operand.
+func (p PrefixList) Mandatory(i int) bool {
+	return p.MandatoryMask&(1<<i) != 0
 }
 
 func (pl *PrefixList) Encode(f *Format, args []operand.Arg) {
 	for i := range args {
 		if mem, ok := args[i].(operand.Mem); ok {
-			if mem.Base.Size() == operand.Size32 {
+			if addr32(mem) {
 				f.Val[f.Len] = 0x67
 				f.Len++
 			}
@@ -50,6 +57,61 @@ func (pl *PrefixList) Encode(f *Format, args []operand.Arg) {
 	f.Len += uint8(copy(f.Val[f.Len:], pl.Val[:pl.Len]))
 }
 
+// EncodedLen counts the legacy prefixes of the encoding, and the address-size
+// and segment-override prefixes that a memory operand in args adds.
+func (pl *PrefixList) EncodedLen(args []operand.Arg) int {
+	n := int(pl.Len)
+	for i := range args {
+		if mem, ok := args[i].(operand.Mem); ok {
+			if addr32(mem) {
+				n++
+			}
+			if _, ok := mem.Segment.Prefix(); ok {
+				n++
+			}
+			break
+		}
+	}
+	return n
+}
+
+// Prefixed reports whether e has b as a prefix byte when encoded for args in
+// 64-bit mode. That is any legacy prefix, the REX prefix, or the first byte
+// of a VEX, XOP or EVEX prefix.
+func (e *Encoding) Prefixed(b byte, args []operand.Arg) bool {
+	for i := uint8(0); i < e.Prefix.Len; i++ {
+		if e.Prefix.Val[i] == b {
+			return true
+		}
+	}
+	for i := range args {
+		if mem, ok := args[i].(operand.Mem); ok {
+			if p, ok := mem.Segment.Prefix(); (ok && p == b) || (b == 0x67 && addr32(mem)) {
+				return true
+			}
+			break
+		}
+	}
+	switch {
+	case e.EVEX.Fmm.IsSet():
+		return b == 0x62
+	case e.VEX.Type != VexTypeNone:
+		vex, _ := e.VEX.value(args)
+		if vex2(vex) {
+			return b == vex2Byte
+		}
+		return b == byte(vex>>16)
+	}
+	rex, ok := e.REX.value(args)
+	return ok && rex == b
+}
+
+// addr32 reports whether mem has a 32-bit address, which needs an address
+// size prefix in 64-bit mode.
+func addr32(mem operand.Mem) bool {
+	return mem.Base.Size() == operand.Size32 || (mem.Base == 0 && mem.Index.Size() == operand.Size32)
+}
+
 func (pl *PrefixList) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	var p Prefix
 	if err := d.DecodeElement(&p, &start); err != nil {
@@ -57,7 +119,7 @@ func (pl *PrefixList) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error
 	}
 	pl.Val[pl.Len] = byte(p.Byte)
 	if p.Mandatory {
-		pl.mandatory |= 1 << pl.Len
+		pl.MandatoryMask |= 1 << pl.Len
 	}
 	pl.Len++
 	return nil
@@ -117,6 +179,25 @@ type REX struct {
 // REX.B either modifies the base in the ModR/M r/m field or SIB base field; or
 // it modifies the opcode reg field used for accessing GPRs.
 func (r *REX) Encode(f *Format, args []operand.Arg) bool {
+	rex, enc := r.value(args)
+	if enc {
+		f.Val[f.Len] = rex
+		f.Len++
+	}
+	return enc
+}
+
+// EncodedLen is 1 if args need a REX prefix, such as for REX.W or an
+// extended register, and 0 otherwise.
+func (r *REX) EncodedLen(args []operand.Arg) int {
+	if _, enc := r.value(args); enc {
+		return 1
+	}
+	return 0
+}
+
+// value returns the REX prefix for args, and whether it is needed.
+func (r *REX) value(args []operand.Arg) (byte, bool) {
 	rex, enc := byte(rexDefault), false
 
 	switch v, m := r.FW.Value(); m {
@@ -166,12 +247,7 @@ func (r *REX) Encode(f *Format, args []operand.Arg) bool {
 		}
 	}
 
-	if enc {
-		f.Val[f.Len] = rex
-		f.Len++
-	}
-
-	return enc
+	return rex, enc
 }
 
 func (r *REX) score() int {
@@ -304,11 +380,50 @@ type VEX struct {
 //     10: F3
 //     11: F2
 func (v *VEX) Encode(f *Format, args []operand.Arg) bool {
+	vex, ok := v.value(args)
+	if !ok {
+		return false
+	}
+
+	if vex2(vex) {
+		f.Val[f.Len] = vex2Byte
+		f.Val[f.Len+1] = byte(((vex & vex2MaskUpper) >> 8) | (vex & vex2MaskLower))
+		f.Len += 2
+	} else {
+		f.Val[f.Len] = byte(vex >> 16)
+		f.Val[f.Len+1] = byte(vex >> 8)
+		f.Val[f.Len+2] = byte(vex)
+		f.Len += 3
+	}
+
+	return true
+}
+
+// EncodedLen is 2 if args fit the two-byte VEX prefix, 3 for the three-byte
+// VEX or XOP prefix, and 0 without one.
+func (v *VEX) EncodedLen(args []operand.Arg) int {
+	switch vex, ok := v.value(args); {
+	case !ok:
+		return 0
+	case vex2(vex):
+		return 2
+	}
+	return 3
+}
+
+// vex2 reports whether vex fits the two-byte form of the prefix.
+func vex2(vex uint32) bool {
+	return (vex & vexMask) == (vexDefault & vexMask)
+}
+
+// value returns the three-byte VEX or XOP prefix for args, and whether the
+// form has one.
+func (v *VEX) value(args []operand.Arg) (uint32, bool) {
 	var vex uint32
 
 	switch v.Type {
 	default:
-		return false
+		return 0, false
 	case VexTypeVEX:
 		vex = vexDefault
 	case VexTypeXOP:
@@ -374,18 +489,7 @@ func (v *VEX) Encode(f *Format, args []operand.Arg) bool {
 		vex = (vex & ^uint32(0b11)) | uint32(b&0b11)
 	}
 
-	if (vex & vexMask) == (vexDefault & vexMask) {
-		f.Val[f.Len] = vex2Byte
-		f.Val[f.Len+1] = byte(((vex & vex2MaskUpper) >> 8) | (vex & vex2MaskLower))
-		f.Len += 2
-	} else {
-		f.Val[f.Len] = byte(vex >> 16)
-		f.Val[f.Len+1] = byte(vex >> 8)
-		f.Val[f.Len+2] = byte(vex)
-		f.Len += 3
-	}
-
-	return true
+	return vex, true
 }
 
 func (v *VEX) score() int {
@@ -535,6 +639,13 @@ func (e *EVEX) Encode(f *Format, args []operand.Arg) bool {
 	panic("TODO: encode EVEX")
 }
 
+func (e *EVEX) EncodedLen(args []operand.Arg) int {
+	if !e.Fmm.IsSet() {
+		return 0
+	}
+	return 4
+}
+
 func (e *EVEX) score() int {
 	if !e.Fmm.IsSet() {
 		return 0
@@ -0,0 +1,28 @@
+package operand
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Data is a sequence of raw bytes emitted in place of an instruction.
+type Data string
+
+func (_ Data) Kind() Kind           { return KindMisc }
+func (_ Data) Validate() error      { return nil }
+func (_ Data) Matches(p Param) bool { return false }
+
+func (d Data) String() string {
+	var b strings.Builder
+	for i := 0; i < len(d); i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("0x")
+		if d[i] < 0x10 {
+			b.WriteByte('0')
+		}
+		b.WriteString(strconv.FormatUint(uint64(d[i]), 16))
+	}
+	return b.String()
+}
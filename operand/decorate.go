@@ -0,0 +1,78 @@
+package operand
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrDecoratorInvalid = errors.New("invalid operand decorator")
+	ErrMaskExpected     = errors.New("opmask register k1-k7 expected")
+)
+
+// Decorations are the AVX-512 decorations that follow a register or memory
+// operand: an opmask as in {k1} with an optional {z} for zeroing, or a
+// broadcast as in {1to16}.
+type Decorations struct {
+	Mask      Reg
+	Zero      bool
+	Broadcast uint8
+}
+
+// Add parses a single decoration without its braces, such as "k1", "z" or
+// "1to16".
+func (d *Decorations) Add(s string) error {
+	switch {
+	case s == "":
+		return ErrDecoratorInvalid
+	case strings.EqualFold(s, "z"):
+		d.Zero = true
+	case isDigit(s[0]):
+		if !strings.HasPrefix(s, "1to") {
+			return ErrDecoratorInvalid
+		}
+		n, err := strconv.ParseUint(s[3:], 10, 8)
+		if err != nil || n == 0 || d.Broadcast != 0 {
+			return ErrDecoratorInvalid
+		}
+		d.Broadcast = uint8(n)
+	default:
+		k, ok := RegOf(s)
+		if !ok || k.Type() != RegTypeMask || k.ID() == 0 {
+			return ErrMaskExpected
+		}
+		d.Mask = k
+	}
+	return nil
+}
+
+// Apply returns arg with the decorations applied. An opmask only applies to
+// a vector or mask register, zeroing requires an opmask, and a broadcast
+// only applies to a memory operand with a supported element count.
+func (d Decorations) Apply(arg Arg) (Arg, error) {
+	if d.Broadcast != 0 {
+		m, ok := arg.(Mem)
+		if !ok || m.Type == MemTypeBroadcast {
+			return nil, ErrDecoratorInvalid
+		}
+		m = m.Broadcast(d.Broadcast)
+		if m.Validate() == ErrInvalidBroadcast {
+			return nil, ErrDecoratorInvalid
+		}
+		arg = m
+	}
+
+	switch r, ok := arg.(Reg); {
+	case d.Mask == 0 && d.Zero:
+		return nil, ErrMaskExpected
+	case d.Mask == 0:
+		return arg, nil
+	case !ok, r.Type() != RegTypeVector && (d.Zero || r.Type() != RegTypeMask):
+		return nil, ErrDecoratorInvalid
+	case d.Zero:
+		return r.Mask(d.Mask), nil
+	default:
+		return r.MergeMask(d.Mask), nil
+	}
+}
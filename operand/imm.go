@@ -24,6 +24,9 @@ func (i Int) Matches(p Param) bool {
 	if p.Kind() != KindImm {
 		return false
 	}
+	if p.Const() {
+		return i == Int(ImmParam(p))
+	}
 	s := ImmParam(p).Size()
 	if p.ExtendedSize() == Size0 && i >= 0 {
 		return s >= Uint(i).MinSize()
@@ -57,6 +60,9 @@ func (i Uint) Matches(p Param) bool {
 	if p.Kind() != KindImm {
 		return false
 	}
+	if p.Const() {
+		return i == Uint(ImmParam(p))
+	}
 	s, es := ImmParam(p).Size(), p.ExtendedSize()
 	if es > s {
 		b := s.ImmBits() - 1
@@ -3,15 +3,18 @@ package operand
 import (
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 )
 
 var (
-	ErrMemBase          = errors.New("base register not provided")
+	ErrMemBase          = errors.New("invalid base register")
 	ErrNoIndexScale     = errors.New("scale provided without index")
 	ErrInvalidScale     = errors.New("unsupported scale for index")
 	ErrUnsupportedIndex = errors.New("unsupported index")
+	ErrInvalidBroadcast = errors.New("unsupported broadcast count")
+	ErrOffsetAddress    = errors.New("memory offset takes only an address")
 )
 
 type (
@@ -23,6 +26,8 @@ type (
 		Size    Size
 		Scale   Size
 		Type    MemType
+		Bcst    uint8  // the element count of a broadcast, as in {1to16}
+		Addr    uint64 // the 64-bit address of a MemTypeOffset operand
 	}
 	MemParam uint16
 	MemType  uint16
@@ -53,6 +58,26 @@ func SizedPtr(base Reg, size Size) Mem {
 	return Mem{Base: base, Size: size}
 }
 
+// Abs returns an absolute address without a base or index register. The
+// address is sign-extended from 32 bits.
+func Abs(addr int32) Mem {
+	return Mem{Disp: addr}
+}
+
+// Moffs returns a full 64-bit address as used by the moffs forms of MOV.
+func Moffs(addr uint64) Mem {
+	return Mem{Type: MemTypeOffset, Addr: addr}
+}
+
+// AbsAddr returns an absolute address, as an Abs if it fits in a
+// sign-extended disp32 and as a Moffs otherwise.
+func AbsAddr(addr uint64) Mem {
+	if a := int64(addr); a >= math.MinInt32 && a <= math.MaxInt32 {
+		return Abs(int32(a))
+	}
+	return Moffs(addr)
+}
+
 // Offset returns a copy of m plus idx bytes.
 func (m Mem) Offset(idx int32) Mem {
 	m.Disp += idx
@@ -66,6 +91,14 @@ func (m Mem) Idx(r Reg, scale Size) Mem {
 	return m
 }
 
+// Broadcast returns a copy of m that loads a single element and broadcasts
+// it to n elements.
+func (m Mem) Broadcast(n uint8) Mem {
+	m.Type = MemTypeBroadcast
+	m.Bcst = n
+	return m
+}
+
 // Sized returns a copy of m with a specific size.
 func (m Mem) Sized(size Size) Mem {
 	m.Size = size
@@ -74,6 +107,27 @@ func (m Mem) Sized(size Size) Mem {
 
 func (m Mem) Kind() Kind { return KindMem }
 
+// VSIB reports whether m is a vector of addresses, indexed by a vector
+// register as used by gather and scatter instructions.
+func (m Mem) VSIB() bool {
+	return m.Index != 0 && m.Index.Type() == RegTypeVector
+}
+
+// Base16 returns the base and index of a 16-bit address, where the base is
+// bx or bp and the index is si or di. Either may be zero, and the registers
+// may be given in either order.
+func (m Mem) Base16() (base, index Reg) {
+	for _, r := range [2]Reg{m.Base, m.Index} {
+		switch r {
+		case BX, BP:
+			base = r
+		case SI, DI:
+			index = r
+		}
+	}
+	return
+}
+
 func (m Mem) Matches(p Param) bool {
 	if p.Kind() != KindMem {
 		return false
@@ -81,11 +135,28 @@ func (m Mem) Matches(p Param) bool {
 	mp := MemParam(p)
 
 	// TODO verify all the memory fields
-	if mp.Type() == MemTypeOffset && (m.Segment == 0 || m.Segment.Type() != RegTypeSegment) {
+	if (mp.Type() == MemTypeOffset) != (m.Type == MemTypeOffset) {
 		return false
 	}
 
 	s, ms := mp.Size(), m.Size
+	switch mp.Type() {
+	case MemTypeVector32, MemTypeVector64:
+		// A VSIB operand has a vector index of the width of the form, and
+		// any size given is that of an element.
+		e := mp.ElemSize()
+		return m.VSIB() && m.Type != MemTypeBroadcast &&
+			m.Index.Size() == mp.TargetSize() &&
+			(ms == Size0 || e == Size0 || ms == e)
+	}
+	if m.VSIB() {
+		return false
+	}
+	if m.Type == MemTypeBroadcast {
+		e := mp.ElemSize()
+		return mp.Type() == MemTypeBroadcast && (ms == Size0 || ms == e) &&
+			e.Bits()*int(m.Bcst) == s.Bits()
+	}
 	if ms == Size0 {
 		return true
 	}
@@ -96,16 +167,41 @@ func (m Mem) Matches(p Param) bool {
 }
 
 func (m Mem) Validate() error {
-	if m.Base.Validate() != nil {
-		return ErrMemBase
+	if m.Type == MemTypeOffset {
+		if m.Base != 0 || m.Index != 0 || m.Disp != 0 {
+			return ErrOffsetAddress
+		}
+		return nil
 	}
 
-	bs, is := m.Base.Size(), m.Index.Size()
-	if bs != Size64 && bs != Size32 {
-		return fmt.Errorf("invalid %d-bit base register", bs.Bits())
+	// Without a base, the address size is that of the index, or 64 bits
+	// for an absolute address.
+	as, is := Size(Size64), m.Index.Size()
+	if m.Base != 0 {
+		if m.Base.Validate() != nil {
+			return ErrMemBase
+		}
+		as = m.Base.Size()
+	} else if m.Index != 0 && !m.VSIB() {
+		as = is
+	}
+	if as == Size16 {
+		return m.validate16()
 	}
-	if is != Size0 && is != bs {
-		return fmt.Errorf("base register is %d-bit, but index is %d-bit", bs.Bits(), is.Bits())
+	if m.Base != 0 && as != Size64 && as != Size32 {
+		return fmt.Errorf("invalid %d-bit base register", as.Bits())
+	}
+	switch {
+	case m.VSIB():
+		if is < Size128 {
+			return ErrUnsupportedIndex
+		}
+	case m.Index != 0 && m.Index.Type() != RegTypeGeneral:
+		return ErrUnsupportedIndex
+	case is != Size0 && is != as:
+		return fmt.Errorf("base register is %d-bit, but index is %d-bit", as.Bits(), is.Bits())
+	case as != Size64 && as != Size32:
+		return fmt.Errorf("invalid %d-bit index register", as.Bits())
 	}
 
 	if m.Index == 0 {
@@ -116,16 +212,47 @@ func (m Mem) Validate() error {
 		if m.Scale < Size8 || Size64 < m.Scale {
 			return ErrInvalidScale
 		}
-		if m.Scale == Size8 && (m.Index.ID()&mIDMask) == mIDMask {
+		if !m.VSIB() && m.Scale == Size8 && (m.Index.ID()&mIDMask) == mIDMask {
 			return ErrUnsupportedIndex
 		}
 	}
 
+	if m.Type == MemTypeBroadcast {
+		switch m.Bcst {
+		case 2, 4, 8, 16:
+		default:
+			return ErrInvalidBroadcast
+		}
+	}
+
+	return nil
+}
+
+// validate16 checks a 16-bit address, which is one of bx or bp, si or di,
+// or one of each, without scaling.
+func (m Mem) validate16() error {
+	base, index := m.Base16()
+	switch {
+	case m.Base != 0 && m.Index != 0 && (base == 0 || index == 0):
+		return ErrUnsupportedIndex
+	case m.Base != 0 && m.Base != base && m.Base != index:
+		return ErrMemBase
+	case m.Index != 0 && m.Index != base && m.Index != index:
+		return ErrUnsupportedIndex
+	case m.Index != 0 && m.Scale > Size8:
+		return ErrInvalidScale
+	case m.Index == 0 && m.Scale != Size0:
+		return ErrNoIndexScale
+	case m.Disp < math.MinInt16 || math.MaxUint16 < m.Disp:
+		return fmt.Errorf("displacement %d exceeds 16 bits", m.Disp)
+	case m.Type == MemTypeBroadcast || m.VSIB():
+		return ErrUnsupportedIndex
+	}
 	return nil
 }
 
 func (m Mem) String() string {
-	n, parts := 0, [11]string{}
+	n, parts := 0, [14]string{}
 
 	if m.Size > Size0 {
 		parts[n] = memNames[m.Size]
@@ -133,23 +260,47 @@ func (m Mem) String() string {
 		n += 2
 	}
 
+	if m.Segment > 0 {
+		parts[n] = m.Segment.String()
+		parts[n+1] = ":"
+		n += 2
+	}
+
 	parts[n] = "["
 	n += 1
 
-	parts[n] = m.Base.String()
-	n += 1
+	if m.Base == 0 && m.Index == 0 {
+		// An absolute address is sign-extended to 64 bits.
+		addr := m.Addr
+		if m.Type != MemTypeOffset {
+			addr = uint64(int64(m.Disp))
+		}
+		parts[n] = "0x" + strconv.FormatUint(addr, 16)
+		n += 1
+	}
+
+	if m.Base > 0 {
+		parts[n] = m.Base.String()
+		n += 1
+	}
 
 	if m.Index > 0 {
-		parts[n] = " + "
+		if m.Base > 0 {
+			parts[n] = " + "
+		}
 		parts[n+1] = m.Index.String()
-		if m.Scale > 1 {
+		// Without a base, an unscaled index would read back as the base.
+		if scale := m.Scale; scale > Size8 || m.Base == 0 {
+			if scale == Size0 {
+				scale = Size8
+			}
 			parts[n+2] = "*"
-			parts[n+3] = m.Scale.ByteString()
+			parts[n+3] = scale.ByteString()
 		}
 		n += 4
 	}
 
-	if m.Disp != 0 {
+	if m.Disp != 0 && (m.Base > 0 || m.Index > 0) {
 		var d uint64
 		if m.Disp > 0 {
 			parts[n] = " + "
@@ -165,6 +316,11 @@ func (m Mem) String() string {
 	parts[n] = "]"
 	n += 1
 
+	if m.Type == MemTypeBroadcast {
+		parts[n] = "{1to" + strconv.Itoa(int(m.Bcst)) + "}"
+		n += 1
+	}
+
 	return strings.Join(parts[:n], "")
 }
 
@@ -1,6 +1,9 @@
 package operand
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type (
 	Misc      uint16
@@ -12,10 +15,63 @@ const (
 	ER
 )
 
+func (m Misc) Kind() Kind      { return KindMisc }
+func (m Misc) Validate() error { return nil }
+
 func (m Misc) Matches(p Param) bool {
 	return p.Kind() == KindMisc && MiscParam(p) == m
 }
 
 func (m Misc) String() string {
+	switch m {
+	case SAE:
+		return "{sae}"
+	case ER:
+		return "{er}"
+	}
 	return fmt.Sprintf("operand.Misc(%d)", m)
 }
+
+// Round is an embedded rounding mode, which is given in place of the {er}
+// operand and also suppresses all exceptions. The values are those of the
+// EVEX.L'L bits.
+type Round uint8
+
+const (
+	RoundNearest Round = iota
+	RoundDown
+	RoundUp
+	RoundZero
+)
+
+var roundNames = [...]string{"rn-sae", "rd-sae", "ru-sae", "rz-sae"}
+
+// RoundOf returns the rounding mode with the given name, such as "rn-sae".
+func RoundOf(name string) (Round, bool) {
+	for i, n := range roundNames {
+		if strings.EqualFold(name, n) {
+			return Round(i), true
+		}
+	}
+	return 0, false
+}
+
+func (r Round) Kind() Kind { return KindMisc }
+
+func (r Round) Validate() error {
+	if int(r) >= len(roundNames) {
+		return fmt.Errorf("invalid rounding mode %d", r)
+	}
+	return nil
+}
+
+func (r Round) Matches(p Param) bool {
+	return p.Kind() == KindMisc && MiscParam(p) == ER
+}
+
+func (r Round) String() string {
+	if int(r) < len(roundNames) {
+		return "{" + roundNames[r] + "}"
+	}
+	return fmt.Sprintf("operand.Round(%d)", r)
+}
@@ -70,6 +70,10 @@ func (p Param) MergeMasked() bool  { return (p & pMergeMasked) == pMergeMasked }
 func (p Param) ExtendedSize() Size { return Size((p >> pExtSizeShift) & sizeMask) }
 func (p Param) ImmConst() bool     { return (p & (pConst | kindMask)) == (pConst | KindImm) }
 
+// Key returns p without the flags that describe how an operand is used
+// (implicit, input, output and extended size), leaving only what it accepts.
+func (p Param) Key() Param { return p & pKeyMask }
+
 func (p Param) String() string {
 	paramNamesOnce.Do(paramNamesInit)
 	m := p & pKeyMask
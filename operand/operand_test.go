@@ -27,3 +27,43 @@ func TestParamValues(t *testing.T) {
 	}{}
 }
 */
+
+func TestDecorations(t *testing.T) {
+	tests := []struct {
+		Arg    Arg
+		String string
+		Param  string
+		Match  bool
+	}{
+		{ZMM1.MergeMask(K1), "zmm1 {k1}", "zmm{k}", true},
+		{ZMM1.MergeMask(K1), "zmm1 {k1}", "zmm{k}{z}", true},
+		{ZMM1.MergeMask(K1), "zmm1 {k1}", "zmm", false},
+		{ZMM1.Mask(K1), "zmm1 {k1}{z}", "zmm{k}{z}", true},
+		{ZMM1.Mask(K1), "zmm1 {k1}{z}", "zmm{k}", false},
+		{K1.MergeMask(K2), "k1 {k2}", "k{k}", true},
+		{Ptr(RAX).Broadcast(16), "[rax]{1to16}", "m512/m32bcst", true},
+		{Ptr(RAX).Broadcast(16), "[rax]{1to16}", "m512/m64bcst", false},
+		{Ptr(RAX).Broadcast(16), "[rax]{1to16}", "m512", false},
+		{SizedPtr(RAX, Size64).Broadcast(8), "QWORD PTR [rax]{1to8}", "m512/m64bcst", true},
+		{SizedPtr(RAX, Size32).Broadcast(8), "DWORD PTR [rax]{1to8}", "m512/m64bcst", false},
+		{Ptr(RAX), "[rax]", "m512/m64bcst", true},
+		{RoundNearest, "{rn-sae}", "{er}", true},
+		{RoundZero, "{rz-sae}", "{er}", true},
+		{RoundZero, "{rz-sae}", "{sae}", false},
+		{Misc(SAE), "{sae}", "{sae}", true},
+		{Misc(SAE), "{sae}", "{er}", false},
+	}
+
+	for _, test := range tests {
+		if s := test.Arg.String(); s != test.String {
+			t.Errorf("incorrect string: expect=%q, actual=%q", test.String, s)
+		}
+		p, ok := ParamOf(test.Param)
+		if !ok {
+			t.Fatalf("unknown param %q", test.Param)
+		}
+		if m := test.Arg.Matches(p); m != test.Match {
+			t.Errorf("incorrect match of %q for %q: expect=%v, actual=%v", test.String, test.Param, test.Match, m)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package operand
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrOperandEmpty      = errors.New("operand expected")
+	ErrOperandUnexpected = errors.New("unexpected input in operand")
+	ErrIntegerInvalid    = errors.New("invalid integer")
+	ErrDispInvalid       = errors.New("displacement out of range")
+	ErrAddressInvalid    = errors.New("invalid base/index expression")
+	ErrLabelInvalid      = errors.New("invalid label")
+	ErrRegisterUnknown   = errors.New("unknown register")
+)
+
+// Parse parses an operand in Intel syntax. The result is a Reg, an Int or
+// Uint immediate, a Mem or a Label, and formats back to the same text with
+// String, other than spacing and case. Registers and memory operands may be
+// followed by AVX-512 decorations:
+//
+//	rax
+//	-16
+//	0x10
+//	QWORD PTR fs:[rax + rbx*8 - 16]
+//	loop
+//	1f
+//	zmm1 {k1}{z}
+//	DWORD PTR [rax]{1to16}
+func Parse(s string) (Arg, error) {
+	l := lexer{s: s}
+	l.skip()
+	if l.done() {
+		return nil, ErrOperandEmpty
+	}
+	if name := l.local(); name != "" {
+		return Label(name), nil
+	}
+
+	var (
+		arg Arg
+		err error
+	)
+	switch c := l.peek(); {
+	case c == '[':
+		arg, err = l.mem()
+	case c == '-' || c == '+' || isDigit(c):
+		arg, err = l.imm()
+	default:
+		save := l.pos
+		name := l.ident()
+		if _, ok := MemSizeOf(name); ok || l.accept(':') {
+			l.pos = save
+			arg, err = l.mem()
+		} else if r, ok := RegOf(name); ok {
+			arg = r
+		} else if name != "" {
+			arg = Label(name)
+		} else {
+			err = ErrOperandUnexpected
+		}
+	}
+	if err == nil {
+		arg, err = l.decorations(arg)
+	}
+	return l.finish(arg, err)
+}
+
+// ParseReg parses a register name.
+func ParseReg(s string) (Reg, error) {
+	l := lexer{s: s}
+	name := l.ident()
+	if name == "" {
+		return 0, ErrOperandEmpty
+	}
+	r, ok := RegOf(name)
+	if !ok {
+		return 0, ErrRegisterUnknown
+	}
+	_, err := l.finish(r, nil)
+	return r, err
+}
+
+// ParseImm parses an integer. Negative values are returned as an Int and
+// all others as a Uint.
+func ParseImm(s string) (Arg, error) {
+	l := lexer{s: s}
+	return l.finish(l.imm())
+}
+
+// ParseMem parses a memory reference, with an optional size and segment.
+func ParseMem(s string) (Mem, error) {
+	l := lexer{s: s}
+	m, err := l.mem()
+	_, err = l.finish(m, err)
+	return m, err
+}
+
+// ParseLabel parses a label name, or a reference to a numeric local label
+// such as "1f" or "1b". Names of registers are not labels.
+func ParseLabel(s string) (Label, error) {
+	l := lexer{s: s}
+	l.skip()
+	if name := l.local(); name != "" {
+		return Label(name), nil
+	}
+	name := l.ident()
+	if name == "" {
+		return "", ErrLabelInvalid
+	}
+	if _, ok := RegOf(name); ok {
+		return "", ErrLabelInvalid
+	}
+	_, err := l.finish(Label(name), nil)
+	return Label(name), err
+}
+
+// MemSizeOf returns the size of a memory size keyword such as "QWORD".
+func MemSizeOf(name string) (Size, bool) {
+	for i, n := range memNames {
+		if i > 0 && strings.EqualFold(name, strings.TrimSuffix(n, " PTR")) {
+			return Size(i), true
+		}
+	}
+	return Size0, false
+}
+
+type lexer struct {
+	s   string
+	pos int
+}
+
+func (l *lexer) skip() {
+	for l.pos < len(l.s) && (l.s[l.pos] == ' ' || l.s[l.pos] == '\t') {
+		l.pos++
+	}
+}
+
+func (l *lexer) done() bool {
+	return l.pos >= len(l.s)
+}
+
+func (l *lexer) peek() byte {
+	if l.done() {
+		return 0
+	}
+	return l.s[l.pos]
+}
+
+func (l *lexer) accept(c byte) bool {
+	l.skip()
+	if l.peek() != c {
+		return false
+	}
+	l.pos++
+	l.skip()
+	return true
+}
+
+func (l *lexer) finish(arg Arg, err error) (Arg, error) {
+	if err != nil {
+		return nil, err
+	}
+	if l.skip(); !l.done() {
+		return nil, ErrOperandUnexpected
+	}
+	return arg, nil
+}
+
+func (l *lexer) ident() string {
+	l.skip()
+	start := l.pos
+	for !l.done() {
+		c := l.s[l.pos]
+		if !isIdent(c) && !(l.pos > start && isDigit(c)) {
+			break
+		}
+		l.pos++
+	}
+	name := l.s[start:l.pos]
+	l.skip()
+	return name
+}
+
+// local returns the rest of the input if it is a reference to a numeric local
+// label, which is a number followed by "f" or "b".
+func (l *lexer) local() string {
+	s := strings.TrimRight(l.s[l.pos:], " \t")
+	n := len(s) - 1
+	if n < 1 || (s[n] != 'f' && s[n] != 'b') {
+		return ""
+	}
+	for i := 0; i < n; i++ {
+		if !isDigit(s[i]) {
+			return ""
+		}
+	}
+	return s
+}
+
+func (l *lexer) number() (uint64, bool, error) {
+	l.skip()
+	if !isDigit(l.peek()) {
+		return 0, false, nil
+	}
+	start := l.pos
+	for !l.done() && (isIdent(l.s[l.pos]) || isDigit(l.s[l.pos])) {
+		l.pos++
+	}
+	n, err := strconv.ParseUint(l.s[start:l.pos], 0, 64)
+	if err != nil {
+		return 0, false, ErrIntegerInvalid
+	}
+	l.skip()
+	return n, true, nil
+}
+
+func (l *lexer) imm() (Arg, error) {
+	neg := l.accept('-')
+	if !neg {
+		l.accept('+')
+	}
+	n, ok, err := l.number()
+	switch {
+	case err != nil:
+		return nil, err
+	case !ok:
+		return nil, ErrIntegerInvalid
+	case !neg:
+		return Uint(n), nil
+	case n > math.MaxInt64+1:
+		return nil, ErrIntegerInvalid
+	}
+	return Int(-int64(n)), nil
+}
+
+// segment parses an optional segment override such as "fs:".
+func (l *lexer) segment(a *Address) error {
+	save := l.pos
+	if r, ok := RegOf(l.ident()); ok && r.Type() == RegTypeSegment && l.accept(':') {
+		return a.Segment(r)
+	}
+	l.pos = save
+	return nil
+}
+
+// decorations parses the decorations that follow arg and applies them.
+func (l *lexer) decorations(arg Arg) (Arg, error) {
+	var d Decorations
+	for l.accept('{') {
+		end := strings.IndexByte(l.s[l.pos:], '}')
+		if end < 0 {
+			return nil, ErrOperandUnexpected
+		}
+		if err := d.Add(strings.TrimSpace(l.s[l.pos : l.pos+end])); err != nil {
+			return nil, err
+		}
+		l.pos += end + 1
+	}
+	return d.Apply(arg)
+}
+
+func (l *lexer) mem() (Mem, error) {
+	var (
+		a  Address
+		sz Size
+	)
+	save := l.pos
+	if s, ok := MemSizeOf(l.ident()); ok {
+		sz = s
+		save = l.pos
+		if !strings.EqualFold(l.ident(), "PTR") {
+			l.pos = save
+		}
+	} else {
+		l.pos = save
+	}
+
+	if err := l.segment(&a); err != nil {
+		return Mem{}, err
+	}
+	if !l.accept('[') {
+		return Mem{}, ErrOperandUnexpected
+	}
+	if err := l.segment(&a); err != nil {
+		return Mem{}, err
+	}
+
+	start := l.pos
+	if n, ok, _ := l.number(); ok && l.accept(']') {
+		a.Abs(n)
+	} else {
+		l.pos = start
+		for first := true; !l.accept(']'); first = false {
+			neg := false
+			switch {
+			case l.accept('-'):
+				neg = true
+			case l.accept('+'):
+			case !first:
+				return Mem{}, ErrOperandUnexpected
+			}
+			if err := l.term(&a, neg); err != nil {
+				return Mem{}, err
+			}
+		}
+	}
+
+	m, err := a.Mem()
+	m.Size = sz
+	return m, err
+}
+
+// term parses one register, scaled index or displacement of an address.
+func (l *lexer) term(a *Address, neg bool) error {
+	n, ok, err := l.number()
+	if err != nil {
+		return err
+	}
+	if ok && !l.accept('*') {
+		if n > math.MaxUint32 {
+			return ErrDispInvalid
+		}
+		if neg {
+			return a.Disp(-int64(n))
+		}
+		return a.Disp(int64(n))
+	}
+	if neg {
+		return ErrAddressInvalid
+	}
+
+	r, isReg := RegOf(l.ident())
+	if !isReg {
+		return ErrAddressInvalid
+	}
+	if !ok && l.accept('*') {
+		if n, ok, err = l.number(); err != nil || !ok {
+			return ErrInvalidScale
+		}
+	}
+	if ok && n == 0 {
+		return ErrInvalidScale
+	}
+	return a.Reg(r, n)
+}
+
+// Address builds a Mem from the terms of an Intel syntax address, such as
+// the base, scaled index and displacement of "[rax + rbx*8 - 16]". Parse uses
+// it for its own input, and other parsers can give it the terms they scan.
+type Address struct {
+	m    Mem
+	disp int64
+}
+
+// Segment sets the segment override, as in "fs:[rax]" or "[fs:rax]".
+func (a *Address) Segment(r Reg) error {
+	if r.Type() != RegTypeSegment || a.m.Segment != 0 {
+		return ErrAddressInvalid
+	}
+	a.m.Segment = r
+	return nil
+}
+
+// Abs sets an address that is only the number n. It is an absolute address,
+// or a moffs if it does not fit in a sign-extended disp32.
+func (a *Address) Abs(n uint64) {
+	seg := a.m.Segment
+	a.m = AbsAddr(n)
+	a.m.Segment = seg
+	a.disp = int64(a.m.Disp)
+}
+
+// Reg adds a register term multiplied by scale, or zero if no scale was
+// given. An unscaled register is the base unless a base was already given.
+// A vector register can only be a VSIB index.
+func (a *Address) Reg(r Reg, scale uint64) error {
+	vector := r.Type() == RegTypeVector && !r.MMX()
+	if r.Type() != RegTypeGeneral && r.Type() != RegTypeIP && !vector {
+		return ErrAddressInvalid
+	}
+	if scale == 0 {
+		if a.m.Base == 0 && !vector {
+			a.m.Base = r
+			return nil
+		}
+		scale = 1
+	}
+
+	if a.m.Index != 0 {
+		return ErrAddressInvalid
+	}
+	a.m.Index = r
+	switch scale {
+	case 1:
+		a.m.Scale = Size8
+	case 2:
+		a.m.Scale = Size16
+	case 4:
+		a.m.Scale = Size32
+	case 8:
+		a.m.Scale = Size64
+	default:
+		return ErrInvalidScale
+	}
+	return nil
+}
+
+// Disp adds n to the displacement.
+func (a *Address) Disp(n int64) error {
+	if n < -math.MaxUint32 || n > math.MaxUint32 {
+		return ErrDispInvalid
+	}
+	a.disp += n
+	return nil
+}
+
+// Mem returns the address. The displacement must fit in 32 bits.
+func (a *Address) Mem() (Mem, error) {
+	if a.disp < math.MinInt32 || a.disp > math.MaxInt32 {
+		return Mem{}, ErrDispInvalid
+	}
+	m := a.m
+	m.Disp = int32(a.disp)
+	return m, nil
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isIdent(c byte) bool {
+	return c == '_' || c == '.' || c == '$' || c == '@' ||
+		('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
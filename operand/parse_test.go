@@ -0,0 +1,126 @@
+package operand
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		Input  string
+		Expect Arg
+		String string
+		Err    error
+	}{
+		{"rax", RAX, "rax", nil},
+		{" XMM12 ", XMM12, "xmm12", nil},
+		{"16", Uint(16), "16", nil},
+		{"0x10", Uint(16), "16", nil},
+		{"-16", Int(-16), "-16", nil},
+		{"-9223372036854775808", Int(-9223372036854775808), "-9223372036854775808", nil},
+		{"loop", Label("loop"), "loop", nil},
+		{".L1", Label(".L1"), ".L1", nil},
+		{"1f", Label("1f"), "1f", nil},
+		{" 12b ", Label("12b"), "12b", nil},
+		{"[rdi]", Ptr(RDI), "[rdi]", nil},
+		{"[rdi+8]", Ptr(RDI).Offset(8), "[rdi + 8]", nil},
+		{"[rdi - 8 + 4]", Ptr(RDI).Offset(-4), "[rdi - 4]", nil},
+		{"[rax + rbx]", Ptr(RAX).Idx(RBX, Size8), "[rax + rbx]", nil},
+		{"[rax + 4*rbx]", Ptr(RAX).Idx(RBX, Size32), "[rax + rbx*4]", nil},
+		{"[rbx*2 + rax]", Ptr(RAX).Idx(RBX, Size16), "[rax + rbx*2]", nil},
+		{"[rip + 0x20]", Ptr(RIP).Offset(32), "[rip + 32]", nil},
+		{"dword ptr [ecx]", SizedPtr(ECX, Size32), "DWORD PTR [ecx]", nil},
+		{"ymmword [rsi]", SizedPtr(RSI, Size256), "YMMWORD PTR [rsi]", nil},
+		{
+			"qword ptr fs:[rax + rbx*8 - 16]",
+			Mem{Base: RAX, Index: RBX, Scale: Size64, Disp: -16, Size: Size64, Segment: FS},
+			"QWORD PTR fs:[rax + rbx*8 - 16]",
+			nil,
+		},
+		{"[gs:rax]", Mem{Base: RAX, Segment: GS}, "gs:[rax]", nil},
+		{"[rbx*4]", Mem{}.Idx(RBX, Size32), "[rbx*4]", nil},
+		{"[rbx*1]", Mem{}.Idx(RBX, Size8), "[rbx*1]", nil},
+		{"[rbx*8 + 0x1000]", Mem{}.Idx(RBX, Size64).Offset(0x1000), "[rbx*8 + 4096]", nil},
+		{"dword ptr [0x7fff0000]", Abs(0x7fff0000).Sized(Size32), "DWORD PTR [0x7fff0000]", nil},
+		{"[0xffffffff80000000]", Abs(-0x80000000), "[0xffffffff80000000]", nil},
+		{"[0x80000000]", Moffs(0x80000000), "[0x80000000]", nil},
+		{"[0x1122334455667788]", Moffs(0x1122334455667788), "[0x1122334455667788]", nil},
+		{"word ptr [bx + si + 2]", Ptr(BX).Idx(SI, Size8).Offset(2).Sized(Size16), "WORD PTR [bx + si + 2]", nil},
+		{"[bp]", Ptr(BP), "[bp]", nil},
+		{"[rax + xmm1*4]", Ptr(RAX).Idx(XMM1, Size32), "[rax + xmm1*4]", nil},
+		{"[ymm2 + rdi + 8]", Ptr(RDI).Idx(YMM2, Size8).Offset(8), "[rdi + ymm2 + 8]", nil},
+		{"dword ptr [zmm31*8]", Mem{Size: Size32}.Idx(ZMM31, Size64), "DWORD PTR [zmm31*8]", nil},
+		{"zmm1 {k1}", ZMM1.MergeMask(K1), "zmm1 {k1}", nil},
+		{"zmm1{k1}{z}", ZMM1.Mask(K1), "zmm1 {k1}{z}", nil},
+		{"k2 {k3}", K2.MergeMask(K3), "k2 {k3}", nil},
+		{"[rax]{1to16}", Ptr(RAX).Broadcast(16), "[rax]{1to16}", nil},
+		{"dword ptr [rax + 8] { 1to8 }", SizedPtr(RAX, Size32).Offset(8).Broadcast(8), "DWORD PTR [rax + 8]{1to8}", nil},
+		{"zmm1 {z}", nil, "", ErrMaskExpected},
+		{"zmm1 {k0}", nil, "", ErrMaskExpected},
+		{"rax {k1}", nil, "", ErrDecoratorInvalid},
+		{"zmm1 {1to16}", nil, "", ErrDecoratorInvalid},
+		{"[rax]{1to3}", nil, "", ErrDecoratorInvalid},
+		{"[rax]{1to16", nil, "", ErrOperandUnexpected},
+		{"", nil, "", ErrOperandEmpty},
+		{"rax rbx", nil, "", ErrOperandUnexpected},
+		{"0xzz", nil, "", ErrIntegerInvalid},
+		{"[rax + rbx + rcx]", nil, "", ErrAddressInvalid},
+		{"[rax + rbx*3]", nil, "", ErrInvalidScale},
+		{"[rax + rbx*0]", nil, "", ErrInvalidScale},
+		{"[rax + 0x80000000 - 1]", Ptr(RAX).Offset(0x7fffffff), "[rax + 2147483647]", nil},
+		{"[rax - rbx]", nil, "", ErrAddressInvalid},
+		{"[rax + 0x100000000]", nil, "", ErrDispInvalid},
+		{"[rax", nil, "", ErrOperandUnexpected},
+		{"fs:[rax] + 1", nil, "", ErrOperandUnexpected},
+		{"fs:[es:rax]", nil, "", ErrAddressInvalid},
+		{"[xmm1 + xmm2]", nil, "", ErrAddressInvalid},
+		{"[mm1]", nil, "", ErrAddressInvalid},
+	}
+
+	for _, test := range tests {
+		arg, err := Parse(test.Input)
+		if err != test.Err {
+			t.Errorf("unexpected error for %q: expect = %v, actual = %v", test.Input, test.Err, err)
+			continue
+		}
+		if arg != test.Expect {
+			t.Errorf("failed to parse %q: expect = %#v, actual = %#v", test.Input, test.Expect, arg)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if s := arg.String(); s != test.String {
+			t.Errorf("failed to format %q: expect = %q, actual = %q", test.Input, test.String, s)
+		}
+		if again, err := Parse(arg.String()); err != nil || again != arg {
+			t.Errorf("failed to round trip %q: %#v, %v", test.Input, again, err)
+		}
+	}
+}
+
+func TestParseKinds(t *testing.T) {
+	if r, err := ParseReg("eax"); err != nil || r != EAX {
+		t.Errorf("ParseReg: %v, %v", r, err)
+	}
+	if _, err := ParseReg("foo"); err != ErrRegisterUnknown {
+		t.Errorf("ParseReg: unexpected error %v", err)
+	}
+	if i, err := ParseImm("-1"); err != nil || i != Int(-1) {
+		t.Errorf("ParseImm: %v, %v", i, err)
+	}
+	if _, err := ParseImm("rax"); err != ErrIntegerInvalid {
+		t.Errorf("ParseImm: unexpected error %v", err)
+	}
+	if m, err := ParseMem("[rsp + 8]"); err != nil || m != Ptr(RSP).Offset(8) {
+		t.Errorf("ParseMem: %v, %v", m, err)
+	}
+	if l, err := ParseLabel("done"); err != nil || l != "done" {
+		t.Errorf("ParseLabel: %v, %v", l, err)
+	}
+	if l, err := ParseLabel("1b"); err != nil || l != "1b" {
+		t.Errorf("ParseLabel: %v, %v", l, err)
+	}
+	if _, err := ParseLabel("rcx"); err != ErrLabelInvalid {
+		t.Errorf("ParseLabel: unexpected error %v", err)
+	}
+}
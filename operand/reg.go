@@ -274,8 +274,8 @@ func (r Reg) Mask(z Reg) Reg {
 
 func (r Reg) MergeMask(k Reg) Reg {
 	switch {
-	case r.Type() != RegTypeVector:
-		panic("vector register required")
+	case r.Type() != RegTypeVector && r.Type() != RegTypeMask:
+		panic("vector or mask register required")
 	case k.Type() != RegTypeMask:
 		panic("mask register required")
 	}
@@ -314,7 +314,19 @@ func (r Reg) Validate() error {
 	return nil
 }
 
+// String returns the name of r, followed by its mask as in "zmm1 {k1}{z}".
 func (r Reg) String() string {
+	name := r.name()
+	if k := r.MaskReg(); k != 0 {
+		name += " {" + k.name() + "}"
+		if !r.MergeMasked() {
+			name += "{z}"
+		}
+	}
+	return name
+}
+
+func (r Reg) name() string {
 	switch r.Type() {
 	case RegTypeGeneral:
 		return genNames[r.Size()-1][r.ID()]
@@ -340,6 +352,10 @@ func (r Reg) Matches(p Param) bool {
 	if p.Kind() != KindReg {
 		return false
 	}
+	// A mask requires a maskable param, and zeroing one that allows it.
+	if r.Masked() && (!p.Masked() || (!r.MergeMasked() && p.MergeMasked())) {
+		return false
+	}
 	if p.Const() {
 		return RegParam(r) == RegParam(p)
 	}
@@ -9,7 +9,13 @@ func (r RelParam) Size() Size {
 	return Size(r & sizeMask)
 }
 
-func (_ Label) Kind() Kind           { return KindMem }
-func (_ Label) Validate() error      { return nil }
-func (l Label) String() string       { return string(l) }
-func (_ Label) Matches(p Param) bool { return false }
+func (_ Label) Kind() Kind      { return KindMem }
+func (_ Label) Validate() error { return nil }
+func (l Label) String() string  { return string(l) }
+
+// Matches reports whether p is a relative offset, of any size, as a label
+// stands for the offset to its definition. This lets the analyses of a
+// recorded program select the form of a jump before it is encoded. The
+// encoder itself replaces each label with its offset before selecting, so
+// the size of the offset still decides between rel8 and rel32 there.
+func (_ Label) Matches(p Param) bool { return p.Kind() == KindRel }
@@ -0,0 +1,69 @@
+package operand
+
+import "fmt"
+
+// VReg is a virtual register. It stands in for a general-purpose or vector
+// register until a register allocator assigns it a physical one.
+//
+//                    3               2               1               0
+//      7             0               0               0 7 6 5 4 3 2 1 0
+//     ╭───────────────────────────────────────────────┬───────────────╮
+//     │                      ID                       │ ╎ ╎TYPE ╎SIZE │
+//     ╰───────────────────────────────────────────────┴───────────────╯
+//
+// The same ID may be used at different sizes, such as a 64-bit register that
+// is later read as 32-bit. All sizes of an ID refer to the same register.
+type VReg uint32
+
+const vIDShift = 8
+
+// MakeVReg creates a virtual register.
+func MakeVReg(id uint32, typ RegType, size Size) VReg {
+	return (VReg(id) << vIDShift) | VReg(typ&rTypeMask) | VReg(size&sizeMask)
+}
+
+func (v VReg) Kind() Kind     { return KindReg }
+func (v VReg) Size() Size     { return Size(v & sizeMask) }
+func (v VReg) Type() RegType  { return RegType(v & rTypeMask) }
+func (v VReg) ID() uint32     { return uint32(v >> vIDShift) }
+func (v VReg) As(s Size) VReg { return MakeVReg(v.ID(), v.Type(), s) }
+
+// Reg returns the physical register with id, using the type and size of v.
+func (v VReg) Reg(id uint8) Reg {
+	return MakeReg(id, v.Type(), v.Size())
+}
+
+func (v VReg) Validate() error {
+	s := v.Size()
+	switch v.Type() {
+	case RegTypeGeneral:
+		if Size8 <= s && s <= Size64 {
+			return nil
+		}
+	case RegTypeVector:
+		if Size128 <= s && s <= Size512 {
+			return nil
+		}
+	}
+	return ErrRegSizeInvalid
+}
+
+func (v VReg) String() string {
+	switch v.Type() {
+	case RegTypeGeneral:
+		return fmt.Sprintf("v%d:r%d", v.ID(), v.Size().Bits())
+	case RegTypeVector:
+		return fmt.Sprintf("v%d:%s", v.ID(), vecNames[v.Size()-4][0][:3])
+	}
+	return regInv
+}
+
+// Matches reports whether a physical register of the same type and size
+// would match p. This includes fixed register params, such as the count of a
+// shift in cl, which leaves the allocator to place v in that register.
+func (v VReg) Matches(p Param) bool {
+	if p.Kind() != KindReg {
+		return false
+	}
+	return ((RegParam(v) ^ RegParam(p)) & rMatchMask) == 0
+}
@@ -3,10 +3,14 @@ package x64
 import (
 	"bytes"
 	"fmt"
+	"strings"
+
+	"github.com/kalamay/x86/operand"
 )
 
 type Assembly struct {
-	buf bytes.Buffer
+	buf     bytes.Buffer
+	defined map[string]bool
 }
 
 func NewAssembly() *Assembly {
@@ -14,6 +18,9 @@ func NewAssembly() *Assembly {
 }
 
 func (a *Assembly) Open() {
+	for k := range a.defined {
+		delete(a.defined, k)
+	}
 }
 
 func (a *Assembly) Emit(e *Emit, call *EmitCall) {
@@ -24,14 +31,36 @@ func (a *Assembly) Emit(e *Emit, call *EmitCall) {
 			a.buf.WriteByte(',')
 		}
 		a.buf.WriteByte(' ')
-		a.buf.WriteString(op.String())
+		if l, ok := op.(operand.Label); ok {
+			a.buf.WriteString(a.reference(string(l)))
+		} else {
+			a.buf.WriteString(op.String())
+		}
 	}
 	a.buf.WriteByte('\n')
 	e.Write(a.buf.Bytes())
 }
 
 func (a *Assembly) Label(e *Emit, label *EmitLabel) {
-	fmt.Fprintf(e, "%s:\n", label.Name())
+	name := label.Name()
+	if i := strings.IndexByte(name, '#'); i > 0 && isNumericLabel(name[:i]) {
+		if a.defined == nil {
+			a.defined = map[string]bool{}
+		}
+		a.defined[name] = true
+		name = name[:i]
+	}
+	fmt.Fprintf(e, "%s:\n", name)
+}
+
+// reference returns the name of a label as written in the source. A numeric
+// label recorded by a Program under its unique name is written as "1b" once
+// it is defined and "1f" before.
+func (a *Assembly) reference(name string) string {
+	if a.defined[name] {
+		return name[:strings.IndexByte(name, '#')] + "b"
+	}
+	return referenceName(name)
 }
 
 func (a *Assembly) Close(e *Emit) {
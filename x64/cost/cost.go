@@ -0,0 +1,381 @@
+// Package cost estimates the steady-state throughput of a loop body from a
+// per-microarchitecture timing table.
+//
+// A Model is loaded from an XML file that lists the latency, reciprocal
+// throughput and execution ports of each instruction form:
+//
+//	<Model name="skylake" issue-width="4">
+//	  <Timing instruction="ADD" operands="r64, r64" latency="1" throughput="0.25" ports="1*p0156"/>
+//	  <Timing instruction="ADD" operands="r64, m64" latency="6" throughput="0.5" ports="1*p0156+1*p23"/>
+//	</Model>
+//
+// The operands attribute uses the operand names of the instruction XML. Ports
+// are written as in uops.info: a sum of uop counts, each followed by the set
+// of ports that can execute it.
+package cost
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kalamay/x86/instruction"
+	"github.com/kalamay/x86/x64"
+	"github.com/kalamay/x86/x64/dataflow"
+)
+
+var (
+	ErrPortsInvalid = errors.New("invalid port usage")
+)
+
+// PortMask is a set of execution ports numbered 0 to 15.
+type PortMask uint16
+
+func (m PortMask) String() string {
+	var b strings.Builder
+	b.WriteByte('p')
+	for i := 0; i < 16; i++ {
+		if m&(1<<i) != 0 {
+			b.WriteString(strconv.FormatInt(int64(i), 16))
+		}
+	}
+	return b.String()
+}
+
+// PortUse is a number of uops that may each execute on any port of a set.
+type PortUse struct {
+	Count int
+	Ports PortMask
+}
+
+// PortList is the uops of an instruction.
+type PortList []PortUse
+
+// ParsePorts parses a port list such as "1*p0156+2*p23".
+func ParsePorts(s string) (PortList, error) {
+	var pl PortList
+	if s = strings.TrimSpace(s); s == "" {
+		return pl, nil
+	}
+	for _, term := range strings.Split(s, "+") {
+		term = strings.TrimSpace(term)
+		n, ports := 1, term
+		if i := strings.IndexByte(term, '*'); i >= 0 {
+			var err error
+			if n, err = strconv.Atoi(term[:i]); err != nil || n < 0 {
+				return nil, ErrPortsInvalid
+			}
+			ports = term[i+1:]
+		}
+		if len(ports) < 2 || ports[0] != 'p' {
+			return nil, ErrPortsInvalid
+		}
+		var m PortMask
+		for _, c := range ports[1:] {
+			d, err := strconv.ParseUint(string(c), 16, 8)
+			if err != nil {
+				return nil, ErrPortsInvalid
+			}
+			m |= 1 << d
+		}
+		pl = append(pl, PortUse{Count: n, Ports: m})
+	}
+	return pl, nil
+}
+
+func (pl PortList) String() string {
+	terms := make([]string, len(pl))
+	for i, pu := range pl {
+		terms[i] = fmt.Sprintf("%d*%s", pu.Count, pu.Ports)
+	}
+	return strings.Join(terms, "+")
+}
+
+// Uops returns the total number of uops.
+func (pl PortList) Uops() int {
+	n := 0
+	for _, pu := range pl {
+		n += pu.Count
+	}
+	return n
+}
+
+func (pl *PortList) UnmarshalXMLAttr(attr xml.Attr) (err error) {
+	*pl, err = ParsePorts(attr.Value)
+	return
+}
+
+// Timing is the cost of an instruction form.
+type Timing struct {
+	Instruction string   `xml:"instruction,attr"`
+	Operands    string   `xml:"operands,attr"`
+	Latency     int      `xml:"latency,attr"`
+	Throughput  float64  `xml:"throughput,attr"`
+	Ports       PortList `xml:"ports,attr"`
+}
+
+// Model is the timing table of a microarchitecture.
+type Model struct {
+	XMLName    xml.Name `xml:"Model"`
+	Name       string   `xml:"name,attr"`
+	IssueWidth int      `xml:"issue-width,attr"`
+	Timings    []Timing `xml:"Timing"`
+
+	// Default is used for forms missing from Timings.
+	Default Timing `xml:"-"`
+
+	forms map[string]int
+}
+
+// DefaultTiming is the cost assumed for a form missing from a Model.
+var DefaultTiming = Timing{Latency: 1, Throughput: 1}
+
+func (m *Model) Load(r io.Reader) error {
+	v := Model{}
+	if err := xml.NewDecoder(r).Decode(&v); err != nil {
+		return err
+	}
+	if v.IssueWidth <= 0 {
+		v.IssueWidth = 4
+	}
+	v.Default = DefaultTiming
+	v.forms = make(map[string]int, len(v.Timings))
+	for i, t := range v.Timings {
+		v.forms[formKey(t.Instruction, t.Operands)] = i
+	}
+	*m = v
+	return nil
+}
+
+// Timing returns the cost of form f of in. The second result is false if
+// the form is not in the table and the Default is returned instead.
+func (m *Model) Timing(in *instruction.Instruction, f *instruction.Form) (Timing, bool) {
+	if i, ok := m.forms[formKey(in.Name, operands(f))]; ok {
+		return m.Timings[i], true
+	}
+	return m.Default, false
+}
+
+// Latency returns the latency of call. It can be used as a sched.Latency.
+func (m *Model) Latency(call *x64.EmitCall, info dataflow.Info) int {
+	f, err := x64.SelectForm(call.Instruction, call.Args)
+	if err != nil {
+		return m.Default.Latency
+	}
+	t, _ := m.Timing(call.Instruction, f)
+	return t.Latency
+}
+
+func operands(f *instruction.Form) string {
+	ops := make([]string, f.Operands.Len)
+	for i := range ops {
+		ops[i] = f.Operands.Val[i].String()
+	}
+	return strings.Join(ops, ",")
+}
+
+func formKey(name, operands string) string {
+	ops := strings.Split(operands, ",")
+	for i := range ops {
+		ops[i] = strings.ToLower(strings.TrimSpace(ops[i]))
+	}
+	return strings.ToUpper(name) + " " + strings.Join(ops, ",")
+}
+
+// Line is the cost of one instruction of a Report.
+type Line struct {
+	Call   *x64.EmitCall
+	Timing Timing
+	Known  bool
+}
+
+// Report is the estimated cost of one iteration of a loop body.
+type Report struct {
+	Lines []Line
+	Uops  int
+	// Pressure is the number of cycles each port is busy per iteration.
+	Pressure [16]float64
+	// Ports is the set of ports used by the model.
+	Ports PortMask
+
+	// IssueBound is the cycles needed to issue every uop.
+	IssueBound float64
+	// PortBound is the cycles needed by the busiest port, or by the forms
+	// whose reciprocal throughput exceeds their port usage.
+	PortBound float64
+	// DepBound is the cycles of the longest dependency chain carried from
+	// one iteration to the next.
+	DepBound float64
+}
+
+// Cycles returns the estimated cycles per iteration.
+func (r *Report) Cycles() float64 {
+	c := r.IssueBound
+	if r.PortBound > c {
+		c = r.PortBound
+	}
+	if r.DepBound > c {
+		c = r.DepBound
+	}
+	return c
+}
+
+// Bottleneck names the bound that limits the estimate.
+func (r *Report) Bottleneck() string {
+	switch c := r.Cycles(); {
+	case c == r.DepBound:
+		return "dependency"
+	case c == r.PortBound:
+		return "ports"
+	}
+	return "issue"
+}
+
+// Analyze estimates the cost of running vals repeatedly as a loop body.
+// Labels are ignored.
+func (m *Model) Analyze(vals []x64.EmitValue) (*Report, error) {
+	r := &Report{}
+	var infos []dataflow.Info
+	rthr := map[string]float64{}
+
+	for _, v := range vals {
+		call, ok := v.(*x64.EmitCall)
+		if !ok {
+			continue
+		}
+		f, err := x64.SelectForm(call.Instruction, call.Args)
+		if err != nil {
+			return nil, &x64.Error{Value: call, Err: err}
+		}
+		info, _ := dataflow.InfoOf(call)
+		t, known := m.Timing(call.Instruction, f)
+		r.Lines = append(r.Lines, Line{Call: call, Timing: t, Known: known})
+		infos = append(infos, info)
+		// Every instruction issues at least one uop, even when the model
+		// does not list its ports.
+		if n := t.Ports.Uops(); n > 0 {
+			r.Uops += n
+		} else {
+			r.Uops++
+		}
+		rthr[formKey(call.Instruction.Name, operands(f))] += t.Throughput
+		for _, pu := range t.Ports {
+			r.Ports |= pu.Ports
+		}
+	}
+
+	r.Pressure = pressure(r.Lines)
+	for _, p := range r.Pressure {
+		if p > r.PortBound {
+			r.PortBound = p
+		}
+	}
+	for _, t := range rthr {
+		if t > r.PortBound {
+			r.PortBound = t
+		}
+	}
+	width := m.IssueWidth
+	if width <= 0 {
+		width = 4
+	}
+	r.IssueBound = float64(r.Uops) / float64(width)
+	r.DepBound = depBound(r.Lines, infos)
+	return r, nil
+}
+
+// pressure distributes the uops of lines over their ports, filling the
+// least busy ports first. Uops with the fewest choices are placed first.
+func pressure(lines []Line) [16]float64 {
+	const eps = 1e-9
+
+	var uses []PortUse
+	for _, l := range lines {
+		uses = append(uses, l.Timing.Ports...)
+	}
+	sort.SliceStable(uses, func(i, j int) bool {
+		return bits.OnesCount16(uint16(uses[i].Ports)) < bits.OnesCount16(uint16(uses[j].Ports))
+	})
+
+	var load [16]float64
+	for _, pu := range uses {
+		for left := float64(pu.Count); left > eps && pu.Ports != 0; {
+			low, next, n := math.Inf(1), math.Inf(1), 0
+			for i := range load {
+				if pu.Ports&(1<<i) != 0 && load[i] < low {
+					low = load[i]
+				}
+			}
+			for i := range load {
+				switch {
+				case pu.Ports&(1<<i) == 0:
+				case load[i]-low < eps:
+					n++
+				case load[i] < next:
+					next = load[i]
+				}
+			}
+			// Raise the least busy ports towards the next level.
+			step := left / float64(n)
+			if next-low < step {
+				step = next - low
+			}
+			for i := range load {
+				if pu.Ports&(1<<i) != 0 && load[i]-low < eps {
+					load[i] += step
+				}
+			}
+			left -= step * float64(n)
+		}
+	}
+	return load
+}
+
+// depBound runs the loop body through a number of iterations, ignoring
+// resource limits, and returns the cycles added by each iteration once the
+// loop carried chains have settled.
+func depBound(lines []Line, infos []dataflow.Info) float64 {
+	const iterations = 16
+	var (
+		ready [len(dataflow.RegSet{}) * 64]float64
+		ends  [iterations]float64
+	)
+	for it := 0; it < iterations; it++ {
+		end := 0.0
+		if it > 0 {
+			end = ends[it-1]
+		}
+		for i, l := range lines {
+			start := 0.0
+			forEach(infos[i].Use, func(u int) {
+				if ready[u] > start {
+					start = ready[u]
+				}
+			})
+			done := start + float64(l.Timing.Latency)
+			forEach(infos[i].Def, func(u int) {
+				ready[u] = done
+			})
+			if done > end {
+				end = done
+			}
+		}
+		ends[it] = end
+	}
+	half := iterations / 2
+	return (ends[iterations-1] - ends[half-1]) / float64(iterations-half)
+}
+
+func forEach(s dataflow.RegSet, fn func(u int)) {
+	for w, word := range s {
+		for b := word; b != 0; b &= b - 1 {
+			fn(w*64 + bits.TrailingZeros64(b))
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package cost
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	. "github.com/kalamay/x86/operand"
+	"github.com/kalamay/x86/x64"
+)
+
+const testModel = `<Model name="test" issue-width="4">
+  <Timing instruction="VADDPS" operands="ymm, ymm, ymm" latency="4" throughput="0.5" ports="1*p01"/>
+  <Timing instruction="VMULPS" operands="ymm, ymm, ymm" latency="4" throughput="0.5" ports="1*p01"/>
+  <Timing instruction="VMOVDQU" operands="ymm, m256" latency="7" throughput="0.5" ports="1*p23"/>
+  <Timing instruction="MULPS" operands="xmm, xmm" latency="4" throughput="3" ports="1*p0"/>
+</Model>`
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		Input  string
+		Expect string
+		Uops   int
+		Err    error
+	}{
+		{"1*p0156", "1*p0156", 1, nil},
+		{"1*p0156+2*p23", "1*p0156+2*p23", 3, nil},
+		{"p5", "1*p5", 1, nil},
+		{"", "", 0, nil},
+		{"1*q0", "", 0, ErrPortsInvalid},
+		{"x*p0", "", 0, ErrPortsInvalid},
+		{"1*p", "", 0, ErrPortsInvalid},
+	}
+
+	for _, test := range tests {
+		pl, err := ParsePorts(test.Input)
+		if err != test.Err {
+			t.Errorf("unexpected error for %q: expect = %v, actual = %v", test.Input, test.Err, err)
+			continue
+		}
+		if s := pl.String(); s != test.Expect {
+			t.Errorf("failed to parse %q: expect = %q, actual = %q", test.Input, test.Expect, s)
+		}
+		if n := pl.Uops(); n != test.Uops {
+			t.Errorf("incorrect uops for %q: expect = %d, actual = %d", test.Input, test.Uops, n)
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	m := Model{}
+	if err := m.Load(strings.NewReader(testModel)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Name       string
+		Build      func(e *x64.Emit)
+		Cycles     float64
+		Bottleneck string
+		Pressure   []float64
+	}{
+		{
+			Name: "accumulator",
+			Build: func(e *x64.Emit) {
+				e.Label("loop")
+				e.VADDPS(YMM0, YMM0, YMM1)
+			},
+			Cycles:     4,
+			Bottleneck: "dependency",
+			Pressure:   []float64{0.5, 0.5},
+		},
+		{
+			Name: "independent",
+			Build: func(e *x64.Emit) {
+				e.VMULPS(YMM0, YMM4, YMM5)
+				e.VMULPS(YMM1, YMM4, YMM5)
+				e.VMULPS(YMM2, YMM4, YMM5)
+				e.VMULPS(YMM3, YMM4, YMM5)
+			},
+			Cycles:     2,
+			Bottleneck: "ports",
+			Pressure:   []float64{2, 2},
+		},
+		{
+			Name: "loads",
+			Build: func(e *x64.Emit) {
+				e.VMOVDQU(YMM0, Ptr(RDI))
+				e.VMOVDQU(YMM1, Ptr(RDI).Offset(32))
+				e.VADDPS(YMM2, YMM0, YMM1)
+			},
+			Cycles:     1,
+			Bottleneck: "ports",
+			Pressure:   []float64{0.5, 0.5, 1, 1},
+		},
+		{
+			Name: "unpipelined",
+			Build: func(e *x64.Emit) {
+				e.MULPS(XMM0, XMM1)
+				e.MULPS(XMM2, XMM1)
+			},
+			Cycles:     6,
+			Bottleneck: "ports",
+			Pressure:   []float64{2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			prog := x64.NewProgram()
+			e := x64.Emit{}
+			e.Open(prog, nil)
+			test.Build(&e)
+			for _, err := range e.Close() {
+				t.Fatal(err)
+			}
+
+			r, err := m.Analyze(prog.Values())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c := r.Cycles(); math.Abs(c-test.Cycles) > 1e-6 {
+				t.Errorf("incorrect cycles: expect = %v, actual = %v", test.Cycles, c)
+			}
+			if b := r.Bottleneck(); b != test.Bottleneck {
+				t.Errorf("incorrect bottleneck: expect = %q, actual = %q", test.Bottleneck, b)
+			}
+			for i, p := range test.Pressure {
+				if math.Abs(r.Pressure[i]-p) > 1e-6 {
+					t.Errorf("incorrect pressure on port %d: expect = %v, actual = %v", i, p, r.Pressure[i])
+				}
+			}
+		})
+	}
+}
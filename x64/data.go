@@ -0,0 +1,59 @@
+package x64
+
+import (
+	"runtime"
+
+	"github.com/kalamay/x86/instruction"
+	"github.com/kalamay/x86/operand"
+)
+
+// DataInstruction is the pseudo-instruction of calls that emit raw bytes
+// rather than an encoded instruction. Its only argument is an operand.Data
+// no longer than an instruction.
+var DataInstruction = &instruction.Instruction{Name: "DB", Summary: "Define Bytes"}
+
+const maxData = len(instruction.Format{}.Val)
+
+// NewData creates a call that emits b as is. The length of b may not exceed
+// 15 bytes.
+func NewData(b []byte) *EmitCall {
+	call := &EmitCall{
+		Instruction: DataInstruction,
+		Args:        []operand.Arg{operand.Data(b)},
+	}
+	runtime.Callers(2, call.pc[:])
+	return call
+}
+
+// Data emits b as is, split into calls of at most 15 bytes.
+func (e *Emit) Data(b []byte) {
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxData {
+			n = maxData
+		}
+		call := &EmitCall{
+			Instruction: DataInstruction,
+			Args:        []operand.Arg{operand.Data(b[:n])},
+		}
+		runtime.Callers(2, call.pc[:])
+		e.emit(call)
+		b = b[n:]
+	}
+}
+
+// Offsetter is implemented by an Emitter that knows the offset of the next
+// instruction from the start of its output.
+type Offsetter interface {
+	// Offset returns the offset, or false if it is not yet known.
+	Offset() (int, bool)
+}
+
+// Offset returns the offset of the next instruction, if the emitter is an
+// Offsetter that knows it.
+func (e *Emit) Offset() (int, bool) {
+	if o, ok := e.emitter.(Offsetter); ok {
+		return o.Offset()
+	}
+	return 0, false
+}
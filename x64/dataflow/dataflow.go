@@ -0,0 +1,320 @@
+// Package dataflow computes register usage and liveness over a recorded
+// sequence of instructions.
+//
+// The registers each instruction reads and writes come from the Input,
+// Output and Implicit flags of the params of its selected form, the address
+// registers of its memory operands and the RFLAGS table in x64. Control flow
+// follows labels and jumps within the sequence.
+//
+// Virtual registers are tracked separately from the physical registers, as
+// whole values in a VRegSet.
+package dataflow
+
+import (
+	"github.com/kalamay/x86/instruction"
+	"github.com/kalamay/x86/operand"
+	"github.com/kalamay/x86/x64"
+)
+
+// Info is the register usage of a single instruction.
+type Info struct {
+	// Use are the units read by the instruction.
+	Use RegSet
+	// Def are the units written by the instruction. A write to part of a
+	// register only defines the units it covers, so the rest of the register
+	// stays live across it.
+	Def RegSet
+	// VUse are the virtual registers read by the instruction.
+	VUse VRegSet
+	// VDef are the virtual registers written by the instruction. A write
+	// that may keep part of the old value also reads it, and so is in VUse.
+	VDef VRegSet
+	// Load is set when the instruction reads a memory operand.
+	Load bool
+	// Store is set when the instruction writes to a memory operand.
+	Store bool
+}
+
+// InfoOf returns the register usage of call.
+func InfoOf(call *x64.EmitCall) (Info, error) {
+	f, err := x64.SelectForm(call.Instruction, call.Args)
+	if err != nil {
+		return Info{}, err
+	}
+	return infoOf(call, f), nil
+}
+
+func infoOf(call *x64.EmitCall, f *instruction.Form) Info {
+	var info Info
+	vex := f.Encoding.VEX.Type != instruction.VexTypeNone || f.Encoding.EVEX.Fmm.IsSet()
+	cancel := cancels(f, call.Args)
+
+	for i := uint8(0); i < f.Operands.Len; i++ {
+		p := f.Operands.Val[i]
+		switch arg := call.Args[i].(type) {
+		case operand.Reg:
+			info.access(arg, p, vex, cancel)
+		case operand.VReg:
+			info.vaccess(arg, p, vex, cancel)
+		case operand.Mem:
+			info.Use.Add(arg.Base)
+			info.Use.Add(arg.Index)
+			info.Load = info.Load || p.Input()
+			info.Store = info.Store || p.Output()
+		}
+	}
+	for i := uint8(0); i < f.Implicit.Len; i++ {
+		p := f.Implicit.Val[i]
+		info.access(operand.Reg(operand.RegParam(p)), p, vex, false)
+	}
+
+	fe := x64.FlagEffectOf(call.Instruction)
+	info.Use.AddFlags(fe.Read | fe.Maybe)
+	info.Def.AddFlags(fe.Writes())
+	return info
+}
+
+func (info *Info) access(r operand.Reg, p operand.Param, vex, cancel bool) {
+	if k := r.MaskReg(); k != 0 {
+		info.Use.Add(k)
+	}
+	merge := r.MergeMasked()
+	r = r.Unmask()
+	if (p.Input() && !cancel) || (p.Output() && merge) {
+		info.Use.Add(r)
+	}
+	if p.Output() {
+		info.Def = info.Def.Union(defUnits(r, vex))
+	}
+}
+
+func (info *Info) vaccess(v operand.VReg, p operand.Param, vex, cancel bool) {
+	if (p.Input() && !cancel) || (p.Output() && !vdefines(v, vex)) {
+		info.VUse.Add(v)
+	}
+	if p.Output() {
+		info.VDef.Add(v)
+	}
+}
+
+// cancels reports whether the inputs of f are the same register, such as in
+// "XOR eax, eax", so that the result does not depend on them.
+func cancels(f *instruction.Form, args []operand.Arg) bool {
+	if !f.CancelingInputs {
+		return false
+	}
+	var in []operand.Arg
+	for i := uint8(0); i < f.Operands.Len; i++ {
+		if !f.Operands.Val[i].Input() {
+			continue
+		}
+		switch r := args[i].(type) {
+		case operand.Reg:
+			in = append(in, r.Unmask())
+		case operand.VReg:
+			in = append(in, r)
+		default:
+			return false
+		}
+	}
+	return len(in) == 2 && in[0] == in[1]
+}
+
+// Config describes the registers used at the edges of the analyzed code.
+type Config struct {
+	// Exit are the registers live when the code returns or falls off the end.
+	Exit RegSet
+	// CallUse are the registers read by a CALL.
+	CallUse RegSet
+	// CallDef are the registers overwritten by a CALL.
+	CallDef RegSet
+	// CalleeSaved are the registers a function must preserve.
+	CalleeSaved []operand.Reg
+}
+
+// SysV is the configuration for the System V AMD64 calling convention.
+var SysV = Config{
+	Exit: RegSetOf(
+		operand.RAX, operand.RDX, operand.XMM0, operand.XMM1, operand.RSP,
+		operand.RBX, operand.RBP, operand.R12, operand.R13, operand.R14, operand.R15,
+	),
+	CallUse: RegSetOf(
+		operand.RDI, operand.RSI, operand.RDX, operand.RCX, operand.R8, operand.R9,
+		operand.XMM0, operand.XMM1, operand.XMM2, operand.XMM3,
+		operand.XMM4, operand.XMM5, operand.XMM6, operand.XMM7,
+		operand.AL, operand.RSP,
+	),
+	CallDef: RegSetOf(
+		operand.RAX, operand.RCX, operand.RDX, operand.RSI, operand.RDI,
+		operand.R8, operand.R9, operand.R10, operand.R11,
+		operand.ZMM0, operand.ZMM1, operand.ZMM2, operand.ZMM3,
+		operand.ZMM4, operand.ZMM5, operand.ZMM6, operand.ZMM7,
+		operand.ZMM8, operand.ZMM9, operand.ZMM10, operand.ZMM11,
+		operand.ZMM12, operand.ZMM13, operand.ZMM14, operand.ZMM15,
+		operand.K0, operand.K1, operand.K2, operand.K3,
+		operand.K4, operand.K5, operand.K6, operand.K7,
+	).Union(FlagSetOf(x64.FlagsStatus)),
+	CalleeSaved: []operand.Reg{
+		operand.RBX, operand.RBP, operand.R12, operand.R13, operand.R14, operand.R15,
+	},
+}
+
+// Liveness holds the register usage and liveness of each value of a program.
+// Labels have an empty Info and the same In and Out.
+type Liveness struct {
+	Info []Info
+	In   []RegSet
+	Out  []RegSet
+	VIn  []VRegSet
+	VOut []VRegSet
+
+	vals []x64.EmitValue
+	succ [][]int
+}
+
+// Analyze computes liveness for vals, which refer to labels by the unique
+// names that a Program records them under.
+func Analyze(vals []x64.EmitValue, c Config) (*Liveness, error) {
+	n := len(vals)
+	l := &Liveness{
+		Info: make([]Info, n),
+		In:   make([]RegSet, n),
+		Out:  make([]RegSet, n),
+		VIn:  make([]VRegSet, n),
+		VOut: make([]VRegSet, n),
+		vals: vals,
+		succ: successors(vals),
+	}
+
+	exit := make([]bool, n)
+	for i, v := range vals {
+		call, ok := v.(*x64.EmitCall)
+		if !ok {
+			continue
+		}
+		f, err := x64.SelectForm(call.Instruction, call.Args)
+		if err != nil {
+			return nil, &x64.Error{Value: call, Err: err}
+		}
+		l.Info[i] = infoOf(call, f)
+		switch call.Instruction.Name {
+		case "CALL":
+			l.Info[i].Use = l.Info[i].Use.Union(c.CallUse)
+			l.Info[i].Def = l.Info[i].Def.Union(c.CallDef)
+		case "RET":
+			exit[i] = true
+		}
+	}
+	for i := range l.succ {
+		for _, s := range l.succ[i] {
+			if s == n {
+				exit[i] = true
+			}
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for i := n - 1; i >= 0; i-- {
+			var out RegSet
+			if exit[i] {
+				out = c.Exit
+			}
+			for _, s := range l.succ[i] {
+				if s < n {
+					out = out.Union(l.In[s])
+				}
+			}
+			in := l.Info[i].Use.Union(out.Diff(l.Info[i].Def))
+			if in != l.In[i] || out != l.Out[i] {
+				l.In[i], l.Out[i] = in, out
+				changed = true
+			}
+
+			var vout VRegSet
+			for _, s := range l.succ[i] {
+				if s < n {
+					vout = vout.Union(l.VIn[s])
+				}
+			}
+			vin := l.Info[i].VUse.Union(vout.Diff(l.Info[i].VDef))
+			if !vin.Equal(l.VIn[i]) || !vout.Equal(l.VOut[i]) {
+				l.VIn[i], l.VOut[i] = vin, vout
+				changed = true
+			}
+		}
+	}
+	return l, nil
+}
+
+// Succ returns the positions control may pass to after position i. A
+// position equal to the length of the program is the fall through exit.
+func (l *Liveness) Succ(i int) []int {
+	return l.succ[i]
+}
+
+// Dead reports whether the instruction at position i only writes registers
+// that are not read afterwards, so that removing it has no effect.
+func (l *Liveness) Dead(i int) bool {
+	call, ok := l.vals[i].(*x64.EmitCall)
+	if !ok || l.Info[i].Store || (l.Info[i].Def.Empty() && l.Info[i].VDef.Empty()) {
+		return false
+	}
+	if _, ok := branchTarget(call); ok {
+		return false
+	}
+	switch call.Instruction.Name {
+	case "CALL", "RET", "JMP", "PUSH", "POP":
+		return false
+	}
+	return l.Info[i].Def.Intersect(l.Out[i]).Empty() &&
+		l.Info[i].VDef.Intersect(l.VOut[i]).Empty()
+}
+
+// successors returns the control flow successors of each value.
+func successors(vals []x64.EmitValue) [][]int {
+	labels := x64.Labels(vals)
+	succ := make([][]int, len(vals))
+	for i, v := range vals {
+		call, ok := v.(*x64.EmitCall)
+		if !ok {
+			succ[i] = []int{i + 1}
+			continue
+		}
+		name := call.Instruction.Name
+		if name == "RET" || name == "UD2" {
+			continue
+		}
+		to, ok := branchTarget(call)
+		switch {
+		case name == "CALL":
+			succ[i] = []int{i + 1}
+		case ok && name == "JMP":
+			if t, ok := labels[to]; ok {
+				succ[i] = []int{t}
+			} else {
+				succ[i] = []int{len(vals)}
+			}
+		case ok:
+			if t, ok := labels[to]; ok {
+				succ[i] = []int{i + 1, t}
+			} else {
+				succ[i] = []int{i + 1, len(vals)}
+			}
+		case name == "JMP":
+			// An indirect jump leaves the analyzed code.
+			succ[i] = []int{len(vals)}
+		default:
+			succ[i] = []int{i + 1}
+		}
+	}
+	return succ
+}
+
+func branchTarget(call *x64.EmitCall) (string, bool) {
+	if len(call.Args) != 1 {
+		return "", false
+	}
+	l, ok := call.Args[0].(operand.Label)
+	return string(l), ok
+}
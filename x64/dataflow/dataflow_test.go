@@ -0,0 +1,224 @@
+package dataflow
+
+import (
+	"reflect"
+	"testing"
+
+	. "github.com/kalamay/x86/operand"
+	"github.com/kalamay/x86/x64"
+)
+
+func record(build func(e *x64.Emit)) []x64.EmitValue {
+	p := x64.NewProgram()
+	e := x64.Emit{}
+	e.Open(p, nil)
+	build(&e)
+	e.Close()
+	return p.Values()
+}
+
+func TestRegSet(t *testing.T) {
+	tests := []struct {
+		Set    RegSet
+		Expect string
+	}{
+		{RegSetOf(RAX, BL, CH, DX, ESI), "{rax ch dx bl esi}"},
+		{RegSetOf(AL, AH), "{ax}"},
+		{RegSetOf(XMM1, YMM2, ZMM3, K1), "{xmm1 ymm2 zmm3 k1}"},
+		{FlagSetOf(x64.FlagCF | x64.FlagZF), "{CF|ZF}"},
+	}
+	for _, test := range tests {
+		if s := test.Set.String(); s != test.Expect {
+			t.Errorf("expected %s, got %s", test.Expect, s)
+		}
+	}
+
+	s := RegSetOf(AX)
+	if !s.Has(RAX) || !s.Has(AL) || !s.Has(AH) || s.Has(R8) {
+		t.Errorf("unexpected aliasing for %s", s)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	vals := record(func(e *x64.Emit) {
+		e.MOV(RAX, Int(0))    // 0
+		e.Label("loop")       // 1
+		e.ADD(RAX, RCX)       // 2
+		e.DEC(RDX)            // 3
+		e.JNE(Label("loop"))  // 4
+		e.MOV(R8, Int(5))     // 5
+		e.MOV(AX, Int(1))     // 6
+		e.VMOVDQU(XMM0, XMM1) // 7
+		e.MOVAPS(XMM2, XMM3)  // 8
+		e.XOR(R9D, R9D)       // 9
+		e.RET()               // 10
+	})
+
+	c := Config{Exit: RegSetOf(RAX, YMM0, YMM2, R9)}
+	l, err := Analyze(vals, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, ok bool) {
+		t.Helper()
+		if !ok {
+			t.Errorf("%s: in=%v out=%v", name, l.In, l.Out)
+		}
+	}
+	check("entry", l.In[0].Has(RCX) && l.In[0].Has(RDX) && !l.In[0].Has(RAX))
+	check("loop", l.Out[4].Has(RAX) && l.Out[4].Has(RCX) && l.In[1].Has(RAX))
+	check("flags", l.Out[3].Flags() == x64.FlagZF && l.In[4].Flags() == x64.FlagZF)
+	check("partial", l.In[6].Has(EAX) && !l.In[6].Has(AX))
+	check("vex", !l.In[7].Has(YMM0) && l.In[7].Has(XMM1))
+	check("sse", l.In[8].Has(YMM2) && !l.In[8].Has(XMM2) && l.In[8].Has(XMM3))
+	check("cancel", !l.In[9].Has(R9))
+
+	if !l.Dead(5) {
+		t.Errorf("expected %d to be dead", 5)
+	}
+	for _, i := range []int{0, 2, 3, 6, 9} {
+		if l.Dead(i) {
+			t.Errorf("expected %d to be live", i)
+		}
+	}
+}
+
+func TestVirtualLiveness(t *testing.T) {
+	v1 := MakeVReg(1, RegTypeGeneral, Size64)
+	v2 := MakeVReg(2, RegTypeGeneral, Size64)
+	v3 := MakeVReg(1, RegTypeVector, Size128)
+	vals := record(func(e *x64.Emit) {
+		e.MOV(v1, Int(5))                   // 0
+		e.IMUL(v1, RSI)                     // 1
+		e.MOV(v2.As(Size16), v1.As(Size16)) // 2
+		e.MOV(v2.As(Size32), Int(0))        // 3
+		e.XOR(v1, v1)                       // 4
+		e.MOVAPS(v3, XMM0)                  // 5
+		e.VMOVDQU(v3, XMM0)                 // 6
+		e.MOV(RAX, v1)                      // 7
+		e.RET()                             // 8
+	})
+
+	l, err := Analyze(vals, SysV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, ok bool) {
+		t.Helper()
+		if !ok {
+			t.Errorf("%s: in=%v out=%v", name, l.VIn, l.VOut)
+		}
+	}
+	check("def", !l.VIn[0].Has(v1) && l.VOut[0].Has(v1))
+	check("use", l.Info[1].VUse.Has(v1) && l.Info[1].VDef.Has(v1) && l.VIn[1].Has(v1))
+	check("partial", l.Info[2].VUse.Has(v2) && l.Info[2].VDef.Has(v2))
+	check("zero extend", !l.Info[3].VUse.Has(v2))
+	check("cancel", !l.Info[4].VUse.Has(v1) && l.VIn[7].Has(v1))
+	check("sse", l.Info[5].VUse.Has(v3) && !l.Info[5].VUse.Has(v1))
+	check("vex", !l.Info[6].VUse.Has(v3))
+
+	for i, dead := range []bool{false, false, true, true, false, true, true, false} {
+		if l.Dead(i) != dead {
+			t.Errorf("%d: expected dead to be %v", i, dead)
+		}
+	}
+}
+
+func TestScopedLabels(t *testing.T) {
+	vals := record(func(e *x64.Emit) {
+		e.Label("f")          // 0
+		e.Label(".loop")      // 1
+		e.JMP(Label("out"))   // 2
+		e.Label("g")          // 3
+		e.Label(".loop")      // 4
+		e.DEC(ECX)            // 5
+		e.JNE(Label(".loop")) // 6
+		e.Label("1")          // 7
+		e.JE(Label("1f"))     // 8
+		e.JNE(Label("1b"))    // 9
+		e.Label("1")          // 10
+		e.Label("out")        // 11
+		e.RET()               // 12
+	})
+
+	l, err := Analyze(vals, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expect := range map[int][]int{2: {11}, 6: {7, 4}, 8: {9, 10}, 9: {10, 7}} {
+		if succ := l.Succ(i); !reflect.DeepEqual(succ, expect) {
+			t.Errorf("%d: expected successors %v, got %v", i, expect, succ)
+		}
+	}
+}
+
+func TestCheckPreserved(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Build  func(e *x64.Emit)
+		Expect []string
+	}{
+		{
+			Name: "push",
+			Build: func(e *x64.Emit) {
+				e.PUSH(RBX)
+				e.MOV(RBX, Int(1))
+				e.POP(RBX)
+				e.RET()
+			},
+		},
+		{
+			Name: "clobber",
+			Build: func(e *x64.Emit) {
+				e.MOV(R12, Int(1))
+				e.MOV(RAX, Int(1))
+				e.RET()
+			},
+			Expect: []string{"r12 is not preserved"},
+		},
+		{
+			Name: "frame",
+			Build: func(e *x64.Emit) {
+				e.PUSH(RBP)
+				e.MOV(RBP, RSP)
+				e.SUB(RSP, Int(16))
+				e.MOV(Ptr(RBP).Offset(-8), R13)
+				e.MOV(R13, Int(0))
+				e.MOV(R13, Ptr(RBP).Offset(-8))
+				e.MOV(RSP, RBP)
+				e.POP(RBP)
+				e.RET()
+			},
+		},
+		{
+			Name: "branch",
+			Build: func(e *x64.Emit) {
+				e.PUSH(RBX)
+				e.TEST(RDI, RDI)
+				e.JE(Label("skip"))
+				e.POP(RBX)
+				e.RET()
+				e.Label("skip")
+				e.POP(R14)
+				e.RET()
+			},
+			Expect: []string{"r14 is not preserved"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			errs := CheckPreserved(record(test.Build), SysV)
+			if len(errs) != len(test.Expect) {
+				t.Fatalf("expected %d errors, got %v", len(test.Expect), errs)
+			}
+			for i, err := range errs {
+				if msg := err.(*x64.Error).Err.Error(); msg != test.Expect[i] {
+					t.Errorf("expected %q, got %q", test.Expect[i], msg)
+				}
+			}
+		})
+	}
+}
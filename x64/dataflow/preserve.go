@@ -0,0 +1,335 @@
+package dataflow
+
+import (
+	"fmt"
+
+	"github.com/kalamay/x86/operand"
+	"github.com/kalamay/x86/x64"
+)
+
+// family identifies a whole register: 0-15 for general purpose registers
+// and 16-47 for vector registers.
+type family int8
+
+const (
+	familyVector = 16
+	familyCount  = familyVector + 32
+	noFamily     = family(-1)
+)
+
+func familyOf(r operand.Reg) family {
+	switch r.Type() {
+	case operand.RegTypeGeneral:
+		if r.HighByte() {
+			return family(r.ID() - 20)
+		}
+		if r.ID() < 16 {
+			return family(r.ID())
+		}
+	case operand.RegTypeVector:
+		if !r.MMX() && r.ID() < 32 {
+			return familyVector + family(r.ID())
+		}
+	}
+	return noFamily
+}
+
+func familyUnits(f family) RegSet {
+	if f < familyVector {
+		return units(operand.MakeReg(uint8(f), operand.RegTypeGeneral, operand.Size64))
+	}
+	return units(operand.MakeReg(uint8(f-familyVector), operand.RegTypeVector, operand.Size512))
+}
+
+// frame tracks which registers and stack slots still hold the value a
+// register had on entry.
+type frame struct {
+	valid bool
+	value [familyCount]family
+	slots map[int32]family
+
+	// sp is the offset of rsp from its value on entry, and bp the offset held
+	// in rbp after it is set up as a frame pointer.
+	sp, bp           int32
+	spKnown, bpKnown bool
+}
+
+func entryFrame() frame {
+	f := frame{valid: true, spKnown: true, slots: map[int32]family{}}
+	for i := range f.value {
+		f.value[i] = family(i)
+	}
+	return f
+}
+
+func (f frame) clone() frame {
+	slots := make(map[int32]family, len(f.slots))
+	for k, v := range f.slots {
+		slots[k] = v
+	}
+	f.slots = slots
+	return f
+}
+
+// merge combines the state of another path into f and reports whether f
+// changed.
+func (f *frame) merge(o frame) bool {
+	if !o.valid {
+		return false
+	}
+	if !f.valid {
+		*f = o.clone()
+		return true
+	}
+	changed := false
+	for i := range f.value {
+		if f.value[i] != o.value[i] && f.value[i] != noFamily {
+			f.value[i] = noFamily
+			changed = true
+		}
+	}
+	for k, v := range f.slots {
+		if ov, ok := o.slots[k]; !ok || ov != v {
+			delete(f.slots, k)
+			changed = true
+		}
+	}
+	if f.spKnown && (!o.spKnown || f.sp != o.sp) {
+		f.spKnown = false
+		changed = true
+	}
+	if f.bpKnown && (!o.bpKnown || f.bp != o.bp) {
+		f.bpKnown = false
+		changed = true
+	}
+	return changed
+}
+
+// slot returns the entry-relative stack offset m refers to.
+func (f *frame) slot(m operand.Mem) (int32, bool) {
+	if m.Index != 0 {
+		return 0, false
+	}
+	switch {
+	case m.Base == operand.RSP && f.spKnown:
+		return f.sp + m.Disp, true
+	case m.Base == operand.RBP && f.bpKnown:
+		return f.bp + m.Disp, true
+	}
+	return 0, false
+}
+
+func (f *frame) pop(dst family) {
+	v, ok := f.slots[f.sp]
+	if !ok || !f.spKnown {
+		v = noFamily
+	}
+	if dst != noFamily {
+		f.value[dst] = v
+	}
+	f.sp += 8
+}
+
+// step applies call to f.
+func (f *frame) step(call *x64.EmitCall, info Info) {
+	args := call.Args
+	reg := func(i int) (operand.Reg, bool) {
+		r, ok := args[i].(operand.Reg)
+		return r, ok
+	}
+	imm := func(i int) (int32, bool) {
+		switch v := args[i].(type) {
+		case operand.Int:
+			return int32(v), true
+		case operand.Uint:
+			return int32(v), true
+		}
+		return 0, false
+	}
+
+	switch name := call.Instruction.Name; name {
+	case "CALL":
+		return
+	case "PUSH":
+		f.sp -= 8
+		v := noFamily
+		if r, ok := reg(0); ok && r.Size() == operand.Size64 {
+			v = f.value[familyOf(r)]
+		}
+		if f.spKnown {
+			f.slots[f.sp] = v
+		}
+		return
+	case "POP":
+		dst := noFamily
+		if r, ok := reg(0); ok {
+			dst = familyOf(r)
+		}
+		f.pop(dst)
+		return
+	case "LEAVE":
+		f.sp, f.spKnown = f.bp, f.bpKnown
+		f.pop(familyOf(operand.RBP))
+		return
+	case "ADD", "SUB":
+		if r, ok := reg(0); ok && r == operand.RSP {
+			if n, ok := imm(1); ok {
+				if name == "SUB" {
+					n = -n
+				}
+				f.sp += n
+			} else {
+				f.spKnown = false
+			}
+			return
+		}
+	case "LEA":
+		if r, ok := reg(0); ok && r == operand.RSP {
+			f.sp, f.spKnown = f.slot(args[1].(operand.Mem))
+			return
+		}
+	}
+
+	if isMove(call.Instruction.Name) && len(args) == 2 {
+		dst, src := args[0], args[1]
+		switch d := dst.(type) {
+		case operand.Reg:
+			switch s := src.(type) {
+			case operand.Reg:
+				switch {
+				case d == operand.RBP && s == operand.RSP:
+					f.bp, f.bpKnown = f.sp, f.spKnown
+					f.value[familyOf(d)] = noFamily
+					return
+				case d == operand.RSP && s == operand.RBP:
+					f.sp, f.spKnown = f.bp, f.bpKnown
+					return
+				case wholeReg(d) && wholeReg(s):
+					f.value[familyOf(d)] = f.value[familyOf(s)]
+					return
+				}
+			case operand.Mem:
+				if off, ok := f.slot(s); ok && wholeReg(d) {
+					v, ok := f.slots[off]
+					if !ok {
+						v = noFamily
+					}
+					f.value[familyOf(d)] = v
+					return
+				}
+			}
+		case operand.Mem:
+			if off, ok := f.slot(d); ok {
+				v := noFamily
+				if s, ok := src.(operand.Reg); ok && wholeReg(s) {
+					v = f.value[familyOf(s)]
+				}
+				f.slots[off] = v
+				return
+			}
+		}
+	}
+
+	for i := range args {
+		if m, ok := args[i].(operand.Mem); ok && info.Store {
+			if off, ok := f.slot(m); ok {
+				f.slots[off] = noFamily
+			}
+		}
+	}
+	for fam := family(0); fam < familyCount; fam++ {
+		if !info.Def.Intersect(familyUnits(fam)).Empty() {
+			if fam == familyOf(operand.RSP) {
+				f.spKnown = false
+			}
+			f.value[fam] = noFamily
+		}
+	}
+}
+
+// wholeReg reports whether r covers the whole value of a register that must
+// be preserved: the 64-bit general purpose register or the low 128 bits of a
+// vector register.
+func wholeReg(r operand.Reg) bool {
+	switch r.Type() {
+	case operand.RegTypeGeneral:
+		return r.Size() == operand.Size64
+	case operand.RegTypeVector:
+		return !r.MMX()
+	}
+	return false
+}
+
+var moves = map[string]bool{
+	"MOV": true, "MOVDQU": true, "MOVDQA": true,
+	"MOVUPS": true, "MOVAPS": true, "MOVUPD": true, "MOVAPD": true,
+	"VMOVDQU": true, "VMOVDQA": true,
+	"VMOVUPS": true, "VMOVAPS": true, "VMOVUPD": true, "VMOVAPD": true,
+	"VMOVDQU32": true, "VMOVDQU64": true, "VMOVDQA32": true, "VMOVDQA64": true,
+}
+
+func isMove(name string) bool {
+	return moves[name]
+}
+
+// CheckPreserved verifies that every register in c.CalleeSaved, and rsp,
+// holds its value from entry at each RET in vals. Values may be saved and
+// restored with PUSH and POP or with moves to and from stack slots addressed
+// through rsp or a frame pointer in rbp.
+func CheckPreserved(vals []x64.EmitValue, c Config) []error {
+	var errs []error
+
+	n := len(vals)
+	info := make([]Info, n)
+	for i, v := range vals {
+		if call, ok := v.(*x64.EmitCall); ok {
+			var err error
+			if info[i], err = InfoOf(call); err != nil {
+				errs = append(errs, &x64.Error{Value: call, Err: err})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	succ := successors(vals)
+	in := make([]frame, n+1)
+	if n > 0 {
+		in[0] = entryFrame()
+	}
+	work := []int{0}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if i >= n || !in[i].valid {
+			continue
+		}
+		out := in[i].clone()
+		if call, ok := vals[i].(*x64.EmitCall); ok {
+			out.step(call, info[i])
+		}
+		for _, s := range succ[i] {
+			if in[s].merge(out) {
+				work = append(work, s)
+			}
+		}
+	}
+
+	for i, v := range vals {
+		call, ok := v.(*x64.EmitCall)
+		if !ok || call.Instruction.Name != "RET" || !in[i].valid {
+			continue
+		}
+		f := &in[i]
+		if !f.spKnown || f.sp != 0 {
+			errs = append(errs, &x64.Error{Value: call, Err: fmt.Errorf("%s is not preserved", operand.RSP)})
+		}
+		for _, r := range c.CalleeSaved {
+			if fam := familyOf(r); fam != noFamily && f.value[fam] != fam {
+				errs = append(errs, &x64.Error{Value: call, Err: fmt.Errorf("%s is not preserved", r)})
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,345 @@
+package dataflow
+
+import (
+	"math/bits"
+	"strings"
+
+	"github.com/kalamay/x86/operand"
+	"github.com/kalamay/x86/x64"
+)
+
+// RegSet is a set of register units. Registers that alias each other share
+// units, so that AL, AX, EAX and RAX all overlap, as do XMM0, YMM0 and ZMM0.
+//
+// General purpose registers have four units each:
+//
+//	┌───────────────────────┬───────────┬─────┬─────┐
+//	│         63-32         │   31-16   │15-8 │ 7-0 │
+//	└───────────────────────┴───────────┴─────┴─────┘
+//
+// Vector registers have three:
+//
+//	┌───────────────────────┬───────────┬───────────┐
+//	│        511-256        │  255-128  │   127-0   │
+//	└───────────────────────┴───────────┴───────────┘
+//
+// MMX and mask registers have one, as does each of the flags in x64.FlagsAll.
+type RegSet [3]uint64
+
+const (
+	unitGeneral = 0
+	unitVector  = unitGeneral + 16*4
+	unitMMX     = unitVector + 32*3
+	unitMask    = unitMMX + 8
+	unitFlags   = unitMask + 8
+	unitCount   = unitFlags + 7
+)
+
+// RegSetOf returns the set of the given registers.
+func RegSetOf(regs ...operand.Reg) RegSet {
+	var s RegSet
+	for _, r := range regs {
+		s.Add(r)
+	}
+	return s
+}
+
+// FlagSetOf returns the set of the given flags.
+func FlagSetOf(f x64.Flags) RegSet {
+	var s RegSet
+	s.AddFlags(f)
+	return s
+}
+
+func (s *RegSet) set(u uint) { s[u/64] |= 1 << (u % 64) }
+
+func (s RegSet) has(u uint) bool { return s[u/64]&(1<<(u%64)) != 0 }
+
+// Add inserts the units of r.
+func (s *RegSet) Add(r operand.Reg) {
+	*s = s.Union(units(r))
+}
+
+// Remove deletes the units of r.
+func (s *RegSet) Remove(r operand.Reg) {
+	*s = s.Diff(units(r))
+}
+
+// Has reports whether any unit of r is in the set.
+func (s RegSet) Has(r operand.Reg) bool {
+	return !s.Intersect(units(r)).Empty()
+}
+
+// AddFlags inserts the flags in f.
+func (s *RegSet) AddFlags(f x64.Flags) {
+	for i := uint(0); i < 7; i++ {
+		if f&(1<<i) != 0 {
+			s.set(unitFlags + i)
+		}
+	}
+}
+
+// Flags returns the flags in the set.
+func (s RegSet) Flags() x64.Flags {
+	var f x64.Flags
+	for i := uint(0); i < 7; i++ {
+		if s.has(unitFlags + i) {
+			f |= 1 << i
+		}
+	}
+	return f
+}
+
+func (s RegSet) Union(o RegSet) RegSet {
+	return RegSet{s[0] | o[0], s[1] | o[1], s[2] | o[2]}
+}
+
+func (s RegSet) Intersect(o RegSet) RegSet {
+	return RegSet{s[0] & o[0], s[1] & o[1], s[2] & o[2]}
+}
+
+func (s RegSet) Diff(o RegSet) RegSet {
+	return RegSet{s[0] &^ o[0], s[1] &^ o[1], s[2] &^ o[2]}
+}
+
+func (s RegSet) Empty() bool {
+	return s[0]|s[1]|s[2] == 0
+}
+
+// Len returns the number of units in the set.
+func (s RegSet) Len() int {
+	return bits.OnesCount64(s[0]) + bits.OnesCount64(s[1]) + bits.OnesCount64(s[2])
+}
+
+// String lists the registers in the set using the narrowest name that
+// covers the units of each.
+func (s RegSet) String() string {
+	var names []string
+	for id := uint8(0); id < 16; id++ {
+		u := uint(unitGeneral + 4*id)
+		var m uint
+		for i := uint(0); i < 4; i++ {
+			if s.has(u + i) {
+				m |= 1 << i
+			}
+		}
+		switch m {
+		case 0:
+		case 0b0001:
+			names = append(names, operand.MakeReg(id, operand.RegTypeGeneral, operand.Size8).String())
+		case 0b0010:
+			if id < 4 {
+				names = append(names, operand.MakeReg(id+20, operand.RegTypeGeneral, operand.Size8).String())
+				break
+			}
+			fallthrough
+		case 0b0011:
+			names = append(names, operand.MakeReg(id, operand.RegTypeGeneral, operand.Size16).String())
+		case 0b0111:
+			names = append(names, operand.MakeReg(id, operand.RegTypeGeneral, operand.Size32).String())
+		default:
+			names = append(names, operand.MakeReg(id, operand.RegTypeGeneral, operand.Size64).String())
+		}
+	}
+	for id := uint8(0); id < 32; id++ {
+		u := uint(unitVector + 3*id)
+		switch {
+		case s.has(u + 2):
+			names = append(names, operand.MakeReg(id, operand.RegTypeVector, operand.Size512).String())
+		case s.has(u + 1):
+			names = append(names, operand.MakeReg(id, operand.RegTypeVector, operand.Size256).String())
+		case s.has(u):
+			names = append(names, operand.MakeReg(id, operand.RegTypeVector, operand.Size128).String())
+		}
+	}
+	for id := uint8(0); id < 8; id++ {
+		if s.has(unitMMX + uint(id)) {
+			names = append(names, operand.MakeReg(id, operand.RegTypeVector, operand.Size64).String())
+		}
+	}
+	for id := uint8(0); id < 8; id++ {
+		if s.has(unitMask + uint(id)) {
+			names = append(names, operand.MakeReg(id, operand.RegTypeMask, operand.Size64).String())
+		}
+	}
+	if f := s.Flags(); f != 0 {
+		names = append(names, f.String())
+	}
+	return "{" + strings.Join(names, " ") + "}"
+}
+
+// units returns the units read by r.
+func units(r operand.Reg) RegSet {
+	var s RegSet
+	if r == 0 {
+		return s
+	}
+	id := uint(r.ID())
+	switch r.Type() {
+	case operand.RegTypeGeneral:
+		if r.HighByte() {
+			s.set(unitGeneral + 4*(id-20) + 1)
+			break
+		}
+		if id >= 16 {
+			break
+		}
+		n := uint(0)
+		switch r.Size() {
+		case operand.Size8:
+			n = 1
+		case operand.Size16:
+			n = 2
+		case operand.Size32:
+			n = 3
+		case operand.Size64:
+			n = 4
+		}
+		for i := uint(0); i < n; i++ {
+			s.set(unitGeneral + 4*id + i)
+		}
+	case operand.RegTypeVector:
+		if r.MMX() {
+			s.set(unitMMX + id%8)
+			break
+		}
+		n := uint(0)
+		switch r.Size() {
+		case operand.Size128:
+			n = 1
+		case operand.Size256:
+			n = 2
+		case operand.Size512:
+			n = 3
+		}
+		for i := uint(0); i < n && id < 32; i++ {
+			s.set(unitVector + 3*id + i)
+		}
+	case operand.RegTypeMask:
+		s.set(unitMask + id%8)
+	case operand.RegTypeStatus:
+		s.AddFlags(x64.FlagsAll)
+	}
+	return s
+}
+
+// defUnits returns the units overwritten by a write to r. Writing a 32-bit
+// general purpose register clears the upper half, as does a VEX or EVEX
+// encoded write to a vector register.
+func defUnits(r operand.Reg, vex bool) RegSet {
+	switch {
+	case r.Type() == operand.RegTypeGeneral && r.Size() == operand.Size32:
+		r = operand.MakeReg(r.ID(), operand.RegTypeGeneral, operand.Size64)
+	case r.Type() == operand.RegTypeVector && !r.MMX() && vex:
+		r = operand.MakeReg(r.ID(), operand.RegTypeVector, operand.Size512)
+	}
+	return units(r)
+}
+
+// VRegSet is a set of virtual registers. All sizes of a virtual register are
+// the same member, but general purpose and vector registers with the same ID
+// are distinct.
+type VRegSet []uint64
+
+func vunit(v operand.VReg) uint {
+	u := uint(v.ID()) * 2
+	if v.Type() == operand.RegTypeVector {
+		u++
+	}
+	return u
+}
+
+// VRegSetOf returns the set of the given virtual registers.
+func VRegSetOf(regs ...operand.VReg) VRegSet {
+	var s VRegSet
+	for _, v := range regs {
+		s.Add(v)
+	}
+	return s
+}
+
+// Add inserts v.
+func (s *VRegSet) Add(v operand.VReg) {
+	u := vunit(v)
+	for uint(len(*s)) <= u/64 {
+		*s = append(*s, 0)
+	}
+	(*s)[u/64] |= 1 << (u % 64)
+}
+
+// Has reports whether v is in the set.
+func (s VRegSet) Has(v operand.VReg) bool {
+	u := vunit(v)
+	return u/64 < uint(len(s)) && s[u/64]&(1<<(u%64)) != 0
+}
+
+func (s VRegSet) Union(o VRegSet) VRegSet {
+	if len(s) < len(o) {
+		s, o = o, s
+	}
+	r := make(VRegSet, len(s))
+	copy(r, s)
+	for i := range o {
+		r[i] |= o[i]
+	}
+	return r.trim()
+}
+
+func (s VRegSet) Intersect(o VRegSet) VRegSet {
+	if len(s) > len(o) {
+		s, o = o, s
+	}
+	r := make(VRegSet, len(s))
+	for i := range s {
+		r[i] = s[i] & o[i]
+	}
+	return r.trim()
+}
+
+func (s VRegSet) Diff(o VRegSet) VRegSet {
+	r := make(VRegSet, len(s))
+	copy(r, s)
+	for i := 0; i < len(r) && i < len(o); i++ {
+		r[i] &^= o[i]
+	}
+	return r.trim()
+}
+
+// Equal reports whether s and o have the same members.
+func (s VRegSet) Equal(o VRegSet) bool {
+	s, o = s.trim(), o.trim()
+	if len(s) != len(o) {
+		return false
+	}
+	for i := range s {
+		if s[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s VRegSet) Empty() bool {
+	return len(s.trim()) == 0
+}
+
+// trim drops the trailing empty words so that equal sets have equal lengths.
+func (s VRegSet) trim() VRegSet {
+	for len(s) > 0 && s[len(s)-1] == 0 {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// vdefines reports whether a write to v replaces its whole value, following
+// the same rules as defUnits. A virtual register may be read at a wider size
+// elsewhere, so a narrower write leaves it live.
+func vdefines(v operand.VReg, vex bool) bool {
+	switch v.Type() {
+	case operand.RegTypeGeneral:
+		return v.Size() >= operand.Size32
+	case operand.RegTypeVector:
+		return vex
+	}
+	return false
+}
@@ -64,6 +64,8 @@ type Emit struct {
 	emitter Emitter
 	errors  []error
 	w       io.Writer
+	prefix  Prefix
+	mode    Mode
 }
 
 func (e *Emit) Write(p []byte) (int, error) {
@@ -89,6 +91,8 @@ func (e *Emit) Open(em Emitter, w io.Writer) {
 	e.emitter = em
 	e.errors = nil
 	e.w = w
+	e.prefix = 0
+	e.mode = Mode64
 }
 
 func (e *Emit) Emit(id InstructionID, args []operand.Arg) {
@@ -97,19 +101,39 @@ func (e *Emit) Emit(id InstructionID, args []operand.Arg) {
 		Args:        args,
 	}
 	runtime.Callers(2, call.pc[:])
-	e.emitter.Emit(e, call)
+	e.emit(call)
 }
 
 func (e *Emit) EmitCall(call *EmitCall) {
-	if call.Line == 0 {
+	if call.Line == 0 && call.pc[0] == 0 {
 		runtime.Callers(2, call.pc[:])
 	}
+	e.emit(call)
+}
+
+func (e *Emit) emit(call *EmitCall) {
+	call.Prefix |= e.prefix
+	e.prefix = 0
+	if call.Mode == Mode64 {
+		call.Mode = e.mode
+	}
 	e.emitter.Emit(e, call)
 }
 
-func (e *Emit) Lock()     { e.Write([]byte{0xf0}) }
-func (e *Emit) Likely()   { e.Write([]byte{0x3e}) }
-func (e *Emit) Unlikely() { e.Write([]byte{0x2e}) }
+// SetMode sets the mode that the following instructions are encoded for.
+func (e *Emit) SetMode(m Mode) { e.mode = m }
+
+// Mode returns the mode that instructions are encoded for.
+func (e *Emit) Mode() Mode { return e.mode }
+
+// Prefix adds p to the prefixes of the next instruction.
+func (e *Emit) Prefix(p Prefix) { e.prefix |= p }
+
+func (e *Emit) Lock()     { e.Prefix(PrefixLock) }
+func (e *Emit) Rep()      { e.Prefix(PrefixRep) }
+func (e *Emit) Repne()    { e.Prefix(PrefixRepne) }
+func (e *Emit) Likely()   { e.Prefix(PrefixTaken) }
+func (e *Emit) Unlikely() { e.Prefix(PrefixNotTaken) }
 
 func (e *Emit) Label(name string) {
 	label := &EmitLabel{
@@ -119,6 +143,13 @@ func (e *Emit) Label(name string) {
 	e.emitter.Label(e, label)
 }
 
+func (e *Emit) EmitLabel(label *EmitLabel) {
+	if label.Line == 0 && label.pc[0] == 0 {
+		runtime.Callers(2, label.pc[:])
+	}
+	e.emitter.Label(e, label)
+}
+
 func (e *Emit) Close() []error {
 	e.emitter.Close(e)
 	errs := e.errors
@@ -131,6 +162,8 @@ func (e *Emit) Close() []error {
 type EmitCall struct {
 	Instruction *instruction.Instruction
 	Args        []operand.Arg
+	Prefix      Prefix
+	Mode        Mode
 	EmitPosition
 
 	pc [2]uintptr
@@ -0,0 +1,387 @@
+package x64
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kalamay/x86/instruction"
+	"github.com/kalamay/x86/operand"
+)
+
+// ErrLabelOperand is returned by Explain for a call that refers to a label,
+// as the offset to the label is only known within a program.
+var ErrLabelOperand = errors.New("label operands cannot be explained")
+
+// Explanation is an encoded instruction broken into the parts that make it
+// up, such as its prefixes, opcode and ModR/M byte.
+type Explanation struct {
+	// Form is the form that was matched, or nil for data.
+	Form *instruction.Form
+	// Encoding is the encoding of Form that was chosen.
+	Encoding *instruction.Encoding
+	// Args are the arguments as encoded. Outside of 64-bit mode, these are
+	// widened for a form that defaults to a 64-bit operand.
+	Args  []operand.Arg
+	Bytes []byte
+	Parts []Part
+}
+
+// Part is a run of the bytes of an instruction that has a single role.
+type Part struct {
+	Kind  PartKind
+	Bytes []byte
+	// Offset is the position of the first byte in the instruction.
+	Offset int
+	// Arg is the index of the argument encoded in the part, or -1.
+	Arg int
+	// Note describes the part further, such as which prefix it is.
+	Note   string
+	Fields []Field
+}
+
+// Field is a bit field within a part.
+type Field struct {
+	Name string
+	// Offset is the position of the byte in the instruction, and Shift is
+	// the position of the lowest bit of the field within that byte.
+	Offset int
+	Shift  uint8
+	Bits   uint8
+	Value  uint8
+	// Arg is the index of the argument encoded in the field, or -1.
+	Arg int
+}
+
+type PartKind uint8
+
+const (
+	PartPrefix PartKind = iota
+	PartREX
+	PartVEX
+	PartOpcode
+	PartModRM
+	PartSIB
+	PartDisp
+	PartImm
+	PartRel
+	PartMoffs
+	PartData
+)
+
+var partNames = [...]string{
+	"prefix", "REX", "VEX", "opcode", "ModRM", "SIB", "disp", "imm", "rel",
+	"moffs", "data",
+}
+
+func (k PartKind) String() string {
+	if int(k) < len(partNames) {
+		return partNames[k]
+	}
+	return fmt.Sprintf("PartKind(%d)", k)
+}
+
+// Explain encodes call and breaks it into its parts. It fails as a Machine
+// does for a form that cannot be encoded, such as an EVEX form.
+func Explain(call *EmitCall) (*Explanation, error) {
+	return Policy(nil).Explain(call)
+}
+
+// Explain is the package Explain with p choosing the encoding of the form.
+func (p Policy) Explain(call *EmitCall) (*Explanation, error) {
+	for _, arg := range call.Args {
+		if arg, ok := arg.(operand.Label); ok {
+			return nil, fmt.Errorf("%w: %q", ErrLabelOperand, referenceName(string(arg)))
+		}
+	}
+
+	m := NewMachine()
+	m.SetPolicy(p)
+	m.encoded = append(m.encoded, instruction.Format{})
+	if err := m.encode(0, call); err != nil {
+		return nil, err
+	}
+
+	x := &Explanation{Bytes: m.encoded[0].Bytes(), Args: call.Args}
+	if call.Instruction == DataInstruction {
+		x.Parts = []Part{{Kind: PartData, Bytes: x.Bytes, Arg: 0}}
+		return x, nil
+	}
+
+	as := call.Mode.size()
+	if call.Mode == Mode64 {
+		f, err := SelectForm(call.Instruction, call.Args)
+		if err != nil {
+			return nil, err
+		}
+		x.Form, x.Encoding = f, p.encoding(f, call.Args)
+	} else {
+		var err error
+		x.Form, x.Encoding, x.Args, _, as, err = selectMode(call, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := x.split(call, as); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// split fills in the parts of x from its bytes. The layout is that of the
+// encoding, except where the bytes depend on the arguments, as for the SIB
+// byte and the displacement.
+func (x *Explanation) split(call *EmitCall, as operand.Size) error {
+	enc, args, b, i := x.Encoding, x.Args, x.Bytes, 0
+	mem := memArg(args)
+
+	add := func(k PartKind, n, arg int, note string, fields ...Field) {
+		for j := range fields {
+			fields[j].Offset += i
+			fields[j].Value = (b[fields[j].Offset] >> fields[j].Shift) & (1<<fields[j].Bits - 1)
+		}
+		x.Parts = append(x.Parts, Part{Kind: k, Bytes: b[i : i+n], Offset: i, Arg: arg, Note: note, Fields: fields})
+		i += n
+	}
+	field := func(name string, off int, shift, bits uint8, arg int) Field {
+		return Field{Name: name, Offset: off, Shift: shift, Bits: bits, Arg: arg}
+	}
+
+	for n := bitsSet(call.Prefix); n > 0; n-- {
+		add(PartPrefix, 1, -1, prefixNote(b[i]))
+	}
+	for i < len(b) && legacyPrefix(b[i]) {
+		switch {
+		case b[i] == 0x67:
+			add(PartPrefix, 1, mem, "address size")
+		case b[i] != 0x66 && segmentPrefixed(args, b[i]):
+			add(PartPrefix, 1, mem, "segment")
+		case mandatoryPrefix(enc, b[i]):
+			add(PartPrefix, 1, -1, "mandatory")
+		case b[i] == 0x66:
+			add(PartPrefix, 1, -1, "operand size")
+		default:
+			add(PartPrefix, 1, -1, prefixNote(b[i]))
+		}
+	}
+
+	switch {
+	case enc.VEX.Type != instruction.VexTypeNone:
+		v := &enc.VEX
+		if b[i] == 0xc5 {
+			add(PartVEX, 2, -1, "two-byte",
+				field("R", 1, 7, 1, argRef(v.FR)),
+				field("vvvv", 1, 3, 4, argRef(v.Fvvvv)),
+				field("L", 1, 2, 1, -1),
+				field("pp", 1, 0, 2, -1),
+			)
+		} else {
+			note := "three-byte"
+			if v.Type == instruction.VexTypeXOP {
+				note = "XOP"
+			}
+			add(PartVEX, 3, -1, note,
+				field("R", 1, 7, 1, argRef(v.FR)),
+				field("X", 1, 6, 1, argRef(v.FX)),
+				field("B", 1, 5, 1, argRef(v.FB)),
+				field("m-mmmm", 1, 0, 5, -1),
+				field("W", 2, 7, 1, -1),
+				field("vvvv", 2, 3, 4, argRef(v.Fvvvv)),
+				field("L", 2, 2, 1, -1),
+				field("pp", 2, 0, 2, -1),
+			)
+		}
+	case call.Mode == Mode64 && i < len(b) && b[i]&0xf0 == 0x40:
+		r := &enc.REX
+		add(PartREX, 1, -1, "",
+			field("W", 0, 3, 1, -1),
+			field("R", 0, 2, 1, argRef(r.FR)),
+			field("X", 0, 1, 1, argRef(r.FX)),
+			field("B", 0, 0, 1, argRef(r.FB)),
+		)
+	}
+
+	if _, ok := shortIncDec(call.Instruction, args); ok && call.Mode != Mode64 {
+		add(PartOpcode, 1, -1, "", field("reg", 0, 0, 3, 0))
+		return x.done(i)
+	}
+
+	var opfields []Field
+	for j := uint8(0); j < enc.Opcode.Len; j++ {
+		if v, m := enc.Opcode.Val[j].AddEnd.Value(); m == instruction.OptModeRef {
+			opfields = append(opfields, field("reg", int(j), 0, 3, int(v)))
+		}
+	}
+	add(PartOpcode, int(enc.Opcode.Len), -1, opcodeMap(enc), opfields...)
+
+	if rm := argRef(enc.ModRM.RM); rm >= 0 {
+		if i >= len(b) {
+			return ErrFailedEncode
+		}
+		reg, regName := argRef(enc.ModRM.Reg), "reg"
+		if _, m := enc.ModRM.Reg.Value(); m == instruction.OptModeValue {
+			regName = "ext"
+		}
+		mod, r := b[i]>>6, b[i]&instruction.ModRMMask
+		_, isMem := args[rm].(operand.Mem)
+		add(PartModRM, 1, -1, "",
+			field("mod", 0, 6, 2, rm),
+			field(regName, 0, 3, 3, reg),
+			field("rm", 0, 0, 3, rm),
+		)
+
+		disp := 0
+		switch {
+		case !isMem || mod == 0b11:
+		case as == operand.Size16:
+			switch {
+			case mod == 0b01:
+				disp = 1
+			case mod == 0b10, r == 0b110:
+				disp = 2
+			}
+		default:
+			base := r
+			if r == instruction.ModRMSIB {
+				if i >= len(b) {
+					return ErrFailedEncode
+				}
+				base = b[i] & instruction.ModRMMask
+				add(PartSIB, 1, rm, "",
+					field("scale", 0, 6, 2, rm),
+					field("index", 0, 3, 3, rm),
+					field("base", 0, 0, 3, rm),
+				)
+			}
+			switch {
+			case mod == 0b01:
+				disp = 1
+			case mod == 0b10, base == instruction.ModRMRelative:
+				disp = 4
+			}
+		}
+		if disp > 0 {
+			if i+disp > len(b) {
+				return ErrFailedEncode
+			}
+			add(PartDisp, disp, rm, "")
+		}
+	}
+
+	for j := uint8(0); j < enc.Immediate.Len; j++ {
+		imm := &enc.Immediate.Val[j]
+		if i+imm.Size.Bytes() > len(b) {
+			return ErrFailedEncode
+		}
+		add(PartImm, imm.Size.Bytes(), argRef(imm.Value), "")
+	}
+
+	if v, m := enc.CodeOffset.Value.Value(); m == instruction.OptModeRef {
+		n := enc.CodeOffset.EncodedLen(args)
+		if call.Mode == Mode16 {
+			n = enc.CodeOffset.EncodedLen16(args)
+		}
+		if i+n > len(b) {
+			return ErrFailedEncode
+		}
+		add(PartRel, n, int(v), "")
+	}
+
+	if v, m := enc.DataOffset.Value.Value(); m == instruction.OptModeRef {
+		n := enc.DataOffset.Size.Bytes()
+		if call.Mode != Mode64 {
+			n = as.Bytes()
+		}
+		if i+n > len(b) {
+			return ErrFailedEncode
+		}
+		add(PartMoffs, n, int(v), "")
+	}
+
+	return x.done(i)
+}
+
+// done checks that the parts of x cover each of its n bytes.
+func (x *Explanation) done(n int) error {
+	if n != len(x.Bytes) {
+		return ErrFailedEncode
+	}
+	return nil
+}
+
+// argRef returns the argument that o refers to, or -1.
+func argRef(o interface {
+	Value() (uint8, instruction.OptMode)
+}) int {
+	if v, m := o.Value(); m == instruction.OptModeRef {
+		return int(v)
+	}
+	return -1
+}
+
+// memArg returns the index of the memory argument in args, or -1.
+func memArg(args []operand.Arg) int {
+	for i, arg := range args {
+		if _, ok := arg.(operand.Mem); ok {
+			return i
+		}
+	}
+	return -1
+}
+
+func legacyPrefix(b byte) bool {
+	switch b {
+	case 0x26, 0x2e, 0x36, 0x3e, 0x64, 0x65, 0x66, 0x67, 0xf0, 0xf2, 0xf3:
+		return true
+	}
+	return false
+}
+
+// segmentPrefixed reports whether b is the segment override of the memory
+// operand in args.
+func segmentPrefixed(args []operand.Arg, b byte) bool {
+	p, ok := segmentPrefix(args)
+	return ok && p == b
+}
+
+func mandatoryPrefix(enc *instruction.Encoding, b byte) bool {
+	for i := 0; i < int(enc.Prefix.Len); i++ {
+		if enc.Prefix.Val[i] == b && enc.Prefix.Mandatory(i) {
+			return true
+		}
+	}
+	return false
+}
+
+func prefixNote(b byte) string {
+	switch b {
+	case 0xf0:
+		return "LOCK"
+	case 0xf3:
+		return "REP"
+	case 0xf2:
+		return "REPNE"
+	case 0x3e:
+		return "branch taken"
+	case 0x2e:
+		return "branch not taken"
+	}
+	return ""
+}
+
+// opcodeMap describes the leading opcode bytes implied by a VEX prefix.
+func opcodeMap(enc *instruction.Encoding) string {
+	if enc.VEX.Type != instruction.VexTypeVEX {
+		return ""
+	}
+	m, _ := enc.VEX.Fmmmmm.Value()
+	switch m {
+	case 1:
+		return "implied 0f"
+	case 2:
+		return "implied 0f 38"
+	case 3:
+		return "implied 0f 3a"
+	}
+	return ""
+}
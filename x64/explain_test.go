@@ -0,0 +1,116 @@
+package x64
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	. "github.com/kalamay/x86/operand"
+)
+
+func TestExplain(t *testing.T) {
+	tests := []struct {
+		Mode  Mode
+		ID    InstructionID
+		Args  []Arg
+		Parts []PartKind
+		Lens  []int
+	}{
+		{Mode64, RET, nil, []PartKind{PartOpcode}, []int{1}},
+		{Mode64, MOV, []Arg{RBX, Int(123)},
+			[]PartKind{PartREX, PartOpcode, PartModRM, PartImm}, []int{1, 1, 1, 4}},
+		{Mode64, MOV, []Arg{R8, Mem{Base: RAX, Index: R9, Scale: Size64, Disp: 0x1000}},
+			[]PartKind{PartREX, PartOpcode, PartModRM, PartSIB, PartDisp}, []int{1, 1, 1, 1, 4}},
+		{Mode64, MOV, []Arg{EAX, Mem{Base: EBX, Segment: FS}},
+			[]PartKind{PartPrefix, PartPrefix, PartOpcode, PartModRM}, []int{1, 1, 1, 1}},
+		{Mode64, MOV, []Arg{EAX, Mem{Base: R13}},
+			[]PartKind{PartREX, PartOpcode, PartModRM, PartDisp}, []int{1, 1, 1, 1}},
+		{Mode64, MOV, []Arg{AL, Moffs(0x1122334455667788)},
+			[]PartKind{PartOpcode, PartMoffs}, []int{1, 8}},
+		{Mode64, VPAND, []Arg{YMM12, YMM13, YMM14},
+			[]PartKind{PartVEX, PartOpcode, PartModRM}, []int{3, 1, 1}},
+		{Mode64, PXOR, []Arg{XMM1, XMM2},
+			[]PartKind{PartPrefix, PartOpcode, PartModRM}, []int{1, 2, 1}},
+		{Mode32, DEC, []Arg{CX}, []PartKind{PartPrefix, PartOpcode}, []int{1, 1}},
+		{Mode32, MOV, []Arg{EAX, Abs(0x1000)}, []PartKind{PartOpcode, PartModRM, PartDisp}, []int{1, 1, 4}},
+		{Mode16, MOV, []Arg{AX, Mem{Base: BP}}, []PartKind{PartOpcode, PartModRM, PartDisp}, []int{1, 1, 1}},
+		{Mode16, MOV, []Arg{AX, Abs(0x7c00)}, []PartKind{PartOpcode, PartModRM, PartDisp}, []int{1, 1, 2}},
+	}
+
+	for i, test := range tests {
+		call := &EmitCall{Instruction: &Instructions.Instructions[test.ID], Args: test.Args, Mode: test.Mode}
+		x, err := Explain(call)
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		var parts []PartKind
+		var lens []int
+		for _, p := range x.Parts {
+			parts = append(parts, p.Kind)
+			lens = append(lens, len(p.Bytes))
+		}
+		if !reflect.DeepEqual(parts, test.Parts) || !reflect.DeepEqual(lens, test.Lens) {
+			t.Errorf("%d: expected %v %v, got %v %v", i, test.Parts, test.Lens, parts, lens)
+		}
+	}
+}
+
+func TestExplainFields(t *testing.T) {
+	// mov r8, [rax + r9*8 + 0x1000] is 4e 8b 84 c8 00 10 00 00.
+	call := &EmitCall{
+		Instruction: &Instructions.Instructions[MOV],
+		Args:        []Arg{R8, Mem{Base: RAX, Index: R9, Scale: Size64, Disp: 0x1000}},
+	}
+	x, err := Explain(call)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type field struct {
+		Name  string
+		Value uint8
+		Arg   int
+	}
+	expect := [][]field{
+		{{"W", 1, -1}, {"R", 1, 0}, {"X", 1, 1}, {"B", 0, 1}},
+		nil,
+		{{"mod", 0b10, 1}, {"reg", 0, 0}, {"rm", 0b100, 1}},
+		{{"scale", 0b11, 1}, {"index", 1, 1}, {"base", 0, 1}},
+		nil,
+	}
+	if len(x.Parts) != len(expect) {
+		t.Fatalf("expected %d parts, got %d", len(expect), len(x.Parts))
+	}
+	for i, p := range x.Parts {
+		var got []field
+		for _, f := range p.Fields {
+			got = append(got, field{f.Name, f.Value, f.Arg})
+		}
+		if !reflect.DeepEqual(got, expect[i]) {
+			t.Errorf("%s: expected %v, got %v", p.Kind, expect[i], got)
+		}
+	}
+	if p := x.Parts[4]; p.Arg != 1 || p.Offset != 4 {
+		t.Errorf("disp: expected arg 1 at 4, got arg %d at %d", p.Arg, p.Offset)
+	}
+}
+
+func TestExplainErrors(t *testing.T) {
+	tests := []struct {
+		ID   InstructionID
+		Args []Arg
+		Err  error
+	}{
+		{JMP, []Arg{Label("end")}, ErrLabelOperand},
+		{VADDPS, []Arg{ZMM1, ZMM2, ZMM3}, ErrEVEXUnsupported},
+		{VADDPS, []Arg{ZMM1.Mask(K1), ZMM2, Mem{Base: RAX}.Broadcast(16)}, ErrEVEXUnsupported},
+	}
+
+	for _, test := range tests {
+		call := &EmitCall{Instruction: &Instructions.Instructions[test.ID], Args: test.Args}
+		if _, err := Explain(call); !errors.Is(err, test.Err) {
+			t.Errorf("%s %v: expected %v, got %v", call.Name(), test.Args, test.Err, err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package x64
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/kalamay/x86/instruction"
+)
+
+// Flags is a set of bits in RFLAGS.
+type Flags uint8
+
+const (
+	FlagCF Flags = 1 << iota // Carry
+	FlagPF                   // Parity
+	FlagAF                   // Auxiliary carry
+	FlagZF                   // Zero
+	FlagSF                   // Sign
+	FlagOF                   // Overflow
+	FlagDF                   // Direction
+
+	FlagsStatus = FlagCF | FlagPF | FlagAF | FlagZF | FlagSF | FlagOF
+	FlagsAll    = FlagsStatus | FlagDF
+)
+
+func (f Flags) String() string {
+	if f == 0 {
+		return "none"
+	}
+	var b strings.Builder
+	for i, name := range [...]string{"CF", "PF", "AF", "ZF", "SF", "OF", "DF"} {
+		if f&(1<<i) != 0 {
+			if b.Len() > 0 {
+				b.WriteByte('|')
+			}
+			b.WriteString(name)
+		}
+	}
+	return b.String()
+}
+
+// FlagEffect describes how an instruction uses RFLAGS.
+type FlagEffect struct {
+	// Read are the flags the instruction depends on.
+	Read Flags
+	// Write are the flags the instruction always overwrites, including those
+	// left undefined.
+	Write Flags
+	// Maybe are the flags the instruction overwrites for some operands only,
+	// such as a shift by a count of zero leaving all flags unchanged.
+	Maybe Flags
+}
+
+// Writes returns every flag the instruction might change.
+func (fe FlagEffect) Writes() Flags {
+	return fe.Write | fe.Maybe
+}
+
+// FlagEffectOf returns the RFLAGS usage of in. Instructions that neither
+// read nor write any flags have a zero FlagEffect.
+//
+// The instruction data does not describe flags, so the effects come from a
+// table. An instruction missing from it is assumed to read every flag and
+// possibly write them, unless each of its forms is an SSE, AVX or MMX
+// operation, which leave RFLAGS alone apart from the comparisons listed.
+func FlagEffectOf(in *instruction.Instruction) FlagEffect {
+	flagEffectsOnce.Do(flagEffectsInit)
+	if fe, ok := flagEffects[in.Name]; ok {
+		return fe
+	}
+	if flagsNone[in.Name] || vectorOnly(in) {
+		return FlagEffect{}
+	}
+	return FlagEffect{Read: FlagsAll, Maybe: FlagsAll}
+}
+
+// vectorOnly reports whether every form of in operates on vector registers
+// in SSE, AVX or MMX state.
+func vectorOnly(in *instruction.Instruction) bool {
+	for i := range in.Forms {
+		f := &in.Forms[i]
+		if f.XmmMode == instruction.XmmModeNone && f.MmxMode != instruction.MmxModeMMX {
+			return false
+		}
+	}
+	return len(in.Forms) > 0
+}
+
+// flagsNone are the general purpose instructions that neither read nor
+// write any flags.
+var flagsNone = map[string]bool{
+	"MOV": true, "MOVZX": true, "MOVSX": true, "MOVSXD": true, "MOVBE": true,
+	"MOVNTI": true, "LEA": true, "XCHG": true, "BSWAP": true, "NOT": true,
+	"PUSH": true, "POP": true, "LEAVE": true, "RET": true, "JMP": true,
+	"CBW": true, "CWDE": true, "CDQE": true, "CWD": true, "CDQ": true, "CQO": true,
+	"SHLX": true, "SHRX": true, "SARX": true, "RORX": true, "MULX": true,
+	"PDEP": true, "PEXT": true, "CRC32": true,
+	"NOP": true, "PAUSE": true, "UD2": true, "INT": true, "CPUID": true,
+	"RDTSC": true, "RDTSCP": true, "LFENCE": true, "MFENCE": true, "SFENCE": true,
+	"PREFETCHNTA": true, "PREFETCHT0": true, "PREFETCHT1": true,
+	"PREFETCHT2": true, "PREFETCHW": true, "CLFLUSH": true, "CLFLUSHOPT": true,
+	"JECXZ": true, "JRCXZ": true, "LOOP": true,
+}
+
+var flagEffects = map[string]FlagEffect{
+	"ADD": {Write: FlagsStatus},
+	"SUB": {Write: FlagsStatus},
+	"CMP": {Write: FlagsStatus},
+	"NEG": {Write: FlagsStatus},
+	"AND": {Write: FlagsStatus},
+	"OR":  {Write: FlagsStatus},
+	"XOR": {Write: FlagsStatus},
+	"ADC": {Read: FlagCF, Write: FlagsStatus},
+	"SBB": {Read: FlagCF, Write: FlagsStatus},
+
+	"TEST":   {Write: FlagsStatus},
+	"INC":    {Write: FlagsStatus &^ FlagCF},
+	"DEC":    {Write: FlagsStatus &^ FlagCF},
+	"MUL":    {Write: FlagsStatus},
+	"IMUL":   {Write: FlagsStatus},
+	"DIV":    {Write: FlagsStatus},
+	"IDIV":   {Write: FlagsStatus},
+	"XADD":   {Write: FlagsStatus},
+	"ADCX":   {Read: FlagCF, Write: FlagCF},
+	"ADOX":   {Read: FlagOF, Write: FlagOF},
+	"RDRAND": {Write: FlagsStatus},
+	"RDSEED": {Write: FlagsStatus},
+
+	"SHL":  {Maybe: FlagsStatus},
+	"SAL":  {Maybe: FlagsStatus},
+	"SHR":  {Maybe: FlagsStatus},
+	"SAR":  {Maybe: FlagsStatus},
+	"SHLD": {Maybe: FlagsStatus},
+	"SHRD": {Maybe: FlagsStatus},
+	"ROL":  {Maybe: FlagCF | FlagOF},
+	"ROR":  {Maybe: FlagCF | FlagOF},
+	"RCL":  {Read: FlagCF, Maybe: FlagCF | FlagOF},
+	"RCR":  {Read: FlagCF, Maybe: FlagCF | FlagOF},
+
+	"BT":     {Write: FlagsStatus &^ FlagZF},
+	"BTC":    {Write: FlagsStatus &^ FlagZF},
+	"BTR":    {Write: FlagsStatus &^ FlagZF},
+	"BTS":    {Write: FlagsStatus &^ FlagZF},
+	"BSF":    {Write: FlagsStatus},
+	"BSR":    {Write: FlagsStatus},
+	"LZCNT":  {Write: FlagsStatus},
+	"TZCNT":  {Write: FlagsStatus},
+	"POPCNT": {Write: FlagsStatus},
+	"ANDN":   {Write: FlagsStatus},
+	"BEXTR":  {Write: FlagsStatus},
+	"BLSI":   {Write: FlagsStatus},
+	"BLSMSK": {Write: FlagsStatus},
+	"BLSR":   {Write: FlagsStatus},
+	"BZHI":   {Write: FlagsStatus},
+
+	"CMPXCHG":    {Write: FlagsStatus},
+	"CMPXCHG8B":  {Write: FlagZF},
+	"CMPXCHG16B": {Write: FlagZF},
+
+	"CMPSB": {Read: FlagDF, Write: FlagsStatus},
+	"CMPSW": {Read: FlagDF, Write: FlagsStatus},
+	"CMPSQ": {Read: FlagDF, Write: FlagsStatus},
+	"SCASB": {Read: FlagDF, Write: FlagsStatus},
+	"SCASW": {Read: FlagDF, Write: FlagsStatus},
+	"SCASD": {Read: FlagDF, Write: FlagsStatus},
+	"SCASQ": {Read: FlagDF, Write: FlagsStatus},
+	"MOVSB": {Read: FlagDF},
+	"MOVSW": {Read: FlagDF},
+	"MOVSQ": {Read: FlagDF},
+	"STOSB": {Read: FlagDF},
+	"STOSW": {Read: FlagDF},
+	"STOSD": {Read: FlagDF},
+	"STOSQ": {Read: FlagDF},
+	"LODSB": {Read: FlagDF},
+	"LODSW": {Read: FlagDF},
+	"LODSD": {Read: FlagDF},
+	"LODSQ": {Read: FlagDF},
+
+	"COMISS":   {Write: FlagsStatus},
+	"COMISD":   {Write: FlagsStatus},
+	"UCOMISS":  {Write: FlagsStatus},
+	"UCOMISD":  {Write: FlagsStatus},
+	"VCOMISS":  {Write: FlagsStatus},
+	"VCOMISD":  {Write: FlagsStatus},
+	"VUCOMISS": {Write: FlagsStatus},
+	"VUCOMISD": {Write: FlagsStatus},
+	"PTEST":    {Write: FlagsStatus},
+	"VPTEST":   {Write: FlagsStatus},
+	"VTESTPS":  {Write: FlagsStatus},
+	"VTESTPD":  {Write: FlagsStatus},
+	"KORTESTB": {Write: FlagsStatus},
+	"KORTESTW": {Write: FlagsStatus},
+	"KORTESTD": {Write: FlagsStatus},
+	"KORTESTQ": {Write: FlagsStatus},
+	"KTESTB":   {Write: FlagsStatus},
+	"KTESTW":   {Write: FlagsStatus},
+	"KTESTD":   {Write: FlagsStatus},
+	"KTESTQ":   {Write: FlagsStatus},
+
+	"CLC":   {Write: FlagCF},
+	"STC":   {Write: FlagCF},
+	"CMC":   {Read: FlagCF, Write: FlagCF},
+	"CLD":   {Write: FlagDF},
+	"STD":   {Write: FlagDF},
+	"SAHF":  {Write: FlagsStatus &^ FlagOF},
+	"LAHF":  {Read: FlagsStatus &^ FlagOF},
+	"PUSHF": {Read: FlagsAll},
+	"POPF":  {Write: FlagsAll},
+
+	// Flags are not preserved across calls.
+	"CALL": {Write: FlagsStatus},
+
+	"LOOPE":  {Read: FlagZF},
+	"LOOPZ":  {Read: FlagZF},
+	"LOOPNE": {Read: FlagZF},
+	"LOOPNZ": {Read: FlagZF},
+}
+
+// conditions maps each condition code suffix to the flags it tests.
+var conditions = map[string]Flags{
+	"O": FlagOF, "NO": FlagOF,
+	"B": FlagCF, "C": FlagCF, "NAE": FlagCF,
+	"AE": FlagCF, "NB": FlagCF, "NC": FlagCF,
+	"E": FlagZF, "Z": FlagZF, "NE": FlagZF, "NZ": FlagZF,
+	"BE": FlagCF | FlagZF, "NA": FlagCF | FlagZF,
+	"A": FlagCF | FlagZF, "NBE": FlagCF | FlagZF,
+	"S": FlagSF, "NS": FlagSF,
+	"P": FlagPF, "PE": FlagPF, "NP": FlagPF, "PO": FlagPF,
+	"L": FlagSF | FlagOF, "NGE": FlagSF | FlagOF,
+	"GE": FlagSF | FlagOF, "NL": FlagSF | FlagOF,
+	"LE": FlagZF | FlagSF | FlagOF, "NG": FlagZF | FlagSF | FlagOF,
+	"G": FlagZF | FlagSF | FlagOF, "NLE": FlagZF | FlagSF | FlagOF,
+}
+
+var flagEffectsOnce sync.Once
+
+func flagEffectsInit() {
+	for cc, f := range conditions {
+		for _, prefix := range [...]string{"J", "SET", "CMOV"} {
+			flagEffects[prefix+cc] = FlagEffect{Read: f}
+		}
+	}
+}
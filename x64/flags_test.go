@@ -0,0 +1,30 @@
+package x64
+
+import (
+	"testing"
+
+	"github.com/kalamay/x86/instruction"
+)
+
+func TestFlagEffectOf(t *testing.T) {
+	sse := []instruction.Form{{XmmMode: instruction.XmmModeSSE}}
+	gp := []instruction.Form{{}}
+
+	tests := []struct {
+		In     instruction.Instruction
+		Expect FlagEffect
+	}{
+		{instruction.Instruction{Name: "ADC", Forms: gp}, FlagEffect{Read: FlagCF, Write: FlagsStatus}},
+		{instruction.Instruction{Name: "JNE", Forms: gp}, FlagEffect{Read: FlagZF}},
+		{instruction.Instruction{Name: "MOV", Forms: gp}, FlagEffect{}},
+		{instruction.Instruction{Name: "PADDD", Forms: sse}, FlagEffect{}},
+		{instruction.Instruction{Name: "UNKNOWN", Forms: gp}, FlagEffect{Read: FlagsAll, Maybe: FlagsAll}},
+		{instruction.Instruction{Name: "UNKNOWN"}, FlagEffect{Read: FlagsAll, Maybe: FlagsAll}},
+	}
+
+	for _, test := range tests {
+		if fe := FlagEffectOf(&test.In); fe != test.Expect {
+			t.Errorf("%s: expect %+v, actual %+v", test.In.Name, test.Expect, fe)
+		}
+	}
+}
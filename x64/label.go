@@ -0,0 +1,130 @@
+package x64
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kalamay/x86/operand"
+)
+
+// labelScope gives unique names to the labels that may be defined more than
+// once: local labels, which start with a '.' and belong to the preceding
+// global label, and numeric labels, such as "1", which are referred to as
+// "1f" for the next definition and "1b" for the previous one.
+type labelScope struct {
+	global  string
+	numeric map[string]int
+}
+
+func (s *labelScope) reset() {
+	s.global = ""
+	for k := range s.numeric {
+		delete(s.numeric, k)
+	}
+}
+
+// define returns the unique name of a label definition.
+func (s *labelScope) define(name string) string {
+	switch {
+	case isLocalLabel(name):
+		return s.global + name
+	case isNumericLabel(name):
+		if s.numeric == nil {
+			s.numeric = map[string]int{}
+		}
+		n := s.numeric[name]
+		s.numeric[name] = n + 1
+		return numericName(name, n)
+	}
+	s.global = name
+	return name
+}
+
+// resolve returns the unique name of a label reference, or false if it is a
+// backward reference to a label that is not defined.
+func (s *labelScope) resolve(name string) (string, bool) {
+	if isLocalLabel(name) {
+		return s.global + name, true
+	}
+	if n := len(name) - 1; n > 0 && isNumericLabel(name[:n]) {
+		switch name[n] {
+		case 'f':
+			return numericName(name[:n], s.numeric[name[:n]]), true
+		case 'b':
+			if i := s.numeric[name[:n]]; i > 0 {
+				return numericName(name[:n], i-1), true
+			}
+			return name, false
+		}
+	}
+	return name, true
+}
+
+// label returns label under its unique name. The label is copied rather
+// than renamed in place.
+func (s *labelScope) label(label *EmitLabel) *EmitLabel {
+	name := s.define(label.Name())
+	if name == label.Name() {
+		return label
+	}
+	l := *label
+	l.Value = name
+	return &l
+}
+
+// call returns a copy of call that refers to each label by its unique name.
+// The arguments of call are left as they were, and a call without labels is
+// returned as is.
+func (s *labelScope) call(call *EmitCall) (*EmitCall, error) {
+	var args []operand.Arg
+	for i, arg := range call.Args {
+		if arg, ok := arg.(operand.Label); ok {
+			name, ok := s.resolve(string(arg))
+			if !ok {
+				return nil, fmt.Errorf("symbol %q is not defined", arg)
+			}
+			if args == nil {
+				args = append([]operand.Arg(nil), call.Args...)
+			}
+			args[i] = operand.Label(name)
+		}
+	}
+	if args == nil {
+		return call, nil
+	}
+	c := *call
+	c.Args = args
+	return &c, nil
+}
+
+// numericName is the unique name of the i'th definition of a numeric label.
+// The name uses a character that is not valid in labels of the source.
+func numericName(name string, i int) string {
+	return name + "#" + strconv.Itoa(i)
+}
+
+// referenceName returns the name of a label as it was written in a forward
+// reference.
+func referenceName(name string) string {
+	if i := strings.IndexByte(name, '#'); i > 0 && isNumericLabel(name[:i]) {
+		return name[:i] + "f"
+	}
+	return name
+}
+
+func isLocalLabel(name string) bool {
+	return len(name) > 1 && name[0] == '.' && name[1] != '.'
+}
+
+func isNumericLabel(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package x64
+
+import (
+	"github.com/kalamay/x86/operand"
+)
+
+// Length returns the number of bytes that call encodes to, computed from the
+// encoding of the selected form rather than by encoding it. A label argument
+// has no known offset, so any form that takes a relative offset may be
+// chosen for it. Then min and max are the lengths of the shortest and the
+// longest of those forms, which for a jump are the rel8 and rel32 forms.
+// Otherwise, min and max are the same.
+func Length(call *EmitCall) (min, max int, err error) {
+	return Policy(nil).Length(call)
+}
+
+// Length is the package Length with p choosing the encoding of each form.
+func (p Policy) Length(call *EmitCall) (min, max int, err error) {
+	n := bitsSet(call.Prefix)
+	if call.Instruction == DataInstruction {
+		if d, ok := call.Args[0].(operand.Data); ok {
+			return n + len(d), n + len(d), nil
+		}
+		return 0, 0, ErrFailedEncode
+	}
+
+	label := false
+	for _, arg := range call.Args {
+		switch arg := arg.(type) {
+		case operand.VReg:
+			return 0, 0, ErrVirtualReg
+		case operand.Label:
+			label = true
+		default:
+			if err = arg.Validate(); err != nil {
+				return 0, 0, err
+			}
+			if call.Mode != Mode64 {
+				if err = call.Mode.check(arg); err != nil {
+					return 0, 0, err
+				}
+			}
+		}
+	}
+
+	if !label {
+		l, err := p.length(call)
+		return n + l, n + l, err
+	}
+
+	as, err := call.Mode.addrSize(call.Args)
+	if err != nil {
+		return 0, 0, err
+	}
+	for i := range call.Instruction.Forms {
+		f := &call.Instruction.Forms[i]
+		if !matchOperands(f.Operands, call.Args) {
+			continue
+		}
+		l, enc := n, p.encoding(f, call.Args)
+		if call.Mode == Mode64 {
+			l += enc.EncodedLen(call.Args)
+		} else if enc.REX.EncodedLen(call.Args) == 0 {
+			l += modeLen(call.Mode, call.Instruction, f, enc, call.Args, false, as)
+		} else {
+			continue
+		}
+		if min == 0 || l < min {
+			min = l
+		}
+		if l > max {
+			max = l
+		}
+	}
+	if max == 0 {
+		return 0, 0, ErrUnsupportedInstruction
+	}
+	return min, max, nil
+}
+
+// length returns the length of call without its prefixes, which has no
+// label arguments.
+func (p Policy) length(call *EmitCall) (int, error) {
+	if call.Mode != Mode64 {
+		form, enc, args, widened, as, err := selectMode(call, p)
+		if err != nil {
+			return 0, err
+		}
+		return modeLen(call.Mode, call.Instruction, form, enc, args, widened, as), nil
+	}
+	if err := check16(call.Args); err != nil {
+		return 0, err
+	}
+	enc, err := p.Select(call.Instruction, call.Args)
+	if err != nil {
+		return 0, err
+	}
+	return enc.EncodedLen(call.Args), nil
+}
@@ -0,0 +1,83 @@
+package x64
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/kalamay/x86/operand"
+)
+
+func TestLength(t *testing.T) {
+	tests := []struct {
+		Mode Mode
+		ID   InstructionID
+		Args []Arg
+	}{
+		{Mode64, RET, nil},
+		{Mode64, MOV, []Arg{RBX, Int(123)}},
+		{Mode64, MOV, []Arg{BX, Int(123)}},
+		{Mode64, MOV, []Arg{RAX, Mem{Base: RSP, Disp: 8}}},
+		{Mode64, MOV, []Arg{EAX, Mem{Base: R13}}},
+		{Mode64, MOV, []Arg{R8, Mem{Base: RAX, Index: R9, Scale: Size64, Disp: 0x1000}}},
+		{Mode64, MOV, []Arg{EAX, Mem{Base: EBX, Segment: FS}}},
+		{Mode64, MOV, []Arg{EAX, Abs(0x1000)}},
+		{Mode64, MOV, []Arg{AL, Moffs(0x1122334455667788)}},
+		{Mode64, ADD, []Arg{Mem{Base: RAX, Size: Size32}, Int(1)}},
+		{Mode64, VPAND, []Arg{XMM0, XMM1, XMM2}},
+		{Mode64, VPAND, []Arg{YMM12, YMM13, YMM14}},
+		{Mode32, PUSH, []Arg{EBP}},
+		{Mode32, DEC, []Arg{CX}},
+		{Mode32, MOV, []Arg{AL, Mem{Base: BX, Index: SI, Scale: 1}}},
+		{Mode32, MOV, []Arg{AL, Moffs(0x80000000)}},
+		{Mode32, MOV, []Arg{EAX, Abs(0x1000)}},
+		{Mode16, MOV, []Arg{EAX, Int(1)}},
+		{Mode16, MOV, []Arg{AX, Mem{Base: BP}}},
+		{Mode16, MOV, []Arg{AX, Abs(0x7c00)}},
+		{Mode16, MOV, []Arg{AX, Mem{Base: EBX}}},
+	}
+
+	buf := bytes.Buffer{}
+	e := Emit{}
+	for i, test := range tests {
+		call := &EmitCall{Instruction: &Instructions.Instructions[test.ID], Args: test.Args, Mode: test.Mode}
+		min, max, err := Length(call)
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+
+		buf.Reset()
+		e.Open(NewMachine(), &buf)
+		e.EmitCall(call)
+		for _, err := range e.Close() {
+			t.Errorf("%d: %v", i, err)
+		}
+		if min != buf.Len() || max != buf.Len() {
+			t.Errorf("%d: expected %d, got %d-%d", i, buf.Len(), min, max)
+		}
+	}
+
+	labels := []struct {
+		Mode     Mode
+		ID       InstructionID
+		Min, Max int
+	}{
+		{Mode64, JMP, 2, 5},
+		{Mode64, JE, 2, 6},
+		{Mode64, CALL, 5, 5},
+		{Mode16, JMP, 2, 3},
+		{Mode16, JNE, 2, 4},
+	}
+	for _, test := range labels {
+		call := &EmitCall{Instruction: &Instructions.Instructions[test.ID], Args: []Arg{Label("a")}, Mode: test.Mode}
+		min, max, err := Length(call)
+		if err != nil || min != test.Min || max != test.Max {
+			t.Errorf("%s %v: expected %d-%d, got %d-%d, %v", call.Name(), test.Mode, test.Min, test.Max, min, max, err)
+		}
+	}
+
+	call := &EmitCall{Instruction: &Instructions.Instructions[MOV], Args: []Arg{RAX, RBX}, Mode: Mode32}
+	if _, _, err := Length(call); err != ErrModeOperand {
+		t.Errorf("expected %v, got %v", ErrModeOperand, err)
+	}
+}
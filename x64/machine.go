@@ -12,13 +12,24 @@ var (
 	ErrInstLength     = errors.New("instruction length exceeded 15 bytes")
 	ErrFailedEncode   = errors.New("unable to encode instruction")
 	ErrSymbolDefinied = errors.New("symbol already defined")
+	ErrVirtualReg     = errors.New("virtual register has not been allocated")
+
+	ErrEVEXUnsupported         = errors.New("EVEX encoding is not supported")
+	ErrRegisterByteUnsupported = errors.New("register operand in an immediate byte is not supported")
 )
 
+// Machine is an Emitter that encodes instructions and resolves labels.
+// Besides global labels, it accepts local labels, which start with a '.' and
+// belong to the preceding global label, and numeric labels, which may be
+// defined any number of times and are referred to as "1f" or "1b" for the
+// next or previous definition of "1".
 type Machine struct {
 	labels  map[string]int
+	scope   labelScope
 	pending []pending
 	encoded []instruction.Format
 	written int
+	policy  Policy
 }
 
 type pending struct {
@@ -32,16 +43,29 @@ func NewMachine() *Machine {
 	}
 }
 
+// SetPolicy sets the policy that chooses among the encodings of a form. The
+// default, nil, uses the preferred encoding of each form.
+func (m *Machine) SetPolicy(p Policy) { m.policy = p }
+
 func (m *Machine) Open() {
 	for k := range m.labels {
 		delete(m.labels, k)
 	}
+	m.scope.reset()
 	m.pending = m.pending[:0]
 	m.encoded = m.encoded[:0]
 	m.written = 0
 }
 
 func (m *Machine) Emit(e *Emit, call *EmitCall) {
+	// A call with labels is copied, as ready replaces them with offsets.
+	scoped, err := m.scope.call(call)
+	if err != nil {
+		e.AddError(err, call)
+		return
+	}
+	call = scoped
+
 	id := len(m.encoded)
 	m.encoded = append(m.encoded, instruction.Format{})
 
@@ -57,7 +81,7 @@ func (m *Machine) Emit(e *Emit, call *EmitCall) {
 }
 
 func (m *Machine) Label(e *Emit, label *EmitLabel) {
-	name := label.Name()
+	name := m.scope.define(label.Name())
 	if _, ok := m.labels[name]; ok {
 		e.AddError(ErrSymbolDefinied, label)
 		return
@@ -102,7 +126,7 @@ func (m *Machine) Close(e *Emit) {
 		if label == "" {
 			e.AddError(ErrFailedEncode, m.pending[0].call)
 		} else {
-			e.AddError(fmt.Errorf("symbol %q is not defined", label), m.pending[0].call)
+			e.AddError(fmt.Errorf("symbol %q is not defined", referenceName(label)), m.pending[0].call)
 		}
 	}
 }
@@ -129,11 +153,43 @@ func (m *Machine) encode(id int, call *EmitCall) error {
 		return nil
 	}
 
-	enc, err := Select(call.Instruction, call.Args)
+	if call.Prefix != 0 {
+		if call.Instruction == DataInstruction {
+			return ErrPrefixInvalid
+		}
+		if err := call.Prefix.Check(call.Instruction, call.Args); err != nil {
+			return err
+		}
+	}
+
+	if call.Instruction == DataInstruction {
+		d, ok := call.Args[0].(operand.Data)
+		if !ok || len(d) == 0 || len(d) > maxData {
+			return ErrFailedEncode
+		}
+		m.encoded[id].Len = uint8(copy(m.encoded[id].Val[:], d))
+		return nil
+	}
+
+	for _, arg := range call.Args {
+		if _, ok := arg.(operand.VReg); ok {
+			return ErrVirtualReg
+		}
+	}
+
+	if call.Mode != Mode64 {
+		return encodeMode(&m.encoded[id], call, m.policy)
+	}
+	if err := check16(call.Args); err != nil {
+		return err
+	}
+
+	enc, err := m.policy.Select(call.Instruction, call.Args)
 	if err != nil {
 		return err
 	}
 
+	call.Prefix.Encode(&m.encoded[id])
 	enc.Prefix.Encode(&m.encoded[id], call.Args)
 	switch {
 	case enc.EVEX.Encode(&m.encoded[id], call.Args):
@@ -150,6 +206,19 @@ func (m *Machine) encode(id int, call *EmitCall) error {
 	return nil
 }
 
+// Offset returns the number of bytes emitted so far. It is not known while
+// an instruction waits for a label.
+func (m *Machine) Offset() (int, bool) {
+	if len(m.pending) > 0 {
+		return 0, false
+	}
+	n := 0
+	for i := range m.encoded {
+		n += int(m.encoded[i].Len)
+	}
+	return n, true
+}
+
 func (m *Machine) write(e *Emit, id int) {
 	e.Write(m.encoded[id].Bytes())
 	m.written++
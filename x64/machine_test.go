@@ -2,6 +2,7 @@ package x64
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 
 	. "github.com/kalamay/x86/operand"
@@ -40,6 +41,202 @@ func TestMachine(t *testing.T) {
 	}
 }
 
+func TestMachineLabels(t *testing.T) {
+	buf := bytes.Buffer{}
+	e := Emit{}
+
+	e.Open(NewMachine(), &buf)
+	e.Label("f")
+	e.Label(".loop")
+	e.DEC(ECX)
+	e.JNE(Label(".loop"))
+	e.Label("1")
+	e.DEC(ECX)
+	e.JNE(Label("1b"))
+	e.JMP(Label("1f"))
+	e.NOP()
+	e.Label("1")
+	e.Label("g")
+	e.Label(".loop")
+	e.JMP(Label(".loop"))
+	for _, err := range e.Close() {
+		t.Error(err)
+	}
+
+	expect := [...]byte{
+		0xff, 0xc9,
+		0x75, 0xfc,
+		0xff, 0xc9,
+		0x75, 0xfc,
+		0xeb, 0x01,
+		0x90,
+		0xeb, 0xfe,
+	}
+	if !bytes.Equal(expect[:], buf.Bytes()) {
+		t.Errorf("failed to encode:\n\texpect = %#v\n\tactual = %#v", expect[:], buf.Bytes())
+	}
+
+	// The calls are encoded without changing their arguments.
+	call := NewCall(JMP, Label(".end"))
+	e.Open(NewMachine(), &buf)
+	e.Label("h")
+	e.EmitCall(call)
+	e.Label(".end")
+	for _, err := range e.Close() {
+		t.Error(err)
+	}
+	if call.Args[0] != Label(".end") {
+		t.Errorf("expected the label argument to be kept, got %v", call.Args[0])
+	}
+
+	for _, label := range []string{"2b", "2f"} {
+		e.Open(NewMachine(), &buf)
+		e.JMP(Label(label))
+		if errs := e.Close(); len(errs) != 1 {
+			t.Errorf("expected an error for %q, got %v", label, errs)
+		}
+	}
+}
+
+func TestMachinePrefix(t *testing.T) {
+	buf := bytes.Buffer{}
+	e := Emit{}
+
+	e.Open(NewMachine(), &buf)
+	e.Label("a")
+	e.Lock()
+	e.ADD(Mem{Base: RAX, Size: Size32}, Int(1))
+	e.Rep()
+	e.MOVSB()
+	e.Unlikely()
+	e.JNE(Label("a"))
+	e.Likely()
+	e.JE(Label("b"))
+	e.NOP()
+	e.Label("b")
+	for _, err := range e.Close() {
+		t.Error(err)
+	}
+
+	expect := [...]byte{
+		0xf0, 0x83, 0x00, 0x01,
+		0xf3, 0xa4,
+		0x2e, 0x75, 0xf7,
+		0x3e, 0x74, 0x01,
+		0x90,
+	}
+	if !bytes.Equal(expect[:], buf.Bytes()) {
+		t.Errorf("failed to encode:\n\texpect = %#v\n\tactual = %#v", expect[:], buf.Bytes())
+	}
+
+	invalid := []struct {
+		Emit func()
+		Err  error
+	}{
+		{func() { e.Lock(); e.MOV(Mem{Base: RAX, Size: Size32}, Int(1)) }, ErrLockInvalid},
+		{func() { e.Lock(); e.ADD(EAX, Int(1)) }, ErrLockInvalid},
+		{func() { e.Rep(); e.NOP() }, ErrRepInvalid},
+		{func() { e.Likely(); e.JMP(Label("a")) }, ErrHintInvalid},
+		{func() { e.Lock(); e.Rep(); e.MOVSB() }, ErrPrefixInvalid},
+	}
+	for i, test := range invalid {
+		e.Open(NewMachine(), &buf)
+		e.Label("a")
+		test.Emit()
+		if errs := e.Close(); len(errs) != 1 || !errors.Is(errs[0], test.Err) {
+			t.Errorf("%d: expected %v, got %v", i, test.Err, errs)
+		}
+	}
+}
+
+func TestMachineMode(t *testing.T) {
+	buf := bytes.Buffer{}
+	e := Emit{}
+
+	e.Open(NewMachine(), &buf)
+	e.SetMode(Mode32)
+	e.MOV(EAX, EBX)
+	e.MOV(AX, BX)
+	e.INC(EAX)
+	e.DEC(CX)
+	e.PUSH(EBP)
+	e.POP(EBP)
+	e.MOV(EAX, Mem{Base: EBX, Disp: 4})
+	e.MOV(AL, Mem{Base: BX, Index: SI, Scale: 1})
+	e.ADD(Mem{Base: EAX, Size: Size32}, Int(1))
+	e.MOV(EAX, Abs(0x1000))
+	e.PXOR(XMM1, XMM2)
+	e.SetMode(Mode16)
+	e.MOV(AX, BX)
+	e.MOV(EAX, EBX)
+	e.INC(AX)
+	e.INC(EAX)
+	e.PUSH(AX)
+	e.PUSH(EAX)
+	e.MOV(AX, Mem{Base: BP})
+	e.MOV(AX, Mem{Base: BX, Index: SI, Scale: 1, Disp: 0x10})
+	e.MOV(AX, Mem{Base: SI, Disp: 0x1234})
+	e.MOV(AX, Abs(0x7c00))
+	e.MOV(AX, Mem{Base: EBX})
+	e.MOVZX(EAX, BL)
+	e.PXOR(XMM1, XMM2)
+	for _, err := range e.Close() {
+		t.Error(err)
+	}
+
+	expect := [...]byte{
+		0x89, 0xd8,
+		0x66, 0x89, 0xd8,
+		0x40,
+		0x66, 0x49,
+		0x55,
+		0x5d,
+		0x8b, 0x43, 0x04,
+		0x67, 0x8a, 0x00,
+		0x83, 0x00, 0x01,
+		0x8b, 0x05, 0x00, 0x10, 0x00, 0x00,
+		0x66, 0x0f, 0xef, 0xca,
+
+		0x89, 0xd8,
+		0x66, 0x89, 0xd8,
+		0x40,
+		0x66, 0x40,
+		0x50,
+		0x66, 0x50,
+		0x8b, 0x46, 0x00,
+		0x8b, 0x40, 0x10,
+		0x8b, 0x84, 0x34, 0x12,
+		0x8b, 0x06, 0x00, 0x7c,
+		0x67, 0x8b, 0x03,
+		0x66, 0x0f, 0xb6, 0xc3,
+		0x66, 0x0f, 0xef, 0xca,
+	}
+	if !bytes.Equal(expect[:], buf.Bytes()) {
+		t.Errorf("failed to encode:\n\texpect = %#v\n\tactual = %#v", expect[:], buf.Bytes())
+	}
+
+	invalid := []struct {
+		Mode Mode
+		Emit func()
+		Err  error
+	}{
+		{Mode32, func() { e.MOV(RAX, RBX) }, ErrModeOperand},
+		{Mode32, func() { e.MOV(R8D, EAX) }, ErrModeRegister},
+		{Mode32, func() { e.MOV(SIL, AL) }, ErrModeRegister},
+		{Mode32, func() { e.MOV(EAX, Mem{Base: RAX}) }, ErrModeAddress},
+		{Mode16, func() { e.MOV(AX, Mem{Base: BX, Index: BP, Scale: 1}) }, ErrUnsupportedIndex},
+		{Mode64, func() { e.MOV(AX, Mem{Base: BX}) }, ErrModeAddress},
+	}
+	for i, test := range invalid {
+		e.Open(NewMachine(), &buf)
+		e.SetMode(test.Mode)
+		test.Emit()
+		if errs := e.Close(); len(errs) != 1 || !errors.Is(errs[0], test.Err) {
+			t.Errorf("%d: expected %v, got %v", i, test.Err, errs)
+		}
+	}
+}
+
 func BenchmarkMachine(b *testing.B) {
 	buf := bytes.Buffer{}
 	e := Emit{}
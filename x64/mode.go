@@ -0,0 +1,378 @@
+package x64
+
+import (
+	"errors"
+	"math"
+
+	"github.com/kalamay/x86/instruction"
+	"github.com/kalamay/x86/operand"
+)
+
+var (
+	ErrModeRegister = errors.New("register is only available in 64-bit mode")
+	ErrModeOperand  = errors.New("64-bit operand is only available in 64-bit mode")
+	ErrModeAddress  = errors.New("address is not available in this mode")
+)
+
+// Mode is the processor mode that instructions are encoded for.
+type Mode uint8
+
+const (
+	Mode64 Mode = iota // long mode, the default
+	Mode32             // protected mode
+	Mode16             // real mode
+)
+
+func (m Mode) String() string {
+	switch m {
+	case Mode32:
+		return "32-bit"
+	case Mode16:
+		return "16-bit"
+	}
+	return "64-bit"
+}
+
+// Bits returns the default address size of m in bits.
+func (m Mode) Bits() int {
+	return m.size().Bits()
+}
+
+func (m Mode) size() operand.Size {
+	switch m {
+	case Mode32:
+		return operand.Size32
+	case Mode16:
+		return operand.Size16
+	}
+	return operand.Size64
+}
+
+// check returns an error if arg may not be used in m, which is either
+// Mode32 or Mode16.
+func (m Mode) check(arg operand.Arg) error {
+	switch arg := arg.(type) {
+	case operand.Reg:
+		return checkModeReg(arg)
+	case operand.Mem:
+		for _, r := range [2]operand.Reg{arg.Base, arg.Index} {
+			switch {
+			case r == 0:
+			case r.Type() == operand.RegTypeIP,
+				r.Type() == operand.RegTypeGeneral && r.Size() == operand.Size64:
+				return ErrModeAddress
+			case checkModeReg(r) != nil:
+				return ErrModeRegister
+			}
+		}
+	}
+	return nil
+}
+
+// checkModeReg returns an error if r requires a REX or EVEX prefix to
+// encode, or is a 64-bit general register.
+func checkModeReg(r operand.Reg) error {
+	switch {
+	case r.Next8(), r.Next16(), r.Type() == operand.RegTypeIP:
+		return ErrModeRegister
+	case r.Type() != operand.RegTypeGeneral:
+	case r.Size() == operand.Size64:
+		return ErrModeOperand
+	case r.Size() == operand.Size8 && !r.HighByte() && r.ID() >= 4:
+		// spl, bpl, sil and dil replace ah, ch, dh and bh with a REX prefix.
+		return ErrModeRegister
+	}
+	return nil
+}
+
+// addrSize returns the address size of the memory operand in args, or the
+// default of m if there is none.
+func (m Mode) addrSize(args []operand.Arg) (operand.Size, error) {
+	for _, arg := range args {
+		mem, ok := arg.(operand.Mem)
+		if !ok {
+			continue
+		}
+		switch {
+		case mem.Type == operand.MemTypeOffset:
+			if mem.Addr > math.MaxUint32 {
+				return 0, ErrModeAddress
+			}
+			if m == Mode16 && mem.Addr > math.MaxUint16 {
+				return operand.Size32, nil
+			}
+		case mem.Base != 0:
+			return mem.Base.Size(), nil
+		case mem.Index != 0 && !mem.VSIB():
+			return mem.Index.Size(), nil
+		case mem.Index == 0 && m == Mode16:
+			if mem.Disp < math.MinInt16 || math.MaxUint16 < mem.Disp {
+				return operand.Size32, nil
+			}
+		}
+		break
+	}
+	return m.size(), nil
+}
+
+// widen returns a copy of args with each 32-bit general register and
+// memory operand made 64-bit. Outside of 64-bit mode, the forms that default
+// to a 64-bit operand, such as PUSH and POP, take a 32-bit one instead.
+func widen(args []operand.Arg) ([]operand.Arg, bool) {
+	wide, ok := make([]operand.Arg, len(args)), false
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case operand.Reg:
+			if arg.Type() == operand.RegTypeGeneral && arg.Size() == operand.Size32 {
+				wide[i], ok = operand.MakeReg(arg.ID(), operand.RegTypeGeneral, operand.Size64), true
+				continue
+			}
+		case operand.Mem:
+			if arg.Size == operand.Size32 {
+				wide[i], ok = arg.Sized(operand.Size64), true
+				continue
+			}
+		}
+		wide[i] = arg
+	}
+	return wide, ok
+}
+
+// operandPrefix reports whether f needs an operand-size prefix in m. The
+// forms are those of 64-bit mode, where a non-mandatory 0x66 selects a
+// 16-bit operand. That holds in 32-bit mode, but in 16-bit mode the prefix
+// selects a 32-bit operand instead.
+func (m Mode) operandPrefix(in *instruction.Instruction, f *instruction.Form, enc *instruction.Encoding, widened bool) bool {
+	has := false
+	for i := 0; i < int(enc.Prefix.Len); i++ {
+		if enc.Prefix.Val[i] == 0x66 && !enc.Prefix.Mandatory(i) {
+			has = true
+		}
+	}
+	if m != Mode16 {
+		return has
+	}
+	return !has && (widened || operand32(in, f, enc))
+}
+
+// operand32 reports whether f is a legacy form with a 32-bit operand. These
+// are the forms that have a REX.W counterpart with the same opcode, or that
+// take a 32-bit immediate.
+func operand32(in *instruction.Instruction, f *instruction.Form, enc *instruction.Encoding) bool {
+	if enc.VEX.Type != instruction.VexTypeNone || enc.EVEX.Fmm.IsSet() {
+		return false
+	}
+	for i := uint8(0); i < f.Operands.Len; i++ {
+		p := f.Operands.Val[i]
+		if p.Kind() == operand.KindReg && operand.Reg(p).Type() != operand.RegTypeGeneral {
+			return false
+		}
+	}
+	for i := uint8(0); i < enc.Immediate.Len; i++ {
+		if enc.Immediate.Val[i].Size == operand.Size32 {
+			return true
+		}
+	}
+	for i := range in.Forms {
+		if rexW(&in.Forms[i].Encoding, enc) {
+			return true
+		}
+		for j := range in.Forms[i].Encodings {
+			if rexW(&in.Forms[i].Encodings[j], enc) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rexW reports whether other is the REX.W counterpart of enc.
+func rexW(other, enc *instruction.Encoding) bool {
+	w, m := other.REX.FW.Value()
+	return m == instruction.OptModeValue && w == 1 &&
+		other.Opcode == enc.Opcode && other.ModRM.Reg == enc.ModRM.Reg
+}
+
+// selectMode finds the form of call for its mode, which is either Mode32 or
+// Mode16, and the encoding p chooses for it. It returns the arguments to
+// encode, which are widened for a form that defaults to a 64-bit operand,
+// and the address size.
+func selectMode(call *EmitCall, p Policy) (form *instruction.Form, enc *instruction.Encoding, args []operand.Arg, widened bool, as operand.Size, err error) {
+	mode := call.Mode
+	args = call.Args
+	for _, arg := range args {
+		if err = mode.check(arg); err != nil {
+			return
+		}
+	}
+
+	form, err = SelectForm(call.Instruction, args)
+	if err == ErrUnsupportedInstruction {
+		if wide, ok := widen(args); ok {
+			if wf, werr := SelectForm(call.Instruction, wide); werr == nil {
+				form, err, args, widened = wf, nil, wide, true
+			}
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	enc = p.encoding(form, args)
+	if err = encodable(enc); err != nil {
+		return
+	}
+	if enc.REX.EncodedLen(args) > 0 {
+		err = ErrModeOperand
+		return
+	}
+	as, err = mode.addrSize(args)
+	return
+}
+
+// encodeMode encodes call into f for 32-bit or 16-bit mode. The forms are
+// those of 64-bit mode, so any that needs a REX prefix is rejected, and the
+// operand and address size prefixes are chosen for the mode. INC and DEC of
+// a register use their single-byte forms, which are REX prefixes in 64-bit
+// mode.
+func encodeMode(f *instruction.Format, call *EmitCall, p Policy) error {
+	form, enc, args, widened, as, err := selectMode(call, p)
+	if err != nil {
+		return err
+	}
+	mode := call.Mode
+
+	call.Prefix.Encode(f)
+	if p, ok := segmentPrefix(args); ok {
+		f.Val[f.Len] = p
+		f.Len++
+	}
+	if as != mode.size() {
+		f.Val[f.Len] = 0x67
+		f.Len++
+	}
+	if mode.operandPrefix(call.Instruction, form, enc, widened) {
+		f.Val[f.Len] = 0x66
+		f.Len++
+	}
+	for i := 0; i < int(enc.Prefix.Len); i++ {
+		if enc.Prefix.Val[i] != 0x66 || enc.Prefix.Mandatory(i) {
+			f.Val[f.Len] = enc.Prefix.Val[i]
+			f.Len++
+		}
+	}
+
+	switch {
+	case enc.EVEX.Encode(f, args):
+	case enc.VEX.Encode(f, args):
+	}
+
+	if r, ok := shortIncDec(call.Instruction, args); ok {
+		f.Val[f.Len] = r
+		f.Len++
+		return nil
+	}
+
+	enc.Opcode.Encode(f, args)
+	if as == operand.Size16 {
+		enc.ModRM.Encode16(f, args)
+	} else {
+		enc.ModRM.Encode32(f, args)
+	}
+	enc.RegisterByte.Encode(f, args)
+	enc.Immediate.Encode(f, args)
+	if mode == Mode16 {
+		enc.CodeOffset.Encode16(f, args)
+	} else {
+		enc.CodeOffset.Encode(f, args)
+	}
+	if v, m := enc.DataOffset.Value.Value(); m == instruction.OptModeRef {
+		if mem, ok := args[v].(operand.Mem); ok {
+			f.Len += uint8(operand.Uint(mem.Addr).Encode(f.Val[f.Len:], as))
+		}
+	}
+	return nil
+}
+
+// modeLen returns the number of bytes that encodeMode appends for enc of
+// form, not counting any prefix given with the call.
+func modeLen(mode Mode, in *instruction.Instruction, form *instruction.Form, enc *instruction.Encoding, args []operand.Arg, widened bool, as operand.Size) int {
+	n := 0
+	if _, ok := segmentPrefix(args); ok {
+		n++
+	}
+	if as != mode.size() {
+		n++
+	}
+	if mode.operandPrefix(in, form, enc, widened) {
+		n++
+	}
+	for i := 0; i < int(enc.Prefix.Len); i++ {
+		if enc.Prefix.Val[i] != 0x66 || enc.Prefix.Mandatory(i) {
+			n++
+		}
+	}
+	n += enc.EVEX.EncodedLen(args) + enc.VEX.EncodedLen(args)
+
+	if _, ok := shortIncDec(in, args); ok {
+		return n + 1
+	}
+
+	n += enc.Opcode.EncodedLen(args)
+	if as == operand.Size16 {
+		n += enc.ModRM.EncodedLen16(args)
+	} else {
+		n += enc.ModRM.EncodedLen32(args)
+	}
+	n += enc.RegisterByte.EncodedLen(args) + enc.Immediate.EncodedLen(args)
+	if mode == Mode16 {
+		n += enc.CodeOffset.EncodedLen16(args)
+	} else {
+		n += enc.CodeOffset.EncodedLen(args)
+	}
+	if _, m := enc.DataOffset.Value.Value(); m == instruction.OptModeRef {
+		n += as.Bytes()
+	}
+	return n
+}
+
+// segmentPrefix returns the segment override of the memory operand in args.
+func segmentPrefix(args []operand.Arg) (byte, bool) {
+	for _, arg := range args {
+		if mem, ok := arg.(operand.Mem); ok {
+			return mem.Segment.Prefix()
+		}
+	}
+	return 0, false
+}
+
+// shortIncDec returns the single-byte opcode of INC or DEC of a 16-bit or
+// 32-bit register.
+func shortIncDec(in *instruction.Instruction, args []operand.Arg) (byte, bool) {
+	if len(args) != 1 {
+		return 0, false
+	}
+	r, ok := args[0].(operand.Reg)
+	if !ok || r.Type() != operand.RegTypeGeneral || (r.Size() != operand.Size16 && r.Size() != operand.Size32) {
+		return 0, false
+	}
+	switch in.Name {
+	case "INC":
+		return 0x40 | r.ID(), true
+	case "DEC":
+		return 0x48 | r.ID(), true
+	}
+	return 0, false
+}
+
+// check16 returns an error if args has a 16-bit address, which may not be
+// used in 64-bit mode.
+func check16(args []operand.Arg) error {
+	for _, arg := range args {
+		if mem, ok := arg.(operand.Mem); ok && (mem.Base.Size() == operand.Size16 ||
+			(mem.Base == 0 && mem.Index.Size() == operand.Size16)) {
+			return ErrModeAddress
+		}
+	}
+	return nil
+}
@@ -0,0 +1,396 @@
+// Package peephole rewrites short instruction sequences recorded in an
+// x64.Program into cheaper equivalents.
+//
+// Each Rule names the instruction it applies to, the kinds of operands the
+// selected form must have and the flags that must be dead afterwards. The
+// rules are applied repeatedly until none of them change the program.
+package peephole
+
+import (
+	"strings"
+
+	"github.com/kalamay/x86/instruction"
+	"github.com/kalamay/x86/operand"
+	"github.com/kalamay/x86/x64"
+)
+
+// Rule describes a single rewrite.
+type Rule struct {
+	Name string
+	// Instruction is the name of the instruction the rule applies to, or
+	// empty to apply to every instruction.
+	Instruction string
+	// Operands are the kinds of the operands of the selected form. A zero
+	// kind matches any operand. When Operands is nil the rule also applies
+	// to instructions that have no matching form.
+	Operands []operand.Kind
+	// Dead are the flags that must be overwritten before they are read
+	// again for the rule to apply.
+	Dead x64.Flags
+	// Rewrite returns the values to replace the matched instruction with.
+	Rewrite func(m *Match) ([]x64.EmitValue, bool)
+}
+
+// Match is the instruction a Rule is applied to.
+type Match struct {
+	Program *x64.Program
+	Index   int
+	Call    *x64.EmitCall
+	Form    *instruction.Form
+}
+
+// Rules are the rewrites applied by Optimizer.
+var Rules = []Rule{
+	{
+		Name:        "zero-idiom",
+		Instruction: "MOV",
+		Operands:    []operand.Kind{operand.KindReg, operand.KindImm},
+		Dead:        x64.FlagsStatus,
+		Rewrite:     zeroIdiom,
+	},
+	{
+		Name:        "add-one",
+		Instruction: "ADD",
+		Operands:    []operand.Kind{0, operand.KindImm},
+		Dead:        x64.FlagCF,
+		Rewrite:     addOne(x64.INC, x64.DEC),
+	},
+	{
+		Name:        "sub-one",
+		Instruction: "SUB",
+		Operands:    []operand.Kind{0, operand.KindImm},
+		Dead:        x64.FlagCF,
+		Rewrite:     addOne(x64.DEC, x64.INC),
+	},
+	{
+		Name:        "self-move",
+		Instruction: "MOV",
+		Operands:    []operand.Kind{operand.KindReg, operand.KindReg},
+		Rewrite:     selfMove,
+	},
+	{
+		Name:        "move-back",
+		Instruction: "MOV",
+		Operands:    []operand.Kind{0, 0},
+		Rewrite:     moveBack,
+	},
+	{
+		Name:    "jump-next",
+		Rewrite: jumpNext,
+	},
+	{
+		Name:    "jump-chain",
+		Rewrite: jumpChain,
+	},
+}
+
+// Optimize applies rules to p until none of them match and returns the
+// number of rewrites made.
+func Optimize(p *x64.Program, rules []Rule) int {
+	n := 0
+	for changed := true; changed; {
+		changed = false
+		for i := 0; i < p.Len(); i++ {
+			if apply(p, i, rules) {
+				changed = true
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func apply(p *x64.Program, i int, rules []Rule) bool {
+	call, ok := p.At(i).(*x64.EmitCall)
+	if !ok {
+		return false
+	}
+	form, err := x64.SelectForm(call.Instruction, call.Args)
+	if err != nil {
+		form = nil
+	}
+	m := Match{Program: p, Index: i, Call: call, Form: form}
+
+	for _, r := range rules {
+		if r.Instruction != "" && r.Instruction != call.Instruction.Name {
+			continue
+		}
+		if !matchKinds(form, r.Operands) {
+			continue
+		}
+		if r.Dead != 0 && !flagsDead(p, i+1, r.Dead, map[int]x64.Flags{}) {
+			continue
+		}
+		if vals, ok := r.Rewrite(&m); ok {
+			p.Replace(i, vals...)
+			return true
+		}
+	}
+	return false
+}
+
+func matchKinds(f *instruction.Form, kinds []operand.Kind) bool {
+	if kinds == nil {
+		return true
+	}
+	if f == nil || int(f.Operands.Len) != len(kinds) {
+		return false
+	}
+	for i, k := range kinds {
+		if k != 0 && f.Operands.Val[i].Kind() != k {
+			return false
+		}
+	}
+	return true
+}
+
+// flagsDead reports whether every flag in fl is overwritten before it is read
+// on all paths starting at position i.
+func flagsDead(p *x64.Program, i int, fl x64.Flags, seen map[int]x64.Flags) bool {
+	if fl&^seen[i] == 0 {
+		return true
+	}
+	seen[i] |= fl
+
+	for ; i < p.Len(); i++ {
+		call, ok := p.At(i).(*x64.EmitCall)
+		if !ok {
+			continue
+		}
+		fe := x64.FlagEffectOf(call.Instruction)
+		if fe.Read&fl != 0 {
+			return false
+		}
+		if fl &^= fe.Write; fl == 0 {
+			return true
+		}
+		name := call.Instruction.Name
+		if name == "RET" {
+			return true
+		}
+		if to, ok := branchTarget(call); ok {
+			at := p.Index(to)
+			if at < 0 || !flagsDead(p, at, fl, seen) {
+				return false
+			}
+			if name == "JMP" {
+				return true
+			}
+		} else if name == "JMP" {
+			return false
+		}
+	}
+	return false
+}
+
+func zeroIdiom(m *Match) ([]x64.EmitValue, bool) {
+	// A virtual register selects the same forms, but is left to be
+	// optimized once it is allocated.
+	r, ok := m.Call.Args[0].(operand.Reg)
+	if !ok {
+		return nil, false
+	}
+	if v, ok := immValue(m.Call.Args[1]); !ok || v != 0 {
+		return nil, false
+	}
+	if r.Type() != operand.RegTypeGeneral || r.Size() < operand.Size32 {
+		return nil, false
+	}
+
+	// Writing the 32-bit register clears the upper half as well.
+	r = operand.MakeReg(r.ID(), operand.RegTypeGeneral, operand.Size32)
+	call := newCall(m.Call, x64.XOR, r, r)
+	if f, err := x64.SelectForm(call.Instruction, call.Args); err != nil || !f.CancelingInputs {
+		return nil, false
+	}
+	return []x64.EmitValue{call}, true
+}
+
+func addOne(up, down x64.InstructionID) func(m *Match) ([]x64.EmitValue, bool) {
+	return func(m *Match) ([]x64.EmitValue, bool) {
+		var id x64.InstructionID
+		switch v, _ := immValue(m.Call.Args[1]); v {
+		case 1:
+			id = up
+		case -1:
+			id = down
+		default:
+			return nil, false
+		}
+		call := newCall(m.Call, id, m.Call.Args[0])
+		if _, err := x64.SelectForm(call.Instruction, call.Args); err != nil {
+			return nil, false
+		}
+		return []x64.EmitValue{call}, true
+	}
+}
+
+func selfMove(m *Match) ([]x64.EmitValue, bool) {
+	r, ok := m.Call.Args[0].(operand.Reg)
+	// A 32-bit move clears the upper half of the register.
+	if !ok || r != m.Call.Args[1] || r.Size() == operand.Size32 {
+		return nil, false
+	}
+	return nil, true
+}
+
+func moveBack(m *Match) ([]x64.EmitValue, bool) {
+	if m.Index == 0 {
+		return nil, false
+	}
+	prev, ok := m.Program.At(m.Index - 1).(*x64.EmitCall)
+	if !ok || prev.Instruction != m.Call.Instruction {
+		return nil, false
+	}
+	dst, src := m.Call.Args[0], m.Call.Args[1]
+	if prev.Args[0] != src || prev.Args[1] != dst {
+		return nil, false
+	}
+	if r, ok := dst.(operand.Reg); ok && r.Size() == operand.Size32 {
+		return nil, false
+	}
+	// The first move must not change the address the value was read from.
+	if r, ok := src.(operand.Reg); ok {
+		if mem, ok := dst.(operand.Mem); ok && (sameReg(mem.Base, r) || sameReg(mem.Index, r)) {
+			return nil, false
+		}
+	}
+	return nil, true
+}
+
+func jumpChain(m *Match) ([]x64.EmitValue, bool) {
+	if !isJump(m.Call) {
+		return nil, false
+	}
+	from := target(m.Call)
+	to, seen := from, map[string]bool{}
+	for !seen[to] {
+		seen[to] = true
+		next, ok := jumpAt(m.Program, m.Program.Index(to))
+		if !ok {
+			if to == from {
+				return nil, false
+			}
+			return []x64.EmitValue{&x64.EmitCall{
+				Instruction:  m.Call.Instruction,
+				Args:         []operand.Arg{operand.Label(to)},
+				Prefix:       m.Call.Prefix,
+				Mode:         m.Call.Mode,
+				EmitPosition: m.Call.Position(),
+			}}, true
+		}
+		to = next
+	}
+	return nil, false
+}
+
+func jumpNext(m *Match) ([]x64.EmitValue, bool) {
+	if !isJump(m.Call) {
+		return nil, false
+	}
+	name := target(m.Call)
+	for i := m.Index + 1; i < m.Program.Len(); i++ {
+		label, ok := m.Program.At(i).(*x64.EmitLabel)
+		if !ok {
+			break
+		}
+		if label.Value == name {
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+// jumpAt returns the target of the unconditional jump that follows the
+// label at position i.
+func jumpAt(p *x64.Program, i int) (string, bool) {
+	if i < 0 {
+		return "", false
+	}
+	for ; i < p.Len(); i++ {
+		switch v := p.At(i).(type) {
+		case *x64.EmitCall:
+			if v.Instruction.Name == "JMP" && isJump(v) {
+				return target(v), true
+			}
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// isJump reports whether call is a direct jump to a label.
+func isJump(call *x64.EmitCall) bool {
+	_, ok := branchTarget(call)
+	return ok && strings.HasPrefix(call.Instruction.Name, "J")
+}
+
+// branchTarget returns the label that call may transfer control to.
+func branchTarget(call *x64.EmitCall) (string, bool) {
+	if len(call.Args) != 1 {
+		return "", false
+	}
+	l, ok := call.Args[0].(operand.Label)
+	return string(l), ok
+}
+
+func target(call *x64.EmitCall) string {
+	return string(call.Args[0].(operand.Label))
+}
+
+func immValue(arg operand.Arg) (int64, bool) {
+	switch v := arg.(type) {
+	case operand.Int:
+		return int64(v), true
+	case operand.Uint:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+func sameReg(a, b operand.Reg) bool {
+	return a != 0 && a.Type() == b.Type() && a.ID() == b.ID()
+}
+
+func newCall(at *x64.EmitCall, id x64.InstructionID, args ...operand.Arg) *x64.EmitCall {
+	return &x64.EmitCall{
+		Instruction:  &x64.Instructions.Instructions[id],
+		Args:         args,
+		Prefix:       at.Prefix,
+		Mode:         at.Mode,
+		EmitPosition: at.Position(),
+	}
+}
+
+// Optimizer is an Emitter that records a program, optimizes it and replays
+// the result into another Emitter.
+type Optimizer struct {
+	Rules []Rule
+
+	next x64.Emitter
+	prog x64.Program
+}
+
+// New creates an Optimizer using Rules that replays into next.
+func New(next x64.Emitter) *Optimizer {
+	return &Optimizer{Rules: Rules, next: next}
+}
+
+func (o *Optimizer) Open() {
+	o.next.Open()
+	o.prog.Open()
+}
+
+func (o *Optimizer) Emit(e *x64.Emit, call *x64.EmitCall) {
+	o.prog.Emit(e, call)
+}
+
+func (o *Optimizer) Label(e *x64.Emit, label *x64.EmitLabel) {
+	o.prog.Label(e, label)
+}
+
+func (o *Optimizer) Close(e *x64.Emit) {
+	Optimize(&o.prog, o.Rules)
+	o.prog.Replay(e, o.next)
+	o.next.Close(e)
+}
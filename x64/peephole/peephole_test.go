@@ -0,0 +1,161 @@
+package peephole
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	. "github.com/kalamay/x86/operand"
+	"github.com/kalamay/x86/x64"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Build  func(e *x64.Emit)
+		Expect string
+	}{
+		{
+			Name: "zero idiom",
+			Build: func(e *x64.Emit) {
+				e.MOV(RAX, Int(0))
+				e.ADD(RAX, RCX)
+				e.RET()
+			},
+			Expect: "XOR eax, eax\nADD rax, rcx\nRET\n",
+		},
+		{
+			Name: "zero idiom flags live",
+			Build: func(e *x64.Emit) {
+				e.CMP(RCX, RDX)
+				e.MOV(RAX, Int(0))
+				e.SETE(AL)
+				e.RET()
+			},
+			Expect: "CMP rcx, rdx\nMOV rax, 0\nSETE al\nRET\n",
+		},
+		{
+			Name: "add one",
+			Build: func(e *x64.Emit) {
+				e.ADD(RAX, Int(1))
+				e.SUB(SizedPtr(RDI, Size64), Int(1))
+				e.ADD(RCX, Int(1))
+				e.ADC(RDX, Int(0))
+				e.RET()
+			},
+			Expect: "INC rax\nDEC QWORD PTR [rdi]\nADD rcx, 1\nADC rdx, 0\nRET\n",
+		},
+		{
+			Name: "moves",
+			Build: func(e *x64.Emit) {
+				e.MOV(RAX, RAX)
+				e.MOV(EAX, EAX)
+				e.MOV(SizedPtr(RSP, Size64), RBX)
+				e.MOV(RBX, SizedPtr(RSP, Size64))
+				e.MOV(RBX, SizedPtr(RBX, Size64))
+				e.MOV(SizedPtr(RBX, Size64), RBX)
+				e.RET()
+			},
+			Expect: "MOV eax, eax\nMOV QWORD PTR [rsp], rbx\nMOV rbx, QWORD PTR [rbx]\nMOV QWORD PTR [rbx], rbx\nRET\n",
+		},
+		{
+			Name: "jumps",
+			Build: func(e *x64.Emit) {
+				e.JE(Label("a"))
+				e.JMP(Label("c"))
+				e.Label("c")
+				e.Label("a")
+				e.JMP(Label("b"))
+				e.INT(Int(3))
+				e.Label("b")
+				e.RET()
+			},
+			Expect: "JE b\nc:\na:\nJMP b\nINT 3\nb:\nRET\n",
+		},
+		{
+			Name: "numeric labels",
+			Build: func(e *x64.Emit) {
+				e.Label("1")
+				e.DEC(ECX)
+				e.JNE(Label("1b"))
+				e.JE(Label("1f"))
+				e.INT(Int(3))
+				e.Label("1")
+				e.RET()
+			},
+			Expect: "1:\nDEC ecx\nJNE 1b\nJE 1f\nINT 3\n1:\nRET\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			e := x64.Emit{}
+			e.Open(New(x64.NewAssembly()), &buf)
+			test.Build(&e)
+			for _, err := range e.Close() {
+				t.Error(err)
+			}
+			if buf.String() != test.Expect {
+				t.Errorf("failed to optimize:\n\texpect = %q\n\tactual = %q", test.Expect, buf.String())
+			}
+		})
+	}
+}
+
+func TestScopedLabels(t *testing.T) {
+	// Each function has its own .loop, and the jump in g must not be
+	// threaded through the jump at f's .loop.
+	buf := bytes.Buffer{}
+	e := x64.Emit{}
+	e.Open(New(x64.NewMachine()), &buf)
+	e.Label("f")
+	e.TEST(EAX, EAX)
+	e.Label(".loop")
+	e.JMP(Label("out"))
+	e.NOP()
+	e.Label("g")
+	e.Label(".loop")
+	e.DEC(ECX)
+	e.JNE(Label(".loop"))
+	e.Label("1")
+	e.JMP(Label("1f"))
+	e.Label("1")
+	e.JNE(Label("1b"))
+	e.Label("out")
+	e.RET()
+	for _, err := range e.Close() {
+		t.Error(err)
+	}
+
+	expect := []byte{0x85, 0xc0, 0xeb, 0x07, 0x90, 0xff, 0xc9, 0x75, 0xfc, 0x75, 0xfe, 0xc3}
+	if !bytes.Equal(buf.Bytes(), expect) {
+		t.Errorf("failed to optimize:\n\texpect = % x\n\tactual = % x", expect, buf.Bytes())
+	}
+}
+
+func TestOptimizeVReg(t *testing.T) {
+	v1 := MakeVReg(1, RegTypeGeneral, Size64)
+	v2 := MakeVReg(2, RegTypeGeneral, Size64)
+
+	p := x64.NewProgram()
+	e := x64.Emit{}
+	e.Open(p, nil)
+	e.MOV(v1, Int(0))
+	e.MOV(v1, v1)
+	e.MOV(v2, v1)
+	e.ADD(v2, Int(1))
+	e.RET()
+	for _, err := range e.Close() {
+		t.Error(err)
+	}
+
+	Optimize(p, Rules)
+	var names []string
+	for _, v := range p.Values() {
+		names = append(names, v.Name())
+	}
+	if expect := "MOV MOV MOV INC RET"; strings.Join(names, " ") != expect {
+		t.Errorf("expected %s, got %s", expect, strings.Join(names, " "))
+	}
+}
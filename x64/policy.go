@@ -0,0 +1,92 @@
+package x64
+
+import (
+	"github.com/kalamay/x86/instruction"
+	"github.com/kalamay/x86/operand"
+)
+
+// Policy chooses which of the encodings of a form to use for args. A nil
+// Policy uses the preferred encoding of the form.
+type Policy func(f *instruction.Form, args []operand.Arg) *instruction.Encoding
+
+// Shortest chooses the encoding that is shortest for args, and the first
+// listed of those that are equally short. Unlike the preferred encoding,
+// this accounts for the registers, so a move of xmm8 may swap its operands
+// to fit a two-byte VEX prefix.
+func Shortest(f *instruction.Form, args []operand.Arg) *instruction.Encoding {
+	return shortest(f, args, func(*instruction.Encoding) bool { return true })
+}
+
+// Canonical chooses the first encoding listed for the form, as GNU as does
+// for a register-to-register form such as "mov %eax, %ebx".
+func Canonical(f *instruction.Form, args []operand.Arg) *instruction.Encoding {
+	if len(f.Encodings) == 0 {
+		return &f.Encoding
+	}
+	return &f.Encodings[0]
+}
+
+// AvoidPrefix returns a Policy that chooses the shortest encoding without
+// the prefix byte b, or the shortest encoding if every one has it.
+func AvoidPrefix(b byte) Policy {
+	return func(f *instruction.Form, args []operand.Arg) *instruction.Encoding {
+		enc := shortest(f, args, func(e *instruction.Encoding) bool { return !e.Prefixed(b, args) })
+		if enc == nil {
+			enc = Shortest(f, args)
+		}
+		return enc
+	}
+}
+
+func shortest(f *instruction.Form, args []operand.Arg, ok func(*instruction.Encoding) bool) *instruction.Encoding {
+	if len(f.Encodings) == 0 {
+		if ok(&f.Encoding) {
+			return &f.Encoding
+		}
+		return nil
+	}
+	var best *instruction.Encoding
+	n := 0
+	for i := range f.Encodings {
+		e := &f.Encodings[i]
+		if !ok(e) {
+			continue
+		}
+		if l := e.EncodedLen(args); best == nil || l < n {
+			best, n = e, l
+		}
+	}
+	return best
+}
+
+// Select is the package Select with p choosing the encoding of the form.
+func (p Policy) Select(in *instruction.Instruction, args []operand.Arg) (*instruction.Encoding, error) {
+	f, err := SelectForm(in, args)
+	if err != nil {
+		return nil, err
+	}
+	enc := p.encoding(f, args)
+	if err := encodable(enc); err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
+
+// encodable returns an error for an encoding that uses a part the encoder
+// does not support yet.
+func encodable(enc *instruction.Encoding) error {
+	if enc.EVEX.Fmm.IsSet() {
+		return ErrEVEXUnsupported
+	}
+	if _, m := enc.RegisterByte.Register.Value(); m == instruction.OptModeRef {
+		return ErrRegisterByteUnsupported
+	}
+	return nil
+}
+
+func (p Policy) encoding(f *instruction.Form, args []operand.Arg) *instruction.Encoding {
+	if p == nil || len(f.Encodings) < 2 {
+		return &f.Encoding
+	}
+	return p(f, args)
+}
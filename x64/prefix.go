@@ -0,0 +1,105 @@
+package x64
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/kalamay/x86/instruction"
+	"github.com/kalamay/x86/operand"
+)
+
+var (
+	ErrLockInvalid   = errors.New("LOCK prefix requires a lockable instruction with a memory destination")
+	ErrRepInvalid    = errors.New("REP prefix requires a string instruction")
+	ErrHintInvalid   = errors.New("branch hint requires a conditional jump")
+	ErrPrefixInvalid = errors.New("conflicting prefixes")
+)
+
+// Prefix is a set of legacy prefixes applied to an instruction.
+type Prefix uint8
+
+const (
+	PrefixLock     Prefix = 1 << iota // LOCK (F0)
+	PrefixRep                         // REP or REPE (F3)
+	PrefixRepne                       // REPNE (F2)
+	PrefixTaken                       // Branch taken hint (3E)
+	PrefixNotTaken                    // Branch not taken hint (2E)
+)
+
+var prefixBytes = [...]byte{0xf0, 0xf3, 0xf2, 0x3e, 0x2e}
+
+// lockable are the instructions that accept a LOCK prefix when their
+// destination is in memory.
+var lockable = map[string]bool{
+	"ADC": true, "ADD": true, "AND": true, "BTC": true, "BTR": true, "BTS": true,
+	"CMPXCHG": true, "CMPXCHG8B": true, "CMPXCHG16B": true, "DEC": true,
+	"INC": true, "NEG": true, "NOT": true, "OR": true, "SBB": true, "SUB": true,
+	"XADD": true, "XCHG": true, "XOR": true,
+}
+
+// Encode appends the prefix bytes to f.
+func (p Prefix) Encode(f *instruction.Format) {
+	for i, b := range prefixBytes {
+		if p&(1<<i) != 0 {
+			f.Val[f.Len] = b
+			f.Len++
+		}
+	}
+}
+
+// Check returns an error if p may not be applied to inst with args.
+func (p Prefix) Check(inst *instruction.Instruction, args []operand.Arg) error {
+	name := inst.Name
+	if bitsSet(p&(PrefixLock|PrefixRep|PrefixRepne)) > 1 ||
+		p&(PrefixTaken|PrefixNotTaken) == PrefixTaken|PrefixNotTaken {
+		return ErrPrefixInvalid
+	}
+	if p&PrefixLock != 0 {
+		if !lockable[name] || len(args) == 0 {
+			return ErrLockInvalid
+		}
+		if _, ok := args[0].(operand.Mem); !ok {
+			return ErrLockInvalid
+		}
+	}
+	if p&(PrefixRep|PrefixRepne) != 0 && (!isString(name) || len(args) > 0) {
+		return ErrRepInvalid
+	}
+	if p&(PrefixTaken|PrefixNotTaken) != 0 && (!strings.HasPrefix(name, "J") || name == "JMP") {
+		return ErrHintInvalid
+	}
+	return nil
+}
+
+func (p Prefix) String() string {
+	names := [...]string{"LOCK", "REP", "REPNE", "TAKEN", "NOTTAKEN"}
+	var b strings.Builder
+	for i, n := range names {
+		if p&(1<<i) != 0 {
+			if b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(n)
+		}
+	}
+	return b.String()
+}
+
+func isString(name string) bool {
+	if len(name) < 4 {
+		return false
+	}
+	switch name[:len(name)-1] {
+	case "MOVS", "STOS", "LODS", "CMPS", "SCAS", "INS", "OUTS":
+		return strings.ContainsRune("BWDQ", rune(name[len(name)-1]))
+	}
+	return false
+}
+
+func bitsSet(p Prefix) int {
+	n := 0
+	for ; p != 0; p &= p - 1 {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,151 @@
+package x64
+
+import (
+	"runtime"
+
+	"github.com/kalamay/x86/operand"
+)
+
+// Program is an Emitter that records instructions and labels instead of
+// encoding them. The recorded values may be inspected and edited before the
+// program is replayed into another Emitter.
+//
+// Each value is either an *EmitCall or an *EmitLabel. Local and numeric
+// labels, and the references to them, are recorded under unique names as
+// they are emitted, so each label name in a program is defined only once.
+// Values added with Insert or Replace must already use these names.
+type Program struct {
+	values []EmitValue
+	scope  labelScope
+}
+
+func NewProgram() *Program {
+	return &Program{}
+}
+
+func (p *Program) Open() {
+	p.values = p.values[:0]
+	p.scope.reset()
+}
+
+func (p *Program) Emit(e *Emit, call *EmitCall) {
+	scoped, err := p.scope.call(call)
+	if err != nil {
+		e.AddError(err, call)
+		return
+	}
+	p.values = append(p.values, scoped)
+}
+
+func (p *Program) Label(e *Emit, label *EmitLabel) {
+	p.values = append(p.values, p.scope.label(label))
+}
+
+func (p *Program) Close(e *Emit) {
+}
+
+// Len returns the number of recorded values.
+func (p *Program) Len() int {
+	return len(p.values)
+}
+
+// At returns the value at position i.
+func (p *Program) At(i int) EmitValue {
+	return p.values[i]
+}
+
+// Values returns the recorded values. The slice is only valid until the
+// program is next modified.
+func (p *Program) Values() []EmitValue {
+	return p.values
+}
+
+// Index returns the position of the label with name, or -1 if there is none.
+// The name is the unique name that the program recorded the label under.
+func (p *Program) Index(name string) int {
+	for i, v := range p.values {
+		if l, ok := v.(*EmitLabel); ok && l.Value == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Labels returns the position of each label in vals by name. As with Index,
+// local and numeric labels are only told apart once a Program has recorded
+// them under unique names.
+func Labels(vals []EmitValue) map[string]int {
+	labels := map[string]int{}
+	for i, v := range vals {
+		if l, ok := v.(*EmitLabel); ok {
+			labels[l.Value] = i
+		}
+	}
+	return labels
+}
+
+// Insert adds vals before position i.
+func (p *Program) Insert(i int, vals ...EmitValue) {
+	n := len(p.values)
+	p.values = append(p.values, vals...)
+	copy(p.values[i+len(vals):], p.values[i:n])
+	copy(p.values[i:], vals)
+}
+
+// Remove deletes n values starting at position i.
+func (p *Program) Remove(i, n int) {
+	copy(p.values[i:], p.values[i+n:])
+	for j := len(p.values) - n; j < len(p.values); j++ {
+		p.values[j] = nil
+	}
+	p.values = p.values[:len(p.values)-n]
+}
+
+// Replace substitutes the value at position i with vals.
+func (p *Program) Replace(i int, vals ...EmitValue) {
+	switch len(vals) {
+	case 0:
+		p.Remove(i, 1)
+	case 1:
+		p.values[i] = vals[0]
+	default:
+		p.values[i] = vals[0]
+		p.Insert(i+1, vals[1:]...)
+	}
+}
+
+// EmitTo replays the program into the Emitter that e was opened with.
+func (p *Program) EmitTo(e *Emit) {
+	p.Replay(e, e.emitter)
+}
+
+// Replay passes each recorded value to em.
+func (p *Program) Replay(e *Emit, em Emitter) {
+	for _, v := range p.values {
+		switch v := v.(type) {
+		case *EmitCall:
+			em.Emit(e, v)
+		case *EmitLabel:
+			em.Label(e, v)
+		}
+	}
+}
+
+// NewCall creates an instruction to add to a Program.
+func NewCall(id InstructionID, args ...operand.Arg) *EmitCall {
+	call := &EmitCall{
+		Instruction: &Instructions.Instructions[id],
+		Args:        args,
+	}
+	runtime.Callers(2, call.pc[:])
+	return call
+}
+
+// NewLabel creates a label to add to a Program.
+func NewLabel(name string) *EmitLabel {
+	label := &EmitLabel{
+		Value: name,
+	}
+	runtime.Callers(2, label.pc[:])
+	return label
+}
@@ -0,0 +1,46 @@
+package x64
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/kalamay/x86/operand"
+)
+
+func TestProgram(t *testing.T) {
+	p := NewProgram()
+	e := Emit{}
+
+	e.Open(p, nil)
+	e.MOV(RAX, Int(1))
+	e.Label("a")
+	e.ADD(RAX, Int(1))
+	e.JMP(Label("a"))
+	for _, err := range e.Close() {
+		t.Error(err)
+	}
+
+	if n := p.Len(); n != 4 {
+		t.Fatalf("expected 4 values, got %d", n)
+	}
+	if i := p.Index("a"); i != 1 {
+		t.Errorf("expected label at 1, got %d", i)
+	}
+
+	p.Replace(2, NewCall(INC, RAX))
+	p.Insert(0, NewCall(XOR, EAX, EAX))
+	p.Remove(1, 1)
+	p.Insert(p.Len(), NewLabel("b"), NewCall(RET))
+
+	buf := bytes.Buffer{}
+	e.Open(NewAssembly(), &buf)
+	p.EmitTo(&e)
+	for _, err := range e.Close() {
+		t.Error(err)
+	}
+
+	expect := "XOR eax, eax\na:\nINC rax\nJMP a\nb:\nRET\n"
+	if buf.String() != expect {
+		t.Errorf("failed to replay:\n\texpect = %q\n\tactual = %q", expect, buf.String())
+	}
+}
@@ -0,0 +1,680 @@
+// Package regalloc assigns physical registers to virtual registers.
+//
+// An Allocator is an x64.Emitter that buffers everything emitted to it. When
+// closed, it maps every operand.VReg to a physical register using a linear
+// scan over the buffered instructions, spilling to a stack frame when it runs
+// out of registers, and then replays the rewritten instructions into the next
+// Emitter.
+package regalloc
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/kalamay/x86/instruction"
+	"github.com/kalamay/x86/operand"
+	"github.com/kalamay/x86/x64"
+)
+
+var (
+	ErrNoScratch         = errors.New("no scratch register available for spilled register")
+	ErrVectorUnsupported = errors.New("512-bit virtual registers are not supported")
+)
+
+type Config struct {
+	// GPR lists the general-purpose registers available for allocation in
+	// order of preference.
+	GPR []operand.Reg
+	// Vector lists the vector registers available for allocation in order of
+	// preference.
+	Vector []operand.Reg
+	// Frame is the base register used to address spill slots. Slots are placed
+	// at negative offsets from Frame, starting below FrameOffset.
+	Frame       operand.Reg
+	FrameOffset int32
+	// Results are the registers read by each RET, such as the return value.
+	Results []operand.Reg
+}
+
+// DefaultConfig allocates from the registers that are not preserved across
+// calls in the System V ABI, and spills below rbp.
+var DefaultConfig = Config{
+	GPR: []operand.Reg{
+		operand.RAX, operand.RCX, operand.RDX, operand.RSI, operand.RDI,
+		operand.R8, operand.R9, operand.R10, operand.R11,
+	},
+	Vector: []operand.Reg{
+		operand.XMM0, operand.XMM1, operand.XMM2, operand.XMM3,
+		operand.XMM4, operand.XMM5, operand.XMM6, operand.XMM7,
+		operand.XMM8, operand.XMM9, operand.XMM10, operand.XMM11,
+		operand.XMM12, operand.XMM13, operand.XMM14, operand.XMM15,
+	},
+	Frame: operand.RBP,
+}
+
+type Allocator struct {
+	config Config
+	next   x64.Emitter
+	prog   x64.Program
+	nodes  []node
+	nextID uint32
+
+	intervals []*interval
+	byKey     map[regKey]*interval
+	fixed     map[regKey][]segment
+	scratch   map[operand.RegType][]operand.Reg
+	frame     int32
+	vex       bool
+}
+
+type node struct {
+	call  *x64.EmitCall
+	label *x64.EmitLabel
+	form  *instruction.Form
+}
+
+// New creates an Allocator that replays its allocated instructions into next.
+func New(next x64.Emitter, c Config) *Allocator {
+	return &Allocator{
+		config: c,
+		next:   next,
+		byKey:  map[regKey]*interval{},
+		fixed:  map[regKey][]segment{},
+	}
+}
+
+// GPR returns a new general-purpose virtual register.
+func (a *Allocator) GPR(s operand.Size) operand.VReg {
+	a.nextID++
+	return operand.MakeVReg(a.nextID, operand.RegTypeGeneral, s)
+}
+
+// Vector returns a new vector virtual register.
+func (a *Allocator) Vector(s operand.Size) operand.VReg {
+	a.nextID++
+	return operand.MakeVReg(a.nextID, operand.RegTypeVector, s)
+}
+
+// FrameSize returns the number of bytes below Config.FrameOffset used for
+// spill slots by the last allocation.
+func (a *Allocator) FrameSize() int32 {
+	return a.frame
+}
+
+// Assigned returns the register or spill slot that v was allocated to.
+func (a *Allocator) Assigned(v operand.VReg) (operand.Arg, bool) {
+	it, ok := a.byKey[vregKey(v)]
+	if !ok {
+		return nil, false
+	}
+	if it.spilled {
+		return a.slot(it, v.Size()), true
+	}
+	return v.Reg(it.reg), true
+}
+
+func (a *Allocator) Open() {
+	a.next.Open()
+	a.prog.Open()
+	a.nodes = a.nodes[:0]
+	a.intervals = a.intervals[:0]
+	a.scratch = nil
+	a.frame = 0
+	a.vex = false
+	for k := range a.byKey {
+		delete(a.byKey, k)
+	}
+	for k := range a.fixed {
+		delete(a.fixed, k)
+	}
+}
+
+func (a *Allocator) Emit(e *x64.Emit, call *x64.EmitCall) {
+	a.prog.Emit(e, call)
+}
+
+func (a *Allocator) Label(e *x64.Emit, label *x64.EmitLabel) {
+	a.prog.Label(e, label)
+}
+
+func (a *Allocator) Close(e *x64.Emit) {
+	if a.allocate(e) && a.rewrite(e) {
+		a.prog.Replay(e, a.next)
+	}
+	a.next.Close(e)
+}
+
+func (a *Allocator) allocate(e *x64.Emit) bool {
+	for _, v := range a.prog.Values() {
+		switch v := v.(type) {
+		case *x64.EmitCall:
+			// The arguments are rewritten in place, so work on a copy and
+			// leave the caller's call as it was emitted.
+			call := *v
+			call.Args = append([]operand.Arg(nil), v.Args...)
+			a.nodes = append(a.nodes, node{call: &call})
+		case *x64.EmitLabel:
+			a.nodes = append(a.nodes, node{label: v})
+		}
+	}
+
+	ok := true
+	for i := range a.nodes {
+		n := &a.nodes[i]
+		if n.call == nil {
+			continue
+		}
+		var err error
+		n.form, err = selectForm(n.call.Instruction, n.call.Args)
+		if err != nil && hasVReg(n.call.Args) {
+			e.AddError(err, n.call)
+			ok = false
+		} else if err == nil && n.form.Encoding.VEX.Type != instruction.VexTypeNone {
+			a.vex = true
+		}
+	}
+	if !ok {
+		return false
+	}
+
+	a.pinFixed()
+	a.buildFixed()
+	if err := a.buildIntervals(); err != nil {
+		e.AddError(err, nil)
+		return false
+	}
+	a.extendLoops()
+
+	// Scratch registers are needed to reload spilled operands. Set aside as
+	// many as the spills of a single instruction require, and repeat the scan
+	// until that is enough.
+	reserve := map[operand.RegType]int{}
+	for {
+		pools := map[operand.RegType][]operand.Reg{
+			operand.RegTypeGeneral: a.config.GPR,
+			operand.RegTypeVector:  a.config.Vector,
+		}
+		a.scratch = map[operand.RegType][]operand.Reg{}
+		for typ, n := range reserve {
+			pool := pools[typ]
+			if n > len(pool) {
+				n = len(pool)
+			}
+			pools[typ] = pool[:len(pool)-n]
+			a.scratch[typ] = pool[len(pool)-n:]
+		}
+		for _, it := range a.intervals {
+			it.spilled = false
+		}
+		if !a.scan(pools) {
+			break
+		}
+		need, done := a.maxSpilled(), true
+		for typ, n := range need {
+			if n > reserve[typ] {
+				reserve[typ], done = n, false
+			}
+		}
+		if done {
+			break
+		}
+	}
+	a.assignSlots()
+	return true
+}
+
+// pinFixed moves virtual registers out of params that only accept a specific
+// register, such as the count of a shift, and uses that register instead.
+func (a *Allocator) pinFixed() {
+	nodes := make([]node, 0, len(a.nodes))
+	for _, n := range a.nodes {
+		if n.form == nil {
+			nodes = append(nodes, n)
+			continue
+		}
+		var after []node
+		params := &n.form.Operands
+		for i := uint8(0); i < params.Len; i++ {
+			p := params.Val[i]
+			v, ok := n.call.Args[i].(operand.VReg)
+			if !ok || p.Kind() != operand.KindReg || !p.Const() {
+				continue
+			}
+			r := operand.Reg(operand.RegParam(p))
+			if p.Input() {
+				nodes = append(nodes, a.moveNode(n.call, r, v))
+			}
+			if p.Output() {
+				after = append(after, a.moveNode(n.call, v, r))
+			}
+			n.call.Args[i] = r
+		}
+		nodes = append(nodes, n)
+		nodes = append(nodes, after...)
+	}
+	a.nodes = nodes
+}
+
+// buildFixed records the ranges over which each physical register holds a
+// value that the allocator must not overwrite.
+func (a *Allocator) buildFixed() {
+	for i, n := range a.nodes {
+		if n.call == nil {
+			continue
+		}
+		if n.call.Instruction.Name == "RET" {
+			for _, r := range a.config.Results {
+				a.usePhys(r, i)
+			}
+		}
+		if n.form == nil {
+			continue
+		}
+		params := &n.form.Operands
+		for j := uint8(0); j < params.Len; j++ {
+			p := params.Val[j]
+			switch arg := n.call.Args[j].(type) {
+			case operand.Reg:
+				a.accessPhys(arg, p, i)
+			case operand.Mem:
+				a.usePhys(arg.Base, i)
+				a.usePhys(arg.Index, i)
+			}
+		}
+		for j := uint8(0); j < n.form.Implicit.Len; j++ {
+			p := n.form.Implicit.Val[j]
+			a.accessPhys(operand.Reg(operand.RegParam(p)), p, i)
+		}
+	}
+}
+
+func (a *Allocator) accessPhys(r operand.Reg, p operand.Param, at int) {
+	// Writes of 8 and 16 bits preserve the rest of the register, so they are
+	// treated as reading it too.
+	if p.Input() || !p.Output() || (r.Type() == operand.RegTypeGeneral && r.Size() < operand.Size32) {
+		a.usePhys(r, at)
+	} else {
+		k := physKey(r)
+		a.fixed[k] = append(a.fixed[k], segment{at, at})
+	}
+}
+
+func (a *Allocator) usePhys(r operand.Reg, at int) {
+	if r.Validate() != nil {
+		return
+	}
+	k := physKey(r)
+	segs := a.fixed[k]
+	if len(segs) == 0 {
+		// A read without a prior write means the value is live on entry.
+		a.fixed[k] = append(segs, segment{0, at})
+	} else {
+		segs[len(segs)-1].end = at
+	}
+}
+
+func (a *Allocator) buildIntervals() error {
+	for i, n := range a.nodes {
+		if n.call == nil {
+			continue
+		}
+		for _, arg := range n.call.Args {
+			v, ok := arg.(operand.VReg)
+			if !ok {
+				continue
+			}
+			if err := v.Validate(); err != nil {
+				return err
+			}
+			// Moving a ZMM register needs EVEX, which cannot be encoded.
+			if v.Type() == operand.RegTypeVector && v.Size() == operand.Size512 {
+				return ErrVectorUnsupported
+			}
+			k := vregKey(v)
+			it, ok := a.byKey[k]
+			if !ok {
+				it = &interval{key: k, start: i}
+				a.byKey[k] = it
+				a.intervals = append(a.intervals, it)
+			}
+			it.end = i
+			if v.Size() > it.size {
+				it.size = v.Size()
+			}
+		}
+	}
+	sort.SliceStable(a.intervals, func(i, j int) bool {
+		return a.intervals[i].start < a.intervals[j].start
+	})
+	return nil
+}
+
+// extendLoops keeps any value that is live on entry to a loop live through to
+// the backward jump that closes it.
+func (a *Allocator) extendLoops() {
+	// The nodes are in the same order as the recorded values.
+	labels := x64.Labels(a.prog.Values())
+	var loops []segment
+	for i, n := range a.nodes {
+		if n.call == nil {
+			continue
+		}
+		for _, arg := range n.call.Args {
+			if l, ok := arg.(operand.Label); ok {
+				if to, ok := labels[string(l)]; ok && to < i {
+					loops = append(loops, segment{to, i})
+				}
+			}
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, loop := range loops {
+			for _, it := range a.intervals {
+				if it.start < loop.start && loop.start <= it.end && it.end < loop.end {
+					it.end = loop.end
+					changed = true
+				}
+			}
+		}
+	}
+}
+
+func (a *Allocator) scan(pools map[operand.RegType][]operand.Reg) (spilled bool) {
+	active := []*interval{}
+	for _, it := range a.intervals {
+		n := 0
+		for _, act := range active {
+			if act.end >= it.start {
+				active[n] = act
+				n++
+			}
+		}
+		active = active[:n]
+
+		if r, ok := a.free(it, active, pools[it.key.typ]); ok {
+			it.reg = r
+			active = append(active, it)
+			continue
+		}
+
+		var victim *interval
+		for _, act := range active {
+			if act.key.typ == it.key.typ && act.end > it.end && !a.conflicts(act.reg, it) &&
+				(victim == nil || act.end > victim.end) {
+				victim = act
+			}
+		}
+		spilled = true
+		if victim == nil {
+			it.spilled = true
+			continue
+		}
+		it.reg = victim.reg
+		victim.spilled = true
+		for i, act := range active {
+			if act == victim {
+				active[i] = it
+				break
+			}
+		}
+	}
+	return
+}
+
+func (a *Allocator) free(it *interval, active []*interval, pool []operand.Reg) (uint8, bool) {
+next:
+	for _, r := range pool {
+		for _, act := range active {
+			if act.key.typ == it.key.typ && act.reg == r.ID() {
+				continue next
+			}
+		}
+		if !a.conflicts(r.ID(), it) {
+			return r.ID(), true
+		}
+	}
+	return 0, false
+}
+
+func (a *Allocator) conflicts(id uint8, it *interval) bool {
+	return overlaps(a.fixed[regKey{uint32(id), it.key.typ}], it.start, it.end)
+}
+
+func (a *Allocator) maxSpilled() map[operand.RegType]int {
+	max := map[operand.RegType]int{}
+	for _, n := range a.nodes {
+		if n.call == nil {
+			continue
+		}
+		spilled := map[regKey]struct{}{}
+		for _, arg := range n.call.Args {
+			if v, ok := arg.(operand.VReg); ok && a.byKey[vregKey(v)].spilled {
+				spilled[vregKey(v)] = struct{}{}
+			}
+		}
+		per := map[operand.RegType]int{}
+		for k := range spilled {
+			per[k.typ]++
+		}
+		for typ, n := range per {
+			if n > max[typ] {
+				max[typ] = n
+			}
+		}
+	}
+	return max
+}
+
+func (a *Allocator) assignSlots() {
+	off := a.config.FrameOffset
+	for _, it := range a.intervals {
+		if !it.spilled {
+			continue
+		}
+		n := int32(8)
+		if it.key.typ == operand.RegTypeVector {
+			n = int32(it.size.Bytes())
+		}
+		off -= n
+		off &^= n - 1
+		it.slot = off
+	}
+	a.frame = a.config.FrameOffset - off
+}
+
+func (a *Allocator) slot(it *interval, s operand.Size) operand.Mem {
+	return operand.Mem{Base: a.config.Frame, Disp: it.slot, Size: s}
+}
+
+// rewrite replaces the recorded program with the allocated instructions.
+func (a *Allocator) rewrite(e *x64.Emit) bool {
+	a.prog.Open()
+	for i, n := range a.nodes {
+		if n.label != nil {
+			a.prog.Label(e, n.label)
+			continue
+		}
+		if n.form == nil || !hasVReg(n.call.Args) {
+			a.prog.Emit(e, n.call)
+			continue
+		}
+
+		var (
+			after []*x64.EmitCall
+			used  []operand.Reg
+			temps = map[regKey]operand.Reg{}
+		)
+		for j, arg := range n.call.Args {
+			v, ok := arg.(operand.VReg)
+			if !ok {
+				continue
+			}
+			it := a.byKey[vregKey(v)]
+			if !it.spilled {
+				n.call.Args[j] = v.Reg(it.reg)
+				continue
+			}
+
+			r, ok := temps[it.key]
+			if !ok {
+				if r, ok = a.scratchFor(it, i, used); !ok {
+					e.AddError(ErrNoScratch, n.call)
+					return false
+				}
+				temps[it.key] = r
+				used = append(used, r)
+			}
+			r = operand.MakeReg(r.ID(), v.Type(), v.Size())
+
+			p := n.form.Operands.Val[j]
+			if p.Input() || (v.Type() == operand.RegTypeGeneral && v.Size() < operand.Size32) {
+				a.prog.Emit(e, a.moveCall(n.call, r, a.slot(it, v.Size())))
+			}
+			if p.Output() {
+				after = append(after, a.moveCall(n.call, a.slot(it, v.Size()), r))
+			}
+			n.call.Args[j] = r
+		}
+		a.prog.Emit(e, n.call)
+		for _, call := range after {
+			a.prog.Emit(e, call)
+		}
+	}
+	return true
+}
+
+func (a *Allocator) scratchFor(it *interval, at int, used []operand.Reg) (operand.Reg, bool) {
+next:
+	for _, r := range a.scratch[it.key.typ] {
+		for _, u := range used {
+			if u.ID() == r.ID() {
+				continue next
+			}
+		}
+		if !overlaps(a.fixed[regKey{uint32(r.ID()), it.key.typ}], at, at) {
+			return r, true
+		}
+	}
+	return 0, false
+}
+
+type regKey struct {
+	id  uint32
+	typ operand.RegType
+}
+
+func vregKey(v operand.VReg) regKey {
+	return regKey{v.ID(), v.Type()}
+}
+
+func physKey(r operand.Reg) regKey {
+	id := uint32(r.ID())
+	switch {
+	case r.HighByte():
+		id -= 20
+	case r.MMX():
+		// MMX registers are distinct from the XMM registers with the same ID.
+		return regKey{id, operand.RegTypeVector | 1}
+	}
+	return regKey{id, r.Type()}
+}
+
+type interval struct {
+	key        regKey
+	start, end int
+	size       operand.Size
+	reg        uint8
+	spilled    bool
+	slot       int32
+}
+
+type segment struct {
+	start, end int
+}
+
+func overlaps(segs []segment, start, end int) bool {
+	for _, s := range segs {
+		if s.start <= end && start <= s.end {
+			return true
+		}
+	}
+	return false
+}
+
+func hasVReg(args []operand.Arg) bool {
+	for _, arg := range args {
+		if _, ok := arg.(operand.VReg); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// selectForm finds the form for args, preferring forms that do not pin a
+// virtual register to a specific physical register.
+func selectForm(in *instruction.Instruction, args []operand.Arg) (*instruction.Form, error) {
+	forms, err := x64.MatchForms(in, args)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range forms {
+		if !pinsVReg(f.Operands, args) {
+			return f, nil
+		}
+	}
+	return forms[0], nil
+}
+
+func pinsVReg(params operand.ParamList, args []operand.Arg) bool {
+	for i := uint8(0); i < params.Len; i++ {
+		if _, ok := args[i].(operand.VReg); ok && params.Val[i].Const() {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Allocator) moveNode(at *x64.EmitCall, dst, src operand.Arg) node {
+	call := a.moveCall(at, dst, src)
+	form, _ := selectForm(call.Instruction, call.Args)
+	return node{call: call, form: form}
+}
+
+// moveCall copies src to dst. XMM registers are moved with VEX when the
+// code already uses it, which avoids mixing legacy SSE and AVX.
+func (a *Allocator) moveCall(at *x64.EmitCall, dst, src operand.Arg) *x64.EmitCall {
+	var (
+		typ  operand.RegType
+		size operand.Size
+	)
+	switch r := dst.(type) {
+	case operand.Reg:
+		typ, size = r.Type(), r.Size()
+	case operand.VReg:
+		typ, size = r.Type(), r.Size()
+	default:
+		switch r := src.(type) {
+		case operand.Reg:
+			typ, size = r.Type(), r.Size()
+		case operand.VReg:
+			typ, size = r.Type(), r.Size()
+		}
+	}
+
+	id := x64.MOV
+	if typ == operand.RegTypeVector {
+		id = x64.VMOVDQU
+		if size == operand.Size128 && !a.vex {
+			id = x64.MOVDQU
+		}
+	}
+
+	return &x64.EmitCall{
+		Instruction:  &x64.Instructions.Instructions[id],
+		Args:         []operand.Arg{dst, src},
+		Mode:         at.Mode,
+		EmitPosition: at.Position(),
+	}
+}
@@ -0,0 +1,186 @@
+package regalloc
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	. "github.com/kalamay/x86/operand"
+	"github.com/kalamay/x86/x64"
+)
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Config Config
+		Build  func(e *x64.Emit, a *Allocator)
+		Expect string
+	}{
+		{
+			Name:   "simple",
+			Config: DefaultConfig,
+			Build: func(e *x64.Emit, a *Allocator) {
+				v1, v2 := a.GPR(Size64), a.GPR(Size64)
+				e.MOV(v1, Int(1))
+				e.MOV(v2, Int(2))
+				e.ADD(v1, v2)
+				e.MOV(RDI, v1)
+			},
+			Expect: "MOV rax, 1\nMOV rcx, 2\nADD rax, rcx\nMOV rdi, rax\n",
+		},
+		{
+			Name:   "shift count",
+			Config: DefaultConfig,
+			Build: func(e *x64.Emit, a *Allocator) {
+				v1, v2 := a.GPR(Size64), a.GPR(Size8)
+				e.MOV(v1, Int(1))
+				e.MOV(v2, Int(3))
+				e.SHL(v1, v2)
+			},
+			Expect: "MOV rax, 1\nMOV dl, 3\nMOV cl, dl\nSHL rax, cl\n",
+		},
+		{
+			Name:   "implicit",
+			Config: DefaultConfig,
+			Build: func(e *x64.Emit, a *Allocator) {
+				v1, v2 := a.GPR(Size64), a.GPR(Size64)
+				e.MOV(v1, Int(7))
+				e.MOV(RAX, Int(100))
+				e.MOV(RDX, Int(0))
+				e.DIV(v1)
+				e.MOV(v2, RAX)
+				e.ADD(v2, v1)
+			},
+			Expect: "MOV rcx, 7\nMOV rax, 100\nMOV rdx, 0\nDIV rcx\nMOV rdx, rax\nADD rdx, rcx\n",
+		},
+		{
+			Name:   "spill",
+			Config: Config{GPR: []Reg{RAX, RCX, RDX, RSI}, Frame: RBP},
+			Build: func(e *x64.Emit, a *Allocator) {
+				v := [5]VReg{}
+				for i := range v {
+					v[i] = a.GPR(Size64)
+					e.MOV(v[i], Int(i))
+				}
+				for i := 1; i < len(v); i++ {
+					e.ADD(v[i], v[0])
+				}
+			},
+			Expect: "MOV rdx, 0\nMOV QWORD PTR [rbp - 8], rdx\nMOV rcx, 1\nMOV rax, 2\n" +
+				"MOV rdx, 3\nMOV QWORD PTR [rbp - 16], rdx\nMOV rdx, 4\nMOV QWORD PTR [rbp - 24], rdx\n" +
+				"MOV rdx, QWORD PTR [rbp - 8]\nADD rcx, rdx\nMOV rdx, QWORD PTR [rbp - 8]\nADD rax, rdx\n" +
+				"MOV rdx, QWORD PTR [rbp - 16]\nMOV rsi, QWORD PTR [rbp - 8]\nADD rdx, rsi\nMOV QWORD PTR [rbp - 16], rdx\n" +
+				"MOV rdx, QWORD PTR [rbp - 24]\nMOV rsi, QWORD PTR [rbp - 8]\nADD rdx, rsi\nMOV QWORD PTR [rbp - 24], rdx\n",
+		},
+		{
+			Name:   "loop",
+			Config: Config{GPR: []Reg{RAX, RCX}, Frame: RBP},
+			Build: func(e *x64.Emit, a *Allocator) {
+				v1, v2, v3 := a.GPR(Size64), a.GPR(Size64), a.GPR(Size64)
+				e.MOV(v1, Int(10))
+				e.Label("loop")
+				e.MOV(v2, v1)
+				e.SUB(v1, Int(1))
+				e.JNE(Label("loop"))
+				e.MOV(v3, Int(0))
+			},
+			Expect: "MOV rax, 10\nloop:\nMOV rcx, rax\nSUB rax, 1\nJNE loop\nMOV rax, 0\n",
+		},
+		{
+			Name:   "sse spill",
+			Config: Config{Vector: []Reg{XMM0, XMM1}, Frame: RBP},
+			Build: func(e *x64.Emit, a *Allocator) {
+				v := [3]VReg{}
+				for i := range v {
+					v[i] = a.Vector(Size128)
+					e.MOVDQU(v[i], Ptr(RSI).Offset(int32(16*i)))
+				}
+				e.PAND(v[1], v[0])
+				e.PAND(v[2], v[0])
+			},
+			Expect: "MOVDQU xmm0, [rsi]\nMOVDQU XMMWORD PTR [rbp - 16], xmm0\nMOVDQU xmm0, [rsi + 16]\n" +
+				"MOVDQU XMMWORD PTR [rbp - 32], xmm0\nMOVDQU xmm0, [rsi + 32]\nMOVDQU XMMWORD PTR [rbp - 48], xmm0\n" +
+				"MOVDQU xmm0, XMMWORD PTR [rbp - 32]\nMOVDQU xmm1, XMMWORD PTR [rbp - 16]\nPAND xmm0, xmm1\n" +
+				"MOVDQU XMMWORD PTR [rbp - 32], xmm0\nMOVDQU xmm0, XMMWORD PTR [rbp - 48]\nMOVDQU xmm1, XMMWORD PTR [rbp - 16]\n" +
+				"PAND xmm0, xmm1\nMOVDQU XMMWORD PTR [rbp - 48], xmm0\n",
+		},
+		{
+			Name:   "vex spill",
+			Config: Config{Vector: []Reg{XMM0, XMM1}, Frame: RBP},
+			Build: func(e *x64.Emit, a *Allocator) {
+				v := [3]VReg{}
+				for i := range v {
+					v[i] = a.Vector(Size128)
+					e.VMOVDQU(v[i], Ptr(RSI).Offset(int32(16*i)))
+				}
+				e.VPADDD(v[1], v[1], v[0])
+				e.VPADDD(v[2], v[2], v[0])
+			},
+			Expect: "VMOVDQU xmm0, [rsi]\nVMOVDQU XMMWORD PTR [rbp - 16], xmm0\nVMOVDQU xmm0, [rsi + 16]\n" +
+				"VMOVDQU XMMWORD PTR [rbp - 32], xmm0\nVMOVDQU xmm0, [rsi + 32]\nVMOVDQU XMMWORD PTR [rbp - 48], xmm0\n" +
+				"VMOVDQU xmm0, XMMWORD PTR [rbp - 32]\nVMOVDQU xmm1, XMMWORD PTR [rbp - 16]\nVPADDD xmm0, xmm0, xmm1\n" +
+				"VMOVDQU XMMWORD PTR [rbp - 32], xmm0\nVMOVDQU xmm0, XMMWORD PTR [rbp - 48]\nVMOVDQU xmm1, XMMWORD PTR [rbp - 16]\n" +
+				"VPADDD xmm0, xmm0, xmm1\nVMOVDQU XMMWORD PTR [rbp - 48], xmm0\n",
+		},
+	}
+
+	for _, test := range tests {
+		buf := bytes.Buffer{}
+		e := x64.Emit{}
+		a := New(x64.NewAssembly(), test.Config)
+		e.Open(a, &buf)
+		test.Build(&e, a)
+		for _, err := range e.Close() {
+			t.Errorf("%s: %v", test.Name, err)
+		}
+		if actual := buf.String(); actual != test.Expect {
+			t.Errorf("%s: failed to allocate:\n\texpect = %q\n\tactual = %q", test.Name, test.Expect, actual)
+		}
+	}
+}
+
+func TestAllocateAmbiguous(t *testing.T) {
+	e := x64.Emit{}
+	a := New(x64.NewAssembly(), DefaultConfig)
+	e.Open(a, &bytes.Buffer{})
+	e.MOVZX(a.GPR(Size32), Ptr(RSI))
+	errs := e.Close()
+	if len(errs) != 1 || !errors.Is(errs[0], x64.ErrAmbiguousOperandSize) {
+		t.Errorf("expected %v, got %v", x64.ErrAmbiguousOperandSize, errs)
+	}
+}
+
+func TestAllocateZMM(t *testing.T) {
+	e := x64.Emit{}
+	a := New(x64.NewAssembly(), DefaultConfig)
+	e.Open(a, &bytes.Buffer{})
+	e.VMOVDQU64(a.Vector(Size512), Ptr(RSI))
+	errs := e.Close()
+	if len(errs) != 1 || !errors.Is(errs[0], ErrVectorUnsupported) {
+		t.Errorf("expected %v, got %v", ErrVectorUnsupported, errs)
+	}
+}
+
+func TestAllocateKeepsProgram(t *testing.T) {
+	prog := x64.NewProgram()
+	a := New(x64.NewAssembly(), DefaultConfig)
+	v := a.GPR(Size64)
+
+	e := x64.Emit{}
+	e.Open(prog, nil)
+	e.MOV(v, Int(1))
+	e.ADD(v, v)
+	e.Close()
+
+	e.Open(a, &bytes.Buffer{})
+	prog.Replay(&e, a)
+	for _, err := range e.Close() {
+		t.Error(err)
+	}
+
+	for i, val := range prog.Values() {
+		if _, ok := val.(*x64.EmitCall).Args[0].(VReg); !ok {
+			t.Errorf("%d: expected the recorded call to keep its virtual register", i)
+		}
+	}
+}
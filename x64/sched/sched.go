@@ -0,0 +1,350 @@
+// Package sched reorders the instructions of a recorded x64.Program to hide
+// latency.
+//
+// Each basic block is turned into a dependency graph built from the register,
+// virtual register, flag and memory accesses of its instructions, and then
+// list scheduled so that instructions on the longest latency path are issued
+// first. Labels, branches, calls and any instruction that cannot be analyzed
+// stay in place and split the program into blocks.
+package sched
+
+import (
+	"strings"
+
+	"github.com/kalamay/x86/operand"
+	"github.com/kalamay/x86/x64"
+	"github.com/kalamay/x86/x64/dataflow"
+)
+
+// Latency returns the number of cycles before the result of call can be
+// used by a dependent instruction.
+type Latency func(call *x64.EmitCall, info dataflow.Info) int
+
+// DefaultLatency is a rough latency model for recent cores.
+func DefaultLatency(call *x64.EmitCall, info dataflow.Info) int {
+	n := 1
+	switch name := call.Instruction.Name; {
+	case strings.Contains(name, "DIV") || strings.Contains(name, "SQRT"):
+		n = 20
+	case strings.Contains(name, "FMADD") || strings.Contains(name, "FMSUB") ||
+		strings.Contains(name, "FNMADD") || strings.Contains(name, "FNMSUB"):
+		n = 4
+	case strings.Contains(name, "MUL"):
+		n = 3
+		if strings.HasSuffix(name, "PS") || strings.HasSuffix(name, "PD") ||
+			strings.HasSuffix(name, "SS") || strings.HasSuffix(name, "SD") {
+			n = 4
+		}
+	case strings.HasSuffix(name, "ADDPS") || strings.HasSuffix(name, "ADDPD") ||
+		strings.HasSuffix(name, "SUBPS") || strings.HasSuffix(name, "SUBPD"):
+		n = 4
+	}
+	if info.Load {
+		n += 4
+	}
+	return n
+}
+
+// DepKind is the reason one instruction must follow another.
+type DepKind uint8
+
+const (
+	DepData   DepKind = iota // The later instruction reads a result.
+	DepAnti                  // The later instruction overwrites an input.
+	DepOutput                // Both instructions write the same location.
+	DepMemory                // The instructions may access the same memory.
+)
+
+func (k DepKind) String() string {
+	switch k {
+	case DepData:
+		return "data"
+	case DepAnti:
+		return "anti"
+	case DepOutput:
+		return "output"
+	case DepMemory:
+		return "memory"
+	}
+	return "unknown"
+}
+
+// Edge is a dependency on another node of a Graph.
+type Edge struct {
+	Node    int
+	Kind    DepKind
+	Latency int
+}
+
+// Node is an instruction in a Graph.
+type Node struct {
+	Call *x64.EmitCall
+	Info dataflow.Info
+	// Mem are the memory operands of Call with their size taken from the
+	// selected form.
+	Mem     []operand.Mem
+	Latency int
+	// Height is the length of the longest latency path from the start of
+	// this node to the end of the block.
+	Height int
+	Pred   []Edge
+	Succ   []Edge
+}
+
+// Graph is the dependency graph of a basic block.
+type Graph struct {
+	Nodes []Node
+}
+
+// Build creates the dependency graph for calls, which must form a basic
+// block.
+func Build(calls []*x64.EmitCall, lat Latency) (*Graph, error) {
+	g := &Graph{Nodes: make([]Node, len(calls))}
+	for i, call := range calls {
+		f, err := x64.SelectForm(call.Instruction, call.Args)
+		if err != nil {
+			return nil, &x64.Error{Value: call, Err: err}
+		}
+		info, _ := dataflow.InfoOf(call)
+		n := Node{Call: call, Info: info, Latency: lat(call, info)}
+		for j, arg := range call.Args {
+			if m, ok := arg.(operand.Mem); ok {
+				if m.Size == operand.Size0 {
+					m.Size = operand.MemParam(f.Operands.Val[j]).Size()
+				}
+				n.Mem = append(n.Mem, m)
+			}
+		}
+		g.Nodes[i] = n
+	}
+
+	for j := range g.Nodes {
+		b := &g.Nodes[j]
+		for i := 0; i < j; i++ {
+			a := &g.Nodes[i]
+			switch {
+			case !a.Info.Def.Intersect(b.Info.Use).Empty() ||
+				!a.Info.VDef.Intersect(b.Info.VUse).Empty():
+				g.link(i, j, DepData, a.Latency)
+			case !a.Info.Def.Intersect(b.Info.Def).Empty() ||
+				!a.Info.VDef.Intersect(b.Info.VDef).Empty():
+				g.link(i, j, DepOutput, 0)
+			case !a.Info.Use.Intersect(b.Info.Def).Empty() ||
+				!a.Info.VUse.Intersect(b.Info.VDef).Empty():
+				g.link(i, j, DepAnti, 0)
+			case memoryDepends(a, b):
+				n := 0
+				if a.Info.Store && b.Info.Load {
+					n = a.Latency
+				}
+				g.link(i, j, DepMemory, n)
+			}
+		}
+	}
+
+	for i := len(g.Nodes) - 1; i >= 0; i-- {
+		n := &g.Nodes[i]
+		n.Height = n.Latency
+		for _, e := range n.Succ {
+			if h := e.Latency + g.Nodes[e.Node].Height; h > n.Height {
+				n.Height = h
+			}
+		}
+	}
+	return g, nil
+}
+
+func (g *Graph) link(from, to int, kind DepKind, lat int) {
+	g.Nodes[from].Succ = append(g.Nodes[from].Succ, Edge{Node: to, Kind: kind, Latency: lat})
+	g.Nodes[to].Pred = append(g.Nodes[to].Pred, Edge{Node: from, Kind: kind, Latency: lat})
+}
+
+// Order returns the node indices in list schedule order. Each cycle issues
+// the ready node with the greatest height, preferring earlier nodes on ties.
+func (g *Graph) Order() []int {
+	n := len(g.Nodes)
+	order := make([]int, 0, n)
+	waiting := make([]int, n)
+	earliest := make([]int, n)
+	for i := range g.Nodes {
+		waiting[i] = len(g.Nodes[i].Pred)
+	}
+
+	for cycle := 0; len(order) < n; cycle++ {
+		best := -1
+		for i := range g.Nodes {
+			if waiting[i] != 0 {
+				continue
+			}
+			if best < 0 || better(g, earliest, cycle, i, best) {
+				best = i
+			}
+		}
+		if earliest[best] > cycle {
+			cycle = earliest[best]
+		}
+		order = append(order, best)
+		waiting[best] = -1
+		for _, e := range g.Nodes[best].Succ {
+			waiting[e.Node]--
+			if t := cycle + e.Latency; t > earliest[e.Node] {
+				earliest[e.Node] = t
+			}
+		}
+	}
+	return order
+}
+
+func better(g *Graph, earliest []int, cycle, i, j int) bool {
+	ri, rj := earliest[i] <= cycle, earliest[j] <= cycle
+	switch {
+	case ri != rj:
+		return ri
+	case !ri && earliest[i] != earliest[j]:
+		return earliest[i] < earliest[j]
+	}
+	return g.Nodes[i].Height > g.Nodes[j].Height
+}
+
+// memoryDepends reports whether a and b may access the same memory with at
+// least one of them writing it.
+func memoryDepends(a, b *Node) bool {
+	ia, ib := implicitMemory(a.Call), implicitMemory(b.Call)
+	if !(a.Info.Store || ia) && !(b.Info.Store || ib) {
+		return false
+	}
+	if !(a.Info.Load || a.Info.Store || ia) || !(b.Info.Load || b.Info.Store || ib) {
+		return false
+	}
+	if ia || ib {
+		return true
+	}
+	for _, m := range a.Mem {
+		for _, n := range b.Mem {
+			if mayAlias(m, n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mayAlias reports whether two memory operands could overlap. Only operands
+// with the same address registers are known to be distinct, when their
+// displacements keep them apart. A 64-bit moffs address is not compared.
+func mayAlias(m, n operand.Mem) bool {
+	if m.Base != n.Base || m.Index != n.Index || m.Scale != n.Scale || m.Segment != n.Segment ||
+		m.Type == operand.MemTypeOffset || n.Type == operand.MemTypeOffset {
+		return true
+	}
+	ms, ns := int32(m.Size.Bytes()), int32(n.Size.Bytes())
+	if ms == 0 || ns == 0 {
+		return true
+	}
+	return m.Disp < n.Disp+ns && n.Disp < m.Disp+ms
+}
+
+// implicitMemory reports whether call accesses memory without a memory
+// operand, such as the stack or a string instruction.
+func implicitMemory(call *x64.EmitCall) bool {
+	name := call.Instruction.Name
+	switch {
+	case strings.HasPrefix(name, "PUSH"), strings.HasPrefix(name, "POP") && name != "POPCNT",
+		strings.HasPrefix(name, "MOVS") && len(call.Args) == 0,
+		strings.HasPrefix(name, "STOS"), strings.HasPrefix(name, "LODS"),
+		strings.HasPrefix(name, "SCAS"),
+		strings.HasPrefix(name, "CMPS") && len(call.Args) == 0,
+		name == "LEAVE", name == "MFENCE", name == "SFENCE", name == "LFENCE":
+		return true
+	}
+	return false
+}
+
+// barrier reports whether call must stay in place. Locked instructions
+// order all memory accesses.
+func barrier(call *x64.EmitCall) bool {
+	if call.Prefix&x64.PrefixLock != 0 {
+		return true
+	}
+	for _, arg := range call.Args {
+		if _, ok := arg.(operand.Label); ok {
+			return true
+		}
+	}
+	switch name := call.Instruction.Name; {
+	case strings.HasPrefix(name, "J"), strings.HasPrefix(name, "LOOP"),
+		name == "CALL", name == "RET", name == "SYSCALL", name == "INT", name == "UD2",
+		name == "CPUID", name == "RDTSC", name == "RDTSCP":
+		return true
+	}
+	return false
+}
+
+// Schedule reorders the instructions of each basic block of p.
+func Schedule(p *x64.Program, lat Latency) {
+	var (
+		out   = make([]x64.EmitValue, 0, p.Len())
+		block []*x64.EmitCall
+	)
+	flush := func() {
+		if g, err := Build(block, lat); err == nil {
+			for _, i := range g.Order() {
+				out = append(out, block[i])
+			}
+		} else {
+			for _, call := range block {
+				out = append(out, call)
+			}
+		}
+		block = block[:0]
+	}
+
+	for _, v := range p.Values() {
+		call, ok := v.(*x64.EmitCall)
+		if ok && !barrier(call) {
+			if _, err := dataflow.InfoOf(call); err == nil {
+				block = append(block, call)
+				continue
+			}
+		}
+		flush()
+		out = append(out, v)
+	}
+	flush()
+
+	p.Remove(0, p.Len())
+	p.Insert(0, out...)
+}
+
+// Scheduler is an Emitter that records a program, schedules it and replays
+// the result into another Emitter.
+type Scheduler struct {
+	Latency Latency
+
+	next x64.Emitter
+	prog x64.Program
+}
+
+// New creates a Scheduler using DefaultLatency that replays into next.
+func New(next x64.Emitter) *Scheduler {
+	return &Scheduler{Latency: DefaultLatency, next: next}
+}
+
+func (s *Scheduler) Open() {
+	s.next.Open()
+	s.prog.Open()
+}
+
+func (s *Scheduler) Emit(e *x64.Emit, call *x64.EmitCall) {
+	s.prog.Emit(e, call)
+}
+
+func (s *Scheduler) Label(e *x64.Emit, label *x64.EmitLabel) {
+	s.prog.Label(e, label)
+}
+
+func (s *Scheduler) Close(e *x64.Emit) {
+	Schedule(&s.prog, s.Latency)
+	s.prog.Replay(e, s.next)
+	s.next.Close(e)
+}
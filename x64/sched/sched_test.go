@@ -0,0 +1,89 @@
+package sched
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/kalamay/x86/operand"
+	"github.com/kalamay/x86/x64"
+)
+
+func TestSchedule(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Build  func(e *x64.Emit)
+		Expect string
+	}{
+		{
+			Name: "chains",
+			Build: func(e *x64.Emit) {
+				e.VMULPS(YMM0, YMM1, YMM2)
+				e.VADDPS(YMM3, YMM0, YMM4)
+				e.VMULPS(YMM5, YMM6, YMM7)
+				e.VADDPS(YMM8, YMM5, YMM9)
+				e.RET()
+			},
+			Expect: "VMULPS ymm0, ymm1, ymm2\nVMULPS ymm5, ymm6, ymm7\nVADDPS ymm3, ymm0, ymm4\nVADDPS ymm8, ymm5, ymm9\nRET\n",
+		},
+		{
+			Name: "canceling inputs",
+			Build: func(e *x64.Emit) {
+				e.VMULPS(XMM1, XMM2, XMM3)
+				e.VADDPS(XMM4, XMM1, XMM5)
+				e.VPXOR(XMM0, XMM1, XMM1)
+			},
+			Expect: "VMULPS xmm1, xmm2, xmm3\nVPXOR xmm0, xmm1, xmm1\nVADDPS xmm4, xmm1, xmm5\n",
+		},
+		{
+			Name: "memory",
+			Build: func(e *x64.Emit) {
+				e.MOV(Ptr(RDI), RAX)
+				e.MOV(RCX, Ptr(RSI))
+				e.MOV(Ptr(RDI), RAX)
+				e.MOV(RDX, Ptr(RDI).Offset(8))
+			},
+			Expect: "MOV [rdi], rax\nMOV rcx, [rsi]\nMOV rdx, [rdi + 8]\nMOV [rdi], rax\n",
+		},
+		{
+			Name: "blocks",
+			Build: func(e *x64.Emit) {
+				e.IMUL(RAX, RCX)
+				e.CMP(RAX, RDX)
+				e.LEA(RSI, Ptr(RSI).Offset(8))
+				e.JE(Label("a"))
+				e.Label("a")
+				e.IMUL(RBX, RCX)
+				e.ADD(RSI, RDI)
+			},
+			Expect: "IMUL rax, rcx\nLEA rsi, [rsi + 8]\nCMP rax, rdx\nJE a\na:\nIMUL rbx, rcx\nADD rsi, rdi\n",
+		},
+		{
+			Name: "virtual registers",
+			Build: func(e *x64.Emit) {
+				v1 := MakeVReg(1, RegTypeGeneral, Size64)
+				v2 := MakeVReg(2, RegTypeGeneral, Size64)
+				e.MOV(v1, Int(5))
+				e.IMUL(v1, RSI)
+				e.MOV(v2, v1)
+				e.IMUL(v1, RDI)
+				e.MOV(RAX, v2)
+			},
+			Expect: "MOV v1:r64, 5\nIMUL v1:r64, rsi\nMOV v2:r64, v1:r64\nIMUL v1:r64, rdi\nMOV rax, v2:r64\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			e := x64.Emit{}
+			e.Open(New(x64.NewAssembly()), &buf)
+			test.Build(&e)
+			for _, err := range e.Close() {
+				t.Error(err)
+			}
+			if buf.String() != test.Expect {
+				t.Errorf("failed to schedule:\n\texpect = %q\n\tactual = %q", test.Expect, buf.String())
+			}
+		})
+	}
+}
@@ -10,9 +10,43 @@ import (
 var (
 	ErrUnsupportedInstruction = errors.New("unsupported instruction")
 	ErrAmbiguousOperandSize   = errors.New("ambiguous operand size")
+	ErrGatherRegisters        = errors.New("gather destination, index and mask registers must differ")
 )
 
+// Select finds the encoding of the first form of in that matches args.
 func Select(in *instruction.Instruction, args []operand.Arg) (*instruction.Encoding, error) {
+	f, err := SelectForm(in, args)
+	if err != nil {
+		return nil, err
+	}
+	return &f.Encoding, nil
+}
+
+// SelectForm finds the first form of in that matches args.
+//
+// Every other matching form is checked as well. If two forms differ only in
+// the width of a memory operand, nothing in args fixes the size and the
+// instruction is rejected with ErrAmbiguousOperandSize rather than guessing.
+func SelectForm(in *instruction.Instruction, args []operand.Arg) (*instruction.Form, error) {
+	var buf [8]*instruction.Form
+	matches, err := matchForms(in, args, buf[:0])
+	if err != nil {
+		return nil, err
+	}
+	if !gatherDistinct(matches[0], args) {
+		return nil, ErrGatherRegisters
+	}
+	return matches[0], nil
+}
+
+// MatchForms returns every form of in that matches args, in order. It fails
+// as SelectForm does for invalid arguments or an ambiguous operand size, but
+// leaves the choice among the forms to the caller.
+func MatchForms(in *instruction.Instruction, args []operand.Arg) ([]*instruction.Form, error) {
+	return matchForms(in, args, nil)
+}
+
+func matchForms(in *instruction.Instruction, args []operand.Arg, matches []*instruction.Form) ([]*instruction.Form, error) {
 	for _, arg := range args {
 		if err := arg.Validate(); err != nil {
 			return nil, err
@@ -20,24 +54,76 @@ func Select(in *instruction.Instruction, args []operand.Arg) (*instruction.Encod
 	}
 
 	for i := 0; i < len(in.Forms); i++ {
-		if matchOperands(in.Forms[i].Operands, args) {
-			return &in.Forms[i].Encoding, nil
+		f := &in.Forms[i]
+		if !matchOperands(f.Operands, args) {
+			continue
 		}
+		for _, m := range matches {
+			if onlyMemSizeDiffers(m.Operands, f.Operands) {
+				return nil, ErrAmbiguousOperandSize
+			}
+		}
+		matches = append(matches, f)
 	}
 
-	return nil, ErrUnsupportedInstruction
+	if len(matches) == 0 {
+		return nil, ErrUnsupportedInstruction
+	}
+	return matches, nil
 }
 
-func matchOperands(params operand.ParamList, args []operand.Arg) bool {
-	for a, i := 0, uint8(0); i < params.Len; i++ {
-		p := params.Val[i]
-		if p.ImmConst() {
-			continue
+// gatherDistinct reports whether the vector registers of a gather differ
+// from each other and from the index of its VSIB operand. The processor
+// raises #UD otherwise.
+func gatherDistinct(f *instruction.Form, args []operand.Arg) bool {
+	var index operand.Reg
+	for i, arg := range args {
+		if m, ok := arg.(operand.Mem); ok && m.VSIB() && f.Operands.Val[i].Input() {
+			index = m.Index
+		}
+	}
+	if index == 0 {
+		return true
+	}
+	seen := uint32(1) << index.ID()
+	for _, arg := range args {
+		if r, ok := arg.(operand.Reg); ok && r.Type() == operand.RegTypeVector {
+			if seen&(1<<r.ID()) != 0 {
+				return false
+			}
+			seen |= 1 << r.ID()
 		}
-		if a >= len(args) || !args[i].Matches(p) {
+	}
+	return true
+}
+
+func matchOperands(params operand.ParamList, args []operand.Arg) bool {
+	if int(params.Len) != len(args) {
+		return false
+	}
+	for i := uint8(0); i < params.Len; i++ {
+		if !args[i].Matches(params.Val[i]) {
 			return false
 		}
-		a++
 	}
 	return true
 }
+
+func onlyMemSizeDiffers(a, b operand.ParamList) bool {
+	if a.Len != b.Len {
+		return false
+	}
+	differs := false
+	for i := uint8(0); i < a.Len; i++ {
+		p, q := a.Val[i].Key(), b.Val[i].Key()
+		switch {
+		case p == q:
+		case p.Kind() == operand.KindMem && q.Kind() == operand.KindMem &&
+			operand.MemParam(p).Type() == operand.MemParam(q).Type():
+			differs = true
+		default:
+			return false
+		}
+	}
+	return differs
+}
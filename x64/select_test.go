@@ -0,0 +1,161 @@
+package x64
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	. "github.com/kalamay/x86/operand"
+)
+
+func TestSelectAmbiguous(t *testing.T) {
+	tests := []struct {
+		ID   InstructionID
+		Args []Arg
+		Err  error
+	}{
+		{INC, []Arg{Ptr(RAX)}, ErrAmbiguousOperandSize},
+		{INC, []Arg{SizedPtr(RAX, Size32)}, nil},
+		{ADD, []Arg{Ptr(RAX), Int(1)}, ErrAmbiguousOperandSize},
+		{ADD, []Arg{SizedPtr(RAX, Size64), Int(1)}, nil},
+		{ADD, []Arg{Ptr(RAX), RBX}, nil},
+		{MOV, []Arg{EAX, Ptr(RSI)}, nil},
+		{LEA, []Arg{RAX, Ptr(RBX).Offset(8)}, nil},
+		{SHL, []Arg{RAX, Int(1)}, nil},
+	}
+
+	for _, test := range tests {
+		_, err := Select(&Instructions.Instructions[test.ID], test.Args)
+		if !errors.Is(err, test.Err) {
+			t.Errorf("%s %v: expect=%v, actual=%v", test.ID, test.Args, test.Err, err)
+		}
+	}
+}
+
+func TestSelectGather(t *testing.T) {
+	tests := []struct {
+		Args   []Arg
+		Expect []byte
+		Err    error
+	}{
+		{[]Arg{XMM0, Ptr(RAX).Idx(XMM1, Size32), XMM2}, []byte{0xc4, 0xe2, 0x69, 0x90, 0x04, 0x88}, nil},
+		{[]Arg{YMM0, Ptr(RAX).Idx(YMM9, Size32).Offset(8), YMM2}, []byte{0xc4, 0xa2, 0x6d, 0x90, 0x44, 0x88, 0x08}, nil},
+		{[]Arg{XMM0, SizedPtr(RAX, Size32).Idx(XMM1, Size32), XMM2}, []byte{0xc4, 0xe2, 0x69, 0x90, 0x04, 0x88}, nil},
+		{[]Arg{XMM0, Ptr(RAX).Idx(YMM1, Size32), XMM2}, nil, ErrUnsupportedInstruction},
+		{[]Arg{XMM0, Ptr(RAX).Idx(RCX, Size32), XMM2}, nil, ErrUnsupportedInstruction},
+		{[]Arg{XMM0, Ptr(RAX).Idx(XMM0, Size32), XMM2}, nil, ErrGatherRegisters},
+		{[]Arg{XMM0, Ptr(RAX).Idx(XMM1, Size32), XMM1}, nil, ErrGatherRegisters},
+		{[]Arg{XMM0, Ptr(RAX).Idx(XMM1, Size32), XMM0}, nil, ErrGatherRegisters},
+		{[]Arg{XMM0, Ptr(RAX).Idx(MM1, Size32), XMM2}, nil, ErrUnsupportedIndex},
+	}
+
+	for _, test := range tests {
+		buf := bytes.Buffer{}
+		e := Emit{}
+		e.Open(NewMachine(), &buf)
+		e.VPGATHERDD(test.Args...)
+		errs := e.Close()
+		if test.Err != nil {
+			if len(errs) != 1 || !errors.Is(errs[0], test.Err) {
+				t.Errorf("%v: expect=%v, actual=%v", test.Args, test.Err, errs)
+			}
+			continue
+		}
+		for _, err := range errs {
+			t.Errorf("%v: %v", test.Args, err)
+		}
+		if !bytes.Equal(buf.Bytes(), test.Expect) {
+			t.Errorf("%v: expect=% x, actual=% x", test.Args, test.Expect, buf.Bytes())
+		}
+	}
+}
+
+func TestSelectPolicy(t *testing.T) {
+	tests := []struct {
+		Policy Policy
+		Expect []byte
+	}{
+		{nil, []byte{0xc4, 0xc1, 0x7a, 0x6f, 0xc8, 0x01, 0xd8}},
+		{Canonical, []byte{0xc4, 0xc1, 0x7a, 0x6f, 0xc8, 0x01, 0xd8}},
+		{Shortest, []byte{0xc5, 0x7a, 0x7f, 0xc1, 0x01, 0xd8}},
+		{AvoidPrefix(0xc4), []byte{0xc5, 0x7a, 0x7f, 0xc1, 0x01, 0xd8}},
+		{AvoidPrefix(0xc5), []byte{0xc4, 0xc1, 0x7a, 0x6f, 0xc8, 0x01, 0xd8}},
+	}
+
+	buf := bytes.Buffer{}
+	e := Emit{}
+	for i, test := range tests {
+		buf.Reset()
+		m := NewMachine()
+		m.SetPolicy(test.Policy)
+		e.Open(m, &buf)
+		e.VMOVDQU(XMM1, XMM8)
+		e.ADD(EAX, EBX)
+		for _, err := range e.Close() {
+			t.Errorf("%d: %v", i, err)
+		}
+		if !bytes.Equal(test.Expect, buf.Bytes()) {
+			t.Errorf("%d: failed to encode:\n\texpect = %#v\n\tactual = %#v", i, test.Expect, buf.Bytes())
+		}
+
+		call := NewCall(VMOVDQU, XMM1, XMM8)
+		if min, max, err := test.Policy.Length(call); err != nil || min != len(test.Expect)-2 || max != min {
+			t.Errorf("%d: expected length %d, got %d-%d, %v", i, len(test.Expect)-2, min, max, err)
+		}
+	}
+
+	f, err := SelectForm(&Instructions.Instructions[ADD], []Arg{EAX, EBX})
+	if err != nil || len(f.Encodings) != 2 || !reflect.DeepEqual(f.Encoding, f.Encodings[0]) {
+		t.Errorf("expected both encodings of ADD r32, r32 to be kept")
+	}
+}
+
+func TestSelectLabel(t *testing.T) {
+	tests := []struct {
+		ID    InstructionID
+		Param string
+		Err   error
+	}{
+		{JMP, "rel8", nil},
+		{JE, "rel8", nil},
+		{CALL, "rel32", nil},
+		{MOV, "", ErrUnsupportedInstruction},
+	}
+
+	for _, test := range tests {
+		args := []Arg{Label("end")}
+		if test.ID == MOV {
+			args = append(args, RAX)
+		}
+		f, err := SelectForm(&Instructions.Instructions[test.ID], args)
+		if !errors.Is(err, test.Err) {
+			t.Errorf("%s: expect=%v, actual=%v", test.ID, test.Err, err)
+			continue
+		}
+		if err == nil && f.Operands.Val[0].String() != test.Param {
+			t.Errorf("%s: expect=%s, actual=%s", test.ID, test.Param, f.Operands.Val[0])
+		}
+	}
+
+	// The machine resolves labels before selecting, so the offset decides
+	// the size of the jump.
+	for _, n := range []int{16, 200} {
+		buf := bytes.Buffer{}
+		e := Emit{}
+		e.Open(NewMachine(), &buf)
+		e.JMP(Label("end"))
+		e.Data(make([]byte, n))
+		e.Label("end")
+		for _, err := range e.Close() {
+			t.Error(err)
+		}
+		op := byte(0xeb)
+		if n > 127 {
+			op = 0xe9
+		}
+		if buf.Bytes()[0] != op {
+			t.Errorf("jmp over %d bytes: expect=%02x, actual=%02x", n, op, buf.Bytes()[0])
+		}
+	}
+}